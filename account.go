@@ -0,0 +1,316 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/gorp.v2"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// account token lifetimes, XXX fix for your users
+var (
+	verifyTTL = 24 * time.Hour
+	resetTTL  = time.Hour
+	minPass   = 8
+)
+
+// Token db type of a single-use account token, only its sha256 is stored
+type Token struct {
+	Id      int64     `db:"id" json:"id"`
+	UserId  int64     `db:"userid" json:"userid"`
+	Kind    string    `db:"kind" json:"kind"` // verify or reset
+	Hash    string    `db:"hash" json:"-"`
+	Expires int64     `db:"expires" json:"expires"` // unix time
+	Created time.Time `db:"created" json:"created"`
+}
+
+// PreInsert set created time before insert in db
+func (a *Token) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	return nil
+}
+
+// AccountRequest body of account endpoints
+type AccountRequest struct {
+	Name  string `json:"name" form:"name"`
+	Email string `json:"mail" form:"mail"`
+	Pass  string `json:"pass" form:"pass" log:"redact"`
+	Token string `json:"token" form:"token" log:"redact"`
+}
+
+// hashPass bcrypt a clear password of hooks, stored hashes are kept:
+// passwords of clients go through SetPassword
+func hashPass(pass string) (string, error) {
+	if pass == "" || strings.HasPrefix(pass, "$2a$") {
+		return pass, nil
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// SetPassword check a clear password length and store its hash, a
+// password like a hash is hashed too
+func (a *User) SetPassword(pass string) error {
+	if err := checkPass(pass); err != nil {
+		return err
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	a.Pass = string(b)
+	return err
+}
+
+// CheckPassword compare a clear password with the stored hash
+func (a *User) CheckPassword(pass string) bool {
+	return a.Pass != "" && bcrypt.CompareHashAndPassword([]byte(a.Pass), []byte(pass)) == nil
+}
+
+func checkPass(pass string) error {
+	if len(pass) < minPass || len(pass) > 72 {
+		return errors.New("password must have 8 to 72 characters")
+	}
+	return nil
+}
+
+func tokenHash(raw string) string {
+	h := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(h[:])
+}
+
+// issueToken replace unused tokens of kind for user by a new one, return it in clear
+func issueToken(dbmap *gorp.DbMap, userId int64, kind string, ttl time.Duration) (string, Token, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Token{}, err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(b)
+	t := Token{UserId: userId, Kind: kind, Hash: tokenHash(raw), Expires: time.Now().Add(ttl).Unix()}
+
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return "", t, err
+	}
+	_, err = tx.Exec("DELETE FROM token WHERE (userid=? AND kind=?) OR expires<?", userId, kind, time.Now().Unix())
+	if err == nil {
+		err = tx.Insert(&t)
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", t, err
+	}
+	return raw, t, tx.Commit()
+}
+
+// consumeToken delete a valid token and return its user, a token is used once
+func consumeToken(dbmap *gorp.DbMap, kind string, raw string) (User, error) {
+	var user User
+	var t Token
+	invalid := errors.New("invalid or expired token")
+	if raw == "" || dbmap.SelectOne(&t, "SELECT * FROM token WHERE hash=? AND kind=?", tokenHash(raw), kind) != nil {
+		return user, invalid
+	}
+	res, err := dbmap.Exec("DELETE FROM token WHERE id=?", t.Id)
+	if err != nil {
+		return user, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 || time.Now().Unix() > t.Expires {
+		return user, invalid // used by a concurrent request or expired
+	}
+	if dbmap.SelectOne(&user, "SELECT * FROM user WHERE id=?", t.UserId) != nil {
+		return user, invalid
+	}
+	return user, nil
+}
+
+// sendToken issue a token and mail its link to user
+func sendToken(c *gin.Context, user User, kind string, ttl time.Duration) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	l := logger(c)
+	v, ok := c.Get("Mailer")
+	base := c.GetString("AccountURL")
+	if !ok || base == "" {
+		l.Error("no mailer or account url for account mails")
+		return
+	}
+
+	raw, t, err := issueToken(dbmap, user.Id, kind, ttl)
+	if err != nil {
+		l.Error("token failed", "kind", kind, "error", err)
+		return
+	}
+	subject, body, err := renderMail(kind, gin.H{
+		"User":    user,
+		"Link":    base + "/" + kind + "/confirm?token=" + raw,
+		"Expires": time.Unix(t.Expires, 0),
+	})
+	if err == nil {
+		err = v.(Mailer).Send(user.Email, subject, body)
+	}
+	if err != nil {
+		l.Error("account mail failed", "kind", kind, "user", user.Id, "error", err)
+		return
+	}
+	l.Info("account mail sent", "kind", kind, "user", user.Id)
+}
+
+// userByEmail find a user of the request tenant by mail address
+func userByEmail(c *gin.Context, email string) (User, bool) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	var user User
+	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE "+tenantScope(c, "user", "email=?")+" LIMIT 1", email)
+	return user, err == nil && email != ""
+}
+
+// PostSignup create a pending user and mail a verification link
+func PostSignup(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	var req AccountRequest
+	if bind(c, &req) != nil {
+		return
+	}
+	logger(c).Debug("signup", "request", Redact(req))
+
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil || addr.Address != req.Email || req.Name == "" {
+		renderError(c, 400, "mandatory fields are empty or invalid")
+		return
+	}
+	if err = checkPass(req.Pass); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	if _, exists := userByEmail(c, req.Email); exists {
+		renderError(c, 409, "mail address already used")
+		return
+	}
+
+	user := User{Name: req.Name, Email: req.Email, Status: UserPending}
+	if err = user.SetPassword(req.Pass); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	setTenant(c, &user)
+	start := time.Now()
+	err = dbmap.Insert(&user)
+	trace(c, "INSERT user signup", start, err)
+	if err != nil {
+		renderUnavailable(c, "signup failed", err)
+		return
+	}
+	invalidate(c, "user")
+	notify(c, "user", "created", user, nil)
+	sendToken(c, user, "verify", verifyTTL)
+	render(c, 201, user)
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"name\": \"Thea\", \"mail\": \"thea@example.org\", \"pass\": \"s3cr3t-pass\" }" http://localhost:8080/api/v1/account/signup
+}
+
+// PostVerifyRequest mail a new verification link to a pending user,
+// the response does not tell if the address is known
+func PostVerifyRequest(c *gin.Context) {
+	var req AccountRequest
+	if bind(c, &req) != nil {
+		return
+	}
+	if user, ok := userByEmail(c, req.Email); ok && user.Status == UserPending {
+		sendToken(c, user, "verify", verifyTTL)
+	}
+	render(c, 202, gin.H{"status": "verification mail sent to known pending address"})
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"mail\": \"thea@example.org\" }" http://localhost:8080/api/v1/account/verify
+}
+
+// VerifyConfirm activate the user of a verification token, from the
+// mail link (GET ?token=) or a POST body
+func VerifyConfirm(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	req := AccountRequest{Token: c.Query("token")}
+	if req.Token == "" && bind(c, &req) != nil {
+		return
+	}
+	user, err := consumeToken(dbmap, "verify", req.Token)
+	if err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+
+	previous := user
+	user.Status = UserActive
+	if err = checkStatus(&user, &previous); err != nil {
+		renderError(c, 409, err.Error())
+		return
+	}
+	start := time.Now()
+	_, err = dbmap.Update(&user)
+	trace(c, "UPDATE user verify", start, err)
+	if err != nil {
+		renderUnavailable(c, "verify failed", err)
+		return
+	}
+	invalidate(c, "user")
+	c.Set("Reason", "email verified")
+	notify(c, "user", "updated", user, previous)
+	render(c, 200, user)
+
+	// curl -i http://localhost:8080/api/v1/account/verify/confirm?token=...
+}
+
+// PostResetRequest mail a password reset link, the response does not
+// tell if the address is known
+func PostResetRequest(c *gin.Context) {
+	var req AccountRequest
+	if bind(c, &req) != nil {
+		return
+	}
+	if user, ok := userByEmail(c, req.Email); ok && user.Status != UserDisabled {
+		sendToken(c, user, "reset", resetTTL)
+	}
+	render(c, 202, gin.H{"status": "reset mail sent to known address"})
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"mail\": \"thea@example.org\" }" http://localhost:8080/api/v1/account/reset
+}
+
+// PostResetConfirm set a new password with a reset token
+func PostResetConfirm(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	var req AccountRequest
+	if bind(c, &req) != nil {
+		return
+	}
+	if err := checkPass(req.Pass); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	user, err := consumeToken(dbmap, "reset", req.Token)
+	if err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+
+	previous := user
+	if err = user.SetPassword(req.Pass); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	start := time.Now()
+	_, err = dbmap.Update(&user)
+	trace(c, "UPDATE user reset", start, err)
+	if err != nil {
+		renderUnavailable(c, "password reset failed", err)
+		return
+	}
+	invalidate(c, "user")
+	notify(c, "user", "updated", user, previous)
+	render(c, 200, gin.H{"status": "password changed"})
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"token\": \"...\", \"pass\": \"n3w-s3cr3t\" }" http://localhost:8080/api/v1/account/reset/confirm
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAccount(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	mailer := &MemoryMailer{}
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(SetMailer(mailer, "http://example.org/api/v1/account"))
+
+	var urla = "/api/v1/account"
+	router.POST(urla+"/signup", PostSignup)
+	router.POST(urla+"/verify", PostVerifyRequest)
+	router.GET(urla+"/verify/confirm", VerifyConfirm)
+	router.POST(urla+"/verify/confirm", VerifyConfirm)
+	router.POST(urla+"/reset", PostResetRequest)
+	router.POST(urla+"/reset/confirm", PostResetConfirm)
+
+	do := func(method string, path string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		req.Host = "evil.example.com" // links never follow the request Host
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	link := regexp.MustCompile(`http://example.org/api/v1/account/(verify|reset)/confirm\?token=([A-Za-z0-9_-]+)`)
+	token := func(to string, kind string) string {
+		m, ok := mailer.Last(to)
+		assert.True(t, ok, "mail sent")
+		parts := link.FindStringSubmatch(m.Body)
+		if assert.Equal(t, 3, len(parts), "mail link") {
+			assert.Equal(t, kind, parts[1], "link kind")
+			return parts[2]
+		}
+		return ""
+	}
+	user := func() *User {
+		var u User
+		dbmap.SelectOne(&u, "SELECT * FROM user WHERE email=?", "thea@example.org")
+		return &u
+	}
+
+	// Signup
+	log.Println("= Signup creates pending user and mails verification")
+	resp := do("POST", urla+"/signup", AccountRequest{Name: "Thea", Email: "thea@example.org", Pass: "s3cr3t-pass"})
+	assert.Equal(t, 201, resp.Code, "http POST signup")
+	assert.NotContains(t, resp.Body.String(), "s3cr3t", "no password in response")
+	assert.Equal(t, UserPending, user().Status, "pending")
+	assert.True(t, user().CheckPassword("s3cr3t-pass"), "password hashed")
+	assert.NotEqual(t, "s3cr3t-pass", user().Pass, "password not stored in clear")
+	m, _ := mailer.Last("thea@example.org")
+	assert.Equal(t, "Verify your email address", m.Subject, "subject from template")
+	assert.Contains(t, m.Body, "Hello Thea", "body from template")
+
+	resp = do("POST", urla+"/signup", AccountRequest{Name: "Thea", Email: "thea@example.org", Pass: "s3cr3t-pass"})
+	assert.Equal(t, 409, resp.Code, "http POST signup same mail")
+	resp = do("POST", urla+"/signup", AccountRequest{Name: "Short", Email: "short@example.org", Pass: "short"})
+	assert.Equal(t, 400, resp.Code, "http POST signup short password")
+	resp = do("POST", urla+"/signup", AccountRequest{Name: "Bad", Email: "not a mail", Pass: "s3cr3t-pass"})
+	assert.Equal(t, 400, resp.Code, "http POST signup invalid mail")
+
+	// Verify
+	log.Println("= Verification token is single use and replaced by a new request")
+	first := token("thea@example.org", "verify")
+	resp = do("POST", urla+"/verify", AccountRequest{Email: "thea@example.org"})
+	assert.Equal(t, 202, resp.Code, "http POST verify request")
+	second := token("thea@example.org", "verify")
+	assert.NotEqual(t, first, second, "new token")
+	resp = do("GET", urla+"/verify/confirm?token="+first, nil)
+	assert.Equal(t, 400, resp.Code, "replaced token")
+	resp = do("GET", urla+"/verify/confirm?token="+second, nil)
+	assert.Equal(t, 200, resp.Code, "http GET verify confirm")
+	assert.Equal(t, UserActive, user().Status, "active")
+	resp = do("POST", urla+"/verify/confirm", AccountRequest{Token: second})
+	assert.Equal(t, 400, resp.Code, "used token")
+	n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM token")
+	assert.Equal(t, int64(0), n, "no token left")
+
+	log.Println("= Unknown addresses get the same answer")
+	count := len(mailer.Mails)
+	resp = do("POST", urla+"/verify", AccountRequest{Email: "thea@example.org"})
+	assert.Equal(t, 202, resp.Code, "http POST verify of active user")
+	resp = do("POST", urla+"/reset", AccountRequest{Email: "nobody@example.org"})
+	assert.Equal(t, 202, resp.Code, "http POST reset of unknown mail")
+	assert.Equal(t, count, len(mailer.Mails), "no mail")
+
+	// Reset
+	log.Println("= Password reset")
+	resp = do("POST", urla+"/reset", AccountRequest{Email: "thea@example.org"})
+	assert.Equal(t, 202, resp.Code, "http POST reset request")
+	reset := token("thea@example.org", "reset")
+	resp = do("POST", urla+"/reset/confirm", AccountRequest{Token: reset, Pass: "short"})
+	assert.Equal(t, 400, resp.Code, "short password keeps token")
+	resp = do("POST", urla+"/reset/confirm", AccountRequest{Token: reset, Pass: "n3w-s3cr3t"})
+	assert.Equal(t, 200, resp.Code, "http POST reset confirm")
+	assert.True(t, user().CheckPassword("n3w-s3cr3t"), "new password")
+	assert.False(t, user().CheckPassword("s3cr3t-pass"), "old password")
+	resp = do("POST", urla+"/reset/confirm", AccountRequest{Token: reset, Pass: "an0ther-pass"})
+	assert.Equal(t, 400, resp.Code, "used token")
+
+	log.Println("= Expired token")
+	resetTTL = -time.Second
+	do("POST", urla+"/reset", AccountRequest{Email: "thea@example.org"})
+	resetTTL = time.Hour
+	resp = do("POST", urla+"/reset/confirm", AccountRequest{Token: token("thea@example.org", "reset"), Pass: "an0ther-pass"})
+	assert.Equal(t, 400, resp.Code, "expired token")
+	assert.True(t, user().CheckPassword("n3w-s3cr3t"), "password unchanged")
+
+	log.Println("= Hash-like password is hashed")
+	hashLike := "$2a$10$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234"
+	do("POST", urla+"/reset", AccountRequest{Email: "thea@example.org"})
+	resp = do("POST", urla+"/reset/confirm", AccountRequest{Token: token("thea@example.org", "reset"), Pass: hashLike})
+	assert.Equal(t, 200, resp.Code, "http POST reset confirm")
+	assert.NotEqual(t, hashLike, user().Pass, "input stored hashed")
+	assert.True(t, user().CheckPassword(hashLike), "hash-like password")
+	assert.NotContains(t, resp.Body.String(), `"pass"`, "no pass in response")
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// AdminField admin UI description of a model field
+type AdminField struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"` // string, number, boolean, date, password or reference
+	Required  bool     `json:"required,omitempty"`
+	ReadOnly  bool     `json:"readOnly,omitempty"`
+	Reference string   `json:"reference,omitempty"` // resource of a reference, like users
+	Choices   []string `json:"choices,omitempty"`   // states of a Status field
+}
+
+// AdminResource admin UI description of a registered model
+type AdminResource struct {
+	Name   string       `json:"name"`  // route, like agents
+	Model  string       `json:"model"` // like Agent
+	Fields []AdminField `json:"fields"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// AdminResources describe registered models for admin UIs like react-admin
+// or ng-admin, fields by json name
+func AdminResources() []AdminResource {
+	var resources []AdminResource
+	for _, m := range Models() {
+		r := AdminResource{Name: plural(m.Resource()), Model: m.Name, Fields: []AdminField{}}
+		for _, f := range m.Fields() {
+			field := AdminField{Name: f.JSON, Type: adminType(f.Type), Required: f.Required}
+			switch {
+			case f.Ref != "":
+				field.Type = "reference"
+				field.Reference = plural(strings.ToLower(f.Ref))
+			case m.Type.Field(f.Index).Tag.Get("log") == "redact":
+				field.Type = "password"
+			}
+			switch f.Column {
+			case "id", "created", "updated": // set by db and hooks
+				field.ReadOnly = true
+			case "status":
+				if st, ok := m.New().(Stateful); ok {
+					field.Choices = st.States().States()
+				}
+			}
+			r.Fields = append(r.Fields, field)
+		}
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+// adminType admin UI type of a Go type
+func adminType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	if t == timeType {
+		return "date"
+	}
+	return "string"
+}
+
+// GetAdminConfig return resources of registered models for admin UIs
+func GetAdminConfig(c *gin.Context) {
+	c.JSON(200, gin.H{"resources": AdminResources()})
+
+	// curl -i http://localhost:8080/admin/config
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestReactAdminQuery(t *testing.T) {
+	log.Println("= react-admin translated query")
+	q, _ := url.ParseQuery(`range=[5,9]&sort=["name","DESC"]&filter={"name":"web","owner":3,"id":[1,2,"x y"]}`)
+	query, sort, limit := ParseQuery(q)
+	assert.Contains(t, query, "name LIKE \"%web%\"", "filter")
+	assert.Contains(t, query, "owner=3", "reference filter")
+	assert.Contains(t, query, "id IN (1,2)", "ids filter, invalid values dropped")
+	assert.Equal(t, " ORDER BY name DESC", sort, "sort")
+	assert.Equal(t, " LIMIT 5, 5", limit, "range")
+	assert.Equal(t, 5, firstRecord(q), "first record")
+
+	q, _ = url.ParseQuery(`range=[9,5]&sort=["name"]&filter={"id":[]}`)
+	query, sort, limit = ParseQuery(q)
+	assert.Equal(t, "0", query, "empty list matches nothing")
+	assert.Equal(t, "", sort, "invalid sort")
+	assert.Equal(t, "", limit, "invalid range")
+
+	log.Println("= react-admin full-text search ignored")
+	q, _ = url.ParseQuery(`filter={"q":"web","name":"db"}`)
+	query, _, _ = ParseQuery(q)
+	assert.Equal(t, "name LIKE \"%db%\"", query, "q dropped")
+	assert.Nil(t, checkFilters("agent", q), "q accepted")
+	q, _ = url.ParseQuery(`filter={"q":"web"}`)
+	query, _, _ = ParseQuery(q)
+	assert.Equal(t, "", query, "no condition")
+
+	log.Println("= ng-admin first record")
+	q, _ = url.ParseQuery("_perPage=5&_page=2")
+	assert.Equal(t, 5, firstRecord(q), "same offset as ParseQuery")
+	q, _ = url.ParseQuery("_start=2&_end=3")
+	assert.Equal(t, 1, firstRecord(q), "_start from 1")
+}
+
+func TestContentRange(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla, GetAgents)
+
+	for _, a := range []Agent{{Name: "web1", IP: "10.0.0.1"}, {Name: "web2", IP: "10.0.0.2"}, {Name: "db1", IP: "10.0.1.1"}} {
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(a)
+		req, _ := http.NewRequest("POST", urla, b)
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	get := func(query string) (*httptest.ResponseRecorder, []Agent) {
+		req, _ := http.NewRequest("GET", urla+"?"+query, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var as []Agent
+		json.Unmarshal(resp.Body.Bytes(), &as)
+		return resp, as
+	}
+
+	log.Println("= react-admin list")
+	resp, as := get(url.Values{"range": {"[1,2]"}, "sort": {`["id","ASC"]`}, "filter": {`{"name":"web"}`}}.Encode())
+	assert.Equal(t, 200, resp.Code, "http GET")
+	assert.Equal(t, "agents 1-1/2", resp.Header().Get("Content-Range"), "Content-Range")
+	if assert.Len(t, as, 1, "second web agent") {
+		assert.Equal(t, "web2", as[0].Name, "sorted")
+	}
+	resp, _ = get(url.Values{"filter": {`{"id":[1,3]}`}}.Encode())
+	assert.Equal(t, "agents 0-1/2", resp.Header().Get("Content-Range"), "getMany")
+	resp, _ = get(url.Values{"filter": {`{"name":"none"}`}}.Encode())
+	assert.Equal(t, "agents */0", resp.Header().Get("Content-Range"), "empty list")
+	resp, as = get(url.Values{"filter": {`{"q":"web"}`}}.Encode())
+	assert.Equal(t, 200, resp.Code, "full-text search ignored")
+	assert.Len(t, as, 3, "all agents")
+
+	log.Println("= ng-admin list")
+	resp, _ = get("_start=2&_end=3&_sortField=id&_sortDir=ASC")
+	assert.Equal(t, "3", resp.Header().Get("X-Total-Count"), "X-Total-Count")
+	assert.Equal(t, "agents 1-2/3", resp.Header().Get("Content-Range"), "Content-Range")
+	resp, _ = get("_perPage=2&_page=2&_sortField=id&_sortDir=ASC")
+	assert.Equal(t, "agents 2-2/3", resp.Header().Get("Content-Range"), "Content-Range of a page")
+}
+
+func TestAdminConfig(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Database(config.DBname))
+	router.GET("/admin/config", GetAdminConfig)
+
+	log.Println("= Resources of registered models")
+	req, _ := http.NewRequest("GET", "/admin/config", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET")
+	var r struct{ Resources []AdminResource }
+	json.Unmarshal(resp.Body.Bytes(), &r)
+
+	fields := make(map[string]map[string]AdminField)
+	for _, res := range r.Resources {
+		fields[res.Name] = make(map[string]AdminField)
+		for _, f := range res.Fields {
+			fields[res.Name][f.Name] = f
+		}
+	}
+	assert.Contains(t, fields, "agents", "agents")
+	assert.Contains(t, fields, "users", "users")
+	for name, resource := range map[string]string{"agent": "agents", "status": "statuses", "policy": "policies", "key": "keys", "box": "boxes"} {
+		assert.Equal(t, resource, plural(name), "plural of "+name)
+	}
+	assert.Equal(t, AdminField{Name: "id", Type: "number", ReadOnly: true}, fields["agents"]["id"], "id")
+	assert.Equal(t, AdminField{Name: "ip", Type: "string", Required: true}, fields["agents"]["ip"], "required")
+	assert.Equal(t, AdminField{Name: "owner", Type: "reference", Reference: "users"}, fields["agents"]["owner"], "reference")
+	assert.Equal(t, "date", fields["agents"]["lastseen"].Type, "date")
+	assert.Contains(t, fields["agents"]["status"].Choices, AgentOffline, "status choices")
+	assert.Equal(t, "password", fields["users"]["pass"].Type, "password")
+	assert.Contains(t, fields["users"], "mail", "json names")
+	assert.NotContains(t, fields["agents"], "ipkey", "internal fields")
+	assert.NotContains(t, fields["agents"], "tenant", "internal fields")
+}
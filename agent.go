@@ -1,7 +1,6 @@
 package models
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"gopkg.in/gorp.v2"
 	"strconv"
@@ -22,48 +21,122 @@ or remove sqlite tricks
 // Agent db and json type
 type Agent struct {
 	Id         int64     `db:"id" json:"id"`
-	Name       string    `db:"name" json:"name"`
-	IP         string    `db:"ip" json:"ip"`
+	Name       string    `db:"name" json:"name" valid:"required"`
+	IP         string    `db:"ip" json:"ip" valid:"required"`
+	IPKey      string    `db:"ipkey" json:"-"` // sortable ip, set by hooks
 	FileSurvey string    `db:"filesurvey" json:"filesurvey"`
 	Role       string    `db:"role" json:"role"`
 	Status     string    `db:"status" json:"status"`
+	Owner      int64     `db:"owner" json:"owner" ref:"User"`
+	Tenant     string    `db:"tenant" json:"-"`                          // set by handlers from Tenant middleware
+	LastSeen   time.Time `db:"lastseen" json:"lastseen" readonly:"true"` // set by heartbeat
+	LastIP     string    `db:"lastip" json:"lastip" readonly:"true"`
 	Created    time.Time `db:"created" json:"created"` // or int64
 	Updated    time.Time `db:"updated" json:"updated"`
 }
 
-// Hooks : PreInsert and PreUpdate
+// Validate check mandatory fields before Insert and Update
+func (a *Agent) Validate() error {
+	if err := required(a); err != nil {
+		return err
+	}
+	ip, err := normalizeIP(a.IP)
+	if err != nil {
+		return err
+	}
+	a.IP = ip
+	return nil // XXX add custom checks
+}
+
+// XXX custom states
+// Agent status, heartbeats and sweeper only move agents between new, online and offline
+const (
+	AgentNew            = "new"
+	AgentOnline         = "online"
+	AgentOffline        = "offline"
+	AgentMaintenance    = "maintenance"
+	AgentDecommissioned = "decommissioned"
+)
+
+// AgentStates allowed Status values and transitions of agents
+var AgentStates = &StateMachine{
+	Initial: AgentNew,
+	Transitions: map[string][]string{
+		AgentNew:            {AgentOnline, AgentOffline, AgentMaintenance, AgentDecommissioned},
+		AgentOnline:         {AgentOffline, AgentMaintenance},
+		AgentOffline:        {AgentOnline, AgentMaintenance, AgentDecommissioned},
+		AgentMaintenance:    {AgentOnline, AgentOffline, AgentDecommissioned},
+		AgentDecommissioned: {},
+	},
+}
+
+// States state machine of Status field
+func (a *Agent) States() *StateMachine {
+	return AgentStates
+}
+
+// Hooks : PreInsert, PreUpdate and PostDelete
 
 // PreInsert set created an updated time before insert in db
 func (a *Agent) PreInsert(s gorp.SqlExecutor) error {
 	a.Created = time.Now() // or time.Now().UnixNano()
 	a.Updated = a.Created
+	a.IPKey = ipKey(a.IP)
 	return nil
 }
 
 // PreUpdate set updated time before insert in db
 func (a *Agent) PreUpdate(s gorp.SqlExecutor) error {
 	a.Updated = time.Now()
+	a.IPKey = ipKey(a.IP)
 	return nil
 }
 
+// PostDelete delete files and file changes of the agent, for every
+// delete: REST, GraphQL or admin
+func (a *Agent) PostDelete(s gorp.SqlExecutor) error {
+	if _, err := s.Exec("DELETE FROM agentfile WHERE agentid=?", a.Id); err != nil {
+		return err
+	}
+	_, err := s.Exec("DELETE FROM agentfilechange WHERE agentid=?", a.Id)
+	return err
+}
+
 // REST handlers
 
 // GetAgents return all agents filtered by URL query
 func GetAgents(c *gin.Context) {
 	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
-	verbose := c.MustGet("Verbose").(bool)
 	query := "SELECT * FROM agent"
 
 	// Parse query string
 	q := c.Request.URL.Query()
+	if err := checkFilters("agent", q); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
 	s, o, l := ParseQuery(q)
-	var count int64
+	s = tenantScope(c, "agent", s)
+
+	if cached, ok := cacheGet(c, "agent", c.Request.URL.RawQuery); ok {
+		if !notModified(c, cached.tag, time.Time{}) {
+			c.Header("X-Total-Count", strconv.FormatInt(cached.count, 10))
+			render(c, 200, cached.data)
+		}
+		return
+	}
+
+	where := ""
 	if s != "" {
-		count, _ = dbmap.SelectInt("SELECT COUNT(*) FROM user  WHERE " + s)
-		query = query + " WHERE " + s
-	} else {
-		count, _ = dbmap.SelectInt("SELECT COUNT(*) FROM user")
+		where = " WHERE " + s
 	}
+	count, updated := listVersion(c, "agent", where)
+	tag := etag("agent", strconv.FormatInt(count, 10), updated, c.Request.URL.RawQuery)
+	if notModified(c, tag, time.Time{}) { // no Last-Modified, MAX(updated) stays the same after a delete
+		return
+	}
+
+	query = query + where
 	if o != "" {
 		query = query + o
 	}
@@ -71,19 +144,20 @@ func GetAgents(c *gin.Context) {
 		query = query + l
 	}
 
-	if verbose == true {
-		fmt.Println(q)
-		fmt.Println("query: " + query)
-	}
+	logger(c).Debug("list agents", "params", q)
 
 	var agents []Agent
+	start := time.Now()
 	_, err := dbmap.Select(&agents, query)
+	trace(c, query, start, err)
 
 	if err == nil {
+		countRows(c, len(agents))
+		cachePut(c, "agent", c.Request.URL.RawQuery, cacheEntry{tag: tag, count: count, data: agents})
 		c.Header("X-Total-Count", strconv.FormatInt(count, 10)) // float64 to string
-		c.JSON(200, agents)
+		render(c, 200, agents)
 	} else {
-		c.JSON(404, gin.H{"error": "no agent(s) into the table"})
+		renderError(c, 404, "no agent(s) into the table")
 	}
 
 	// curl -i http://localhost:8080/api/v1/agents
@@ -95,12 +169,15 @@ func GetAgent(c *gin.Context) {
 	id := c.Params.ByName("id")
 
 	var agent Agent
-	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE id=? LIMIT 1", id)
+	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE "+tenantScope(c, "agent", "id=?")+" LIMIT 1", id)
 
 	if err == nil {
-		c.JSON(200, agent)
+		if notModified(c, etag("agent", id, agent.Updated.Format(time.RFC3339Nano)), agent.Updated) {
+			return
+		}
+		render(c, 200, agent)
 	} else {
-		c.JSON(404, gin.H{"error": "agent not found"})
+		renderError(c, 404, "agent not found")
 	}
 
 	// curl -i http://localhost:8080/api/v1/agents/1
@@ -109,25 +186,33 @@ func GetAgent(c *gin.Context) {
 // PostAgent create and return agent
 func PostAgent(c *gin.Context) {
 	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
-	verbose := c.MustGet("Verbose").(bool)
 
 	var agent Agent
-	c.Bind(&agent)
-
-	if verbose == true {
-		fmt.Println(agent)
+	if bind(c, &agent) != nil {
+		return
 	}
 
-	if agent.Name != "" && agent.IP != "" { // XXX Check mandatory fields
-		err := dbmap.Insert(&agent)
+	logger(c).Debug("post agent", "agent", Redact(agent))
+	setTenant(c, &agent)
+
+	err := agent.Validate()
+	if err == nil {
+		err = checkStatus(&agent, nil)
+	}
+	if err == nil {
+		start := time.Now()
+		err = dbmap.Insert(&agent)
+		trace(c, "INSERT agent", start, err)
 		if err == nil {
-			c.JSON(201, agent)
+			invalidate(c, "agent")
+			notify(c, "agent", "created", agent, nil)
+			render(c, 201, agent)
 		} else {
 			checkErr(err, "Insert failed")
 		}
 
 	} else {
-		c.JSON(400, gin.H{"error": "Mandatory fields are empty"})
+		renderError(c, 400, err.Error())
 	}
 
 	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"firstname\": \"Thea\", \"lastname\": \"Queen\" }" http://localhost:8080/api/v1/agents
@@ -136,17 +221,17 @@ func PostAgent(c *gin.Context) {
 // UpdateAgent by id
 func UpdateAgent(c *gin.Context) {
 	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
-	verbose := c.MustGet("Verbose").(bool)
 	id := c.Params.ByName("id")
 
 	var agent Agent
-	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE id=?", id)
+	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE "+tenantScope(c, "agent", "id=?"), id)
 	if err == nil {
 		var json Agent
-		c.Bind(&json)
-		if verbose == true {
-			fmt.Println(json)
+		if bind(c, &json) != nil {
+			return
 		}
+		logger(c).Debug("update agent", "id", id, "agent", Redact(json))
+		previous := agent
 		agentId, _ := strconv.ParseInt(id, 0, 64)
 
 		//TODO : find fields via reflections
@@ -158,23 +243,35 @@ func UpdateAgent(c *gin.Context) {
 			Role:       json.Role,
 			FileSurvey: json.FileSurvey,
 			Status:     json.Status,
+			Owner:      json.Owner,
+			Tenant:     agent.Tenant,
+			LastSeen:   agent.LastSeen,
+			LastIP:     agent.LastIP,
 			Created:    agent.Created, //agent read from previous select
 		}
 
-		if agent.Name != "" && agent.IP != "" { // XXX Check mandatory fields
+		err = agent.Validate()
+		if err == nil {
+			err = checkStatus(&agent, &previous)
+		}
+		if err == nil {
+			start := time.Now()
 			_, err = dbmap.Update(&agent)
+			trace(c, "UPDATE agent id="+id, start, err)
 			if err == nil {
-				c.JSON(200, agent)
+				invalidate(c, "agent")
+				notify(c, "agent", "updated", agent, previous)
+				render(c, 200, agent)
 			} else {
 				checkErr(err, "Updated failed")
 			}
 
 		} else {
-			c.JSON(400, gin.H{"error": "mandatory fields are empty"})
+			renderError(c, errorStatus(err), err.Error())
 		}
 
 	} else {
-		c.JSON(404, gin.H{"error": "agent not found"})
+		renderError(c, 404, "agent not found")
 	}
 
 	// curl -i -X PUT -H "Content-Type: application/json" -d "{ \"firstname\": \"Thea\", \"lastname\": \"Merlyn\" }" http://localhost:8080/api/v1/agents/1
@@ -186,20 +283,40 @@ func DeleteAgent(c *gin.Context) {
 	id := c.Params.ByName("id")
 
 	var agent Agent
-	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE id=?", id)
+	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE "+tenantScope(c, "agent", "id=?"), id)
 
 	if err == nil {
+		start := time.Now()
 		_, err = dbmap.Delete(&agent)
+		trace(c, "DELETE agent id="+id, start, err)
 
 		if err == nil {
-			c.JSON(200, gin.H{"id #" + id: "deleted"})
+			invalidate(c, "agent")
+			notify(c, "agent", "deleted", agent, nil)
+			render(c, 200, gin.H{"id": agent.Id, "status": "deleted"})
 		} else {
 			checkErr(err, "Delete failed")
 		}
 
 	} else {
-		c.JSON(404, gin.H{"error": "agent not found"})
+		renderError(c, 404, "agent not found")
 	}
 
 	// curl -i -X DELETE http://localhost:8080/api/v1/agents/1
 }
+
+// PostAgentTransition change status of one agent, body {"status":"...","reason":"..."}
+func PostAgentTransition(c *gin.Context) {
+	m, _ := ModelFor("Agent")
+	transition(c, m)
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"status\": \"maintenance\", \"reason\": \"disk change\" }" http://localhost:8080/api/v1/agents/1/transition
+}
+
+// GetAgentTransitions return status history of one agent
+func GetAgentTransitions(c *gin.Context) {
+	m, _ := ModelFor("Agent")
+	transitions(c, m)
+
+	// curl -i http://localhost:8080/api/v1/agents/1/transitions
+}
@@ -30,7 +30,7 @@ func TestAgent(t *testing.T) {
 
 	// Add
 	log.Println("= http POST Agent")
-	var a = Agent{Name: "Name test", IP: "Ip test"}
+	var a = Agent{Name: "Name test", IP: "10.0.0.1"}
 	b := new(bytes.Buffer)
 	json.NewEncoder(b).Encode(a)
 	req, err := http.NewRequest("POST", urla, b)
@@ -45,7 +45,7 @@ func TestAgent(t *testing.T) {
 
 	// Add second agent
 	log.Println("= http POST more Agent")
-	var a2 = Agent{Name: "Name test2", IP: "Ip test2"}
+	var a2 = Agent{Name: "Name test2", IP: "10.0.0.2"}
 	json.NewEncoder(b).Encode(a2)
 	req, err = http.NewRequest("POST", urla, b)
 	req.Header.Set("Content-Type", "application/json")
@@ -104,7 +104,7 @@ func TestAgent(t *testing.T) {
 	//fmt.Println(q)
 	query, sort, limit = ParseQuery(q)
 	//fmt.Println(query)
-	assert.Equal(t, " LIMIT 5 OFFSET 6", limit, "Parse query")
+	assert.Equal(t, " LIMIT 5 OFFSET 5", limit, "Parse query")
 
 	log.Println("= Test parsing start end query")
 	s = "http://127.0.0.1:8080/api?_start=2&_end=4"
@@ -179,7 +179,7 @@ func TestAgent(t *testing.T) {
 
 	// Update one
 	log.Println("= http PUT one Agent")
-	//var a4 = Agent{Name: "Name test2 updated", IP: "Ip test2"}
+	//var a4 = Agent{Name: "Name test2 updated", IP: "10.0.0.2"}
 	a2.Name = "Name test2 updated"
 	json.NewEncoder(b).Encode(a2)
 	req, err = http.NewRequest("PUT", urla+"/2", b)
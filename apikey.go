@@ -0,0 +1,330 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIKey db and json type of a key of a user or an agent, the key is only
+// shown once at creation: gmt_<prefix>_<secret>
+type APIKey struct {
+	Id       int64     `db:"id" json:"id"`
+	Name     string    `db:"name" json:"name"`
+	Prefix   string    `db:"prefix" json:"prefix"` // lookup
+	Hash     string    `db:"hash" json:"-"`        // sha256 of the key
+	UserId   int64     `db:"userid" json:"userid"`
+	AgentId  int64     `db:"agentid" json:"agentid"`
+	Scopes   string    `db:"scopes" json:"scopes"`   // comma separated: agents:read,users:write,*:read,*
+	Expires  time.Time `db:"expires" json:"expires"` // zero for no expiry
+	LastUsed time.Time `db:"lastused" json:"lastused"`
+	LastIP   string    `db:"lastip" json:"lastip"`
+	Revoked  bool      `db:"revoked" json:"revoked"`
+	Tenant   string    `db:"tenant" json:"-"` // tenant of owner, claim read by TenantKey
+	Created  time.Time `db:"created" json:"created"`
+}
+
+// PreInsert set created time before insert in db
+func (a *APIKey) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	return nil
+}
+
+const keyPrefix = "gmt_"
+
+var (
+	scopeFormat  = regexp.MustCompile(`^(\*|[a-z0-9_-]+)(:(\*|read|write))?$`)
+	apiVersion   = regexp.MustCompile(`^v[0-9]+$`)
+	lastUsedStep = time.Minute // last used time is written at most once per step
+	// perModel endpoints reach several models, scopes are checked per model with keyAllows
+	perModel = map[string]bool{"graphql": true, "live": true}
+)
+
+// newAPIKey random key, its lookup prefix and hash
+func newAPIKey() (string, string, string, error) {
+	b := make([]byte, 36)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	prefix := hex.EncodeToString(b[:4])
+	key := keyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(b[4:])
+	return key, prefix, tokenHash(key), nil
+}
+
+// parseScopes validate a comma separated scope list
+func parseScopes(scopes string) ([]string, error) {
+	var list []string
+	for _, s := range strings.Split(scopes, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !scopeFormat.MatchString(s) {
+			return nil, errors.New("invalid scope " + s)
+		}
+		list = append(list, s)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("scopes are empty")
+	}
+	return list, nil
+}
+
+// allows return true if scopes grant verb, read or write, on resource
+func allows(scopes []string, resource string, verb string) bool {
+	for _, s := range scopes {
+		parts := strings.SplitN(s, ":", 2)
+		if parts[0] != "*" && parts[0] != resource {
+			continue
+		}
+		if len(parts) == 1 || parts[1] == "*" || parts[1] == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// covers return true if granted scopes include every wanted scope
+func covers(granted []string, wanted []string) bool {
+	for _, w := range wanted {
+		parts := append(strings.SplitN(w, ":", 2), "*")
+		verbs := []string{parts[1]}
+		if parts[1] == "*" {
+			verbs = []string{"read", "write"}
+		}
+		for _, v := range verbs {
+			if !allows(granted, parts[0], v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// scope resource and verb of a request: agents and write for POST /api/v1/agents/:id/heartbeat
+func scope(c *gin.Context) (string, string) {
+	resource := "none"
+	for _, p := range strings.Split(c.FullPath(), "/") {
+		if p != "" && p != "api" && !apiVersion.MatchString(p) {
+			resource = p
+			break
+		}
+	}
+	verb := "write"
+	if c.Request.Method == "GET" || c.Request.Method == "HEAD" || c.Request.Method == "OPTIONS" {
+		verb = "read"
+	}
+	return resource, verb
+}
+
+// APIKeyAuth gin Middlware to accept API keys from header
+// Authorization: Bearer gmt_..., check scopes and set User and APIKey
+func APIKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+		key := strings.TrimSpace(c.GetHeader("Authorization"))
+		for _, s := range []string{"Bearer ", "ApiKey "} {
+			key = strings.TrimPrefix(key, s)
+		}
+		parts := strings.Split(strings.TrimPrefix(key, keyPrefix), "_")
+		var k APIKey
+		if !strings.HasPrefix(key, keyPrefix) || len(parts) < 2 ||
+			dbmap.SelectOne(&k, "SELECT * FROM apikey WHERE prefix=?", parts[0]) != nil ||
+			subtle.ConstantTimeCompare([]byte(k.Hash), []byte(tokenHash(key))) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			renderError(c, 401, "invalid api key")
+			c.Abort()
+			return
+		}
+		if k.Revoked || (!k.Expires.IsZero() && time.Now().After(k.Expires)) {
+			renderError(c, 401, "revoked or expired api key")
+			c.Abort()
+			return
+		}
+		if tenant, ok := c.Get("Tenant"); ok && k.Tenant != tenant.(string) { // Tenant set before
+			renderError(c, 403, "api key is not valid for tenant "+tenant.(string))
+			c.Abort()
+			return
+		}
+
+		resource, verb := scope(c)
+		scopes, _ := parseScopes(k.Scopes)
+		// an agent key only reaches routes of its own agent: agents/<own id>/...
+		ownAgent := k.AgentId == 0 || (resource == "agents" && c.Param("id") == strconv.FormatInt(k.AgentId, 10))
+		if !(perModel[resource] || allows(scopes, resource, verb)) || !ownAgent {
+			renderError(c, 403, "api key scopes do not allow "+verb+" on "+resource)
+			c.Abort()
+			return
+		}
+
+		if time.Since(k.LastUsed) > lastUsedStep {
+			dbmap.Exec("UPDATE apikey SET lastused=?, lastip=? WHERE id=?", time.Now(), c.ClientIP(), k.Id)
+		}
+		c.Set("APIKey", k)
+		c.Set("User", keyOwner(dbmap, k))
+		c.Next()
+	}
+}
+
+// keyAllows return an error if the API key of the request does not grant
+// verb on model of resource, agent or agents, nil for requests without key
+func keyAllows(c *gin.Context, resource string, verb string) error {
+	v, ok := c.Get("APIKey")
+	if !ok {
+		return nil
+	}
+	m, ok := ModelFor(resource)
+	scopes, _ := parseScopes(v.(APIKey).Scopes)
+	if !ok || !allows(scopes, plural(m.Resource()), verb) {
+		return errors.New("api key scopes do not allow " + verb + " on " + resource)
+	}
+	return nil
+}
+
+// keyOwner name set as User of requests: user name or agent:name
+func keyOwner(dbmap *gorp.DbMap, k APIKey) string {
+	if k.AgentId != 0 {
+		name, _ := dbmap.SelectStr("SELECT name FROM agent WHERE id=?", k.AgentId)
+		return "agent:" + name
+	}
+	name, _ := dbmap.SelectStr("SELECT name FROM user WHERE id=?", k.UserId)
+	return name
+}
+
+// GetAPIKeys return keys of the request tenant filtered by URL query, without secrets
+func GetAPIKeys(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	if err := checkFilters("apikey", c.Request.URL.Query()); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	s, o, l := ParseQuery(c.Request.URL.Query())
+	where := " WHERE tenant=?"
+	if s != "" {
+		where = where + " AND " + s
+	}
+	count, _ := dbmap.SelectInt("SELECT COUNT(*) FROM apikey"+where, tenantOf(c))
+
+	var keys []APIKey
+	_, err := dbmap.Select(&keys, "SELECT * FROM apikey"+where+o+l, tenantOf(c))
+	if err == nil {
+		c.Header("X-Total-Count", strconv.FormatInt(count, 10))
+		render(c, 200, keys)
+	} else {
+		renderError(c, 404, "no key(s) into the table")
+	}
+
+	// curl -i http://localhost:8080/api/v1/apikeys
+}
+
+// PostAPIKey create a key of a user or an agent, the key is only in this response
+func PostAPIKey(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	var k APIKey
+	if bind(c, &k) != nil {
+		return
+	}
+	scopes, err := parseScopes(k.Scopes)
+	if err != nil || k.Name == "" || (k.UserId == 0) == (k.AgentId == 0) {
+		renderError(c, 400, "mandatory fields are empty or invalid: name, scopes and one of userid or agentid")
+		return
+	}
+	owner, id := "user", k.UserId
+	if k.AgentId != 0 {
+		owner, id = "agent", k.AgentId
+	}
+	tenant, err := dbmap.SelectNullStr("SELECT tenant FROM "+owner+" WHERE "+tenantScope(c, owner, "id=?"), id)
+	if err != nil || !tenant.Valid {
+		renderError(c, 400, owner+" not found")
+		return
+	}
+	if v, ok := c.Get("APIKey"); ok { // no escalation with a key
+		caller := v.(APIKey)
+		if caller.AgentId != 0 && k.AgentId != caller.AgentId {
+			renderError(c, 403, "an agent key only creates keys of its own agent")
+			return
+		}
+		granted, _ := parseScopes(caller.Scopes)
+		if k.UserId != 0 && k.UserId != caller.UserId && !allows(granted, "admin", "write") {
+			renderError(c, 403, "a user key only creates keys of its own user, without admin scope")
+			return
+		}
+		if !covers(granted, scopes) {
+			renderError(c, 403, "scopes exceed those of the calling key")
+			return
+		}
+	}
+
+	k.Tenant = tenant.String
+	key, err := CreateAPIKey(dbmap, &k)
+	if err == nil {
+		logger(c).Info("api key created", "key", k.Id, "prefix", k.Prefix, "scopes", k.Scopes)
+		render(c, 201, struct {
+			APIKey
+			Key string `json:"key"`
+		}{k, key})
+	} else {
+		logger(c).Error("api key not created", "error", err)
+		renderError(c, 500, "key not created")
+	}
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"name\": \"web1\", \"agentid\": 1, \"scopes\": \"agents:write\" }" http://localhost:8080/api/v1/apikeys
+}
+
+// CreateAPIKey insert a new key with owner, name, scopes and tenant of k,
+// return the key, only shown once. Used by PostAPIKey and ginadmin to
+// create a first key.
+func CreateAPIKey(dbmap *gorp.DbMap, k *APIKey) (string, error) {
+	scopes, err := parseScopes(k.Scopes)
+	if err != nil {
+		return "", err
+	}
+	k.Scopes = strings.Join(scopes, ",")
+	var key, prefix, hash string
+	for try := 0; try < 3; try++ { // prefix is unique, draw again on collision
+		key, prefix, hash, err = newAPIKey()
+		if err != nil {
+			return "", err
+		}
+		if n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM apikey WHERE prefix=?", prefix); n == 0 {
+			break
+		}
+	}
+	k.Id, k.Prefix, k.Hash = 0, prefix, hash
+	k.LastUsed, k.LastIP, k.Revoked = time.Time{}, "", false
+	return key, dbmap.Insert(k)
+}
+
+// DeleteAPIKey revoke one key of the request tenant by id, it stays listed
+func DeleteAPIKey(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var k APIKey
+	err := dbmap.SelectOne(&k, "SELECT * FROM apikey WHERE id=? AND tenant=?", id, tenantOf(c))
+	if err == nil {
+		k.Revoked = true
+		_, err = dbmap.Update(&k)
+		if err == nil {
+			logger(c).Info("api key revoked", "key", k.Id, "prefix", k.Prefix)
+			render(c, 200, gin.H{"id": k.Id, "status": "revoked"})
+		} else {
+			renderUnavailable(c, "revoke failed", err)
+		}
+	} else {
+		renderError(c, 404, "key not found")
+	}
+
+	// curl -i -X DELETE http://localhost:8080/api/v1/apikeys/1
+}
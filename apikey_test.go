@@ -0,0 +1,202 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScopes(t *testing.T) {
+	scopes, err := parseScopes("agents:read, users ,*:write")
+	assert.Nil(t, err, "valid scopes")
+	assert.True(t, allows(scopes, "agents", "read"), "agents:read")
+	assert.False(t, allows([]string{"agents:read"}, "agents", "write"), "no agents:write")
+	assert.True(t, allows(scopes, "users", "write"), "users")
+	assert.True(t, allows(scopes, "webhooks", "write"), "*:write")
+	assert.False(t, allows(scopes, "webhooks", "read"), "no *:read")
+
+	_, err = parseScopes("agents:delete")
+	assert.NotNil(t, err, "invalid verb")
+	_, err = parseScopes(" , ")
+	assert.NotNil(t, err, "empty scopes")
+
+	assert.True(t, covers([]string{"agents"}, []string{"agents:read", "agents:write"}), "agents covers verbs")
+	assert.False(t, covers([]string{"agents:read"}, []string{"agents"}), "read does not cover all")
+	assert.False(t, covers([]string{"agents"}, []string{"*:read"}), "resource does not cover all")
+	assert.True(t, covers([]string{"*"}, []string{"*", "users:write"}), "all covers all")
+}
+
+func TestAPIKeys(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(NewBus(10).Middleware())
+
+	// admin routes without auth, as set by a sample server behind its own auth
+	router.POST("/admin/apikeys", PostAPIKey)
+	router.GET("/admin/apikeys", GetAPIKeys)
+	router.DELETE("/admin/apikeys/:id", DeleteAPIKey)
+	router.POST("/admin/agents", PostAgent)
+	router.POST("/admin/users", PostUser)
+
+	v1 := router.Group("/api/v1")
+	v1.Use(APIKeyAuth())
+	v1.GET("/agents", GetAgents)
+	v1.POST("/agents/:id/heartbeat", PostAgentHeartbeat)
+	v1.GET("/users", GetUsers)
+	v1.POST("/apikeys", PostAPIKey)
+	v1.POST("/graphql", GraphQL)
+	v1.GET("/live", Live)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	do := func(method string, path string, key string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.1:4242"
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	create := func(path string, key string, k APIKey) (*httptest.ResponseRecorder, string) {
+		resp := do("POST", path, key, k)
+		var created struct {
+			Key string
+		}
+		json.Unmarshal(resp.Body.Bytes(), &created)
+		return resp, created.Key
+	}
+
+	do("POST", "/admin/agents", "", Agent{Name: "web1", IP: "10.0.0.1"})
+	do("POST", "/admin/agents", "", Agent{Name: "web2", IP: "10.0.0.2"})
+	do("POST", "/admin/users", "", User{Name: "admin"})
+	do("POST", "/admin/users", "", User{Name: "bob"})
+
+	// Create
+	log.Println("= Create keys, shown once")
+	resp, agentKey := create("/admin/apikeys", "", APIKey{Name: "web1", AgentId: 1, Scopes: "agents:write"})
+	assert.Equal(t, 201, resp.Code, "http POST agent key")
+	assert.Regexp(t, `^gmt_[0-9a-f]{8}_`, agentKey, "key format")
+	resp, userKey := create("/admin/apikeys", "", APIKey{Name: "admin cli", UserId: 1, Scopes: "*:read,apikeys:write"})
+	assert.Equal(t, 201, resp.Code, "http POST user key")
+
+	resp, _ = create("/admin/apikeys", "", APIKey{Name: "both", UserId: 1, AgentId: 1, Scopes: "*"})
+	assert.Equal(t, 400, resp.Code, "http POST key with two owners")
+	resp, _ = create("/admin/apikeys", "", APIKey{Name: "bad", UserId: 1, Scopes: "agents:delete"})
+	assert.Equal(t, 400, resp.Code, "http POST key with invalid scope")
+	resp, _ = create("/admin/apikeys", "", APIKey{Name: "ghost", AgentId: 9, Scopes: "*"})
+	assert.Equal(t, 400, resp.Code, "http POST key of missing agent")
+
+	resp = do("GET", "/admin/apikeys", "", nil)
+	assert.NotContains(t, resp.Body.String(), agentKey[12:], "secret not listed")
+	assert.NotContains(t, resp.Body.String(), "hash", "hash not listed")
+
+	// Auth
+	log.Println("= Authorization header and scopes")
+	resp = do("GET", "/api/v1/agents", "", nil)
+	assert.Equal(t, 401, resp.Code, "no key")
+	assert.Equal(t, `Bearer realm="api"`, resp.Header().Get("WWW-Authenticate"), "challenge")
+	resp = do("GET", "/api/v1/agents", agentKey+"x", nil)
+	assert.Equal(t, 401, resp.Code, "wrong key")
+	resp = do("GET", "/api/v1/agents", "gmt_", nil)
+	assert.Equal(t, 401, resp.Code, "malformed key")
+
+	resp = do("POST", "/api/v1/agents/1/heartbeat", agentKey, nil)
+	assert.Equal(t, 200, resp.Code, "agent key heartbeat")
+	resp = do("POST", "/api/v1/agents/2/heartbeat", agentKey, nil)
+	assert.Equal(t, 403, resp.Code, "agent key on another agent")
+	resp = do("GET", "/api/v1/agents", agentKey, nil)
+	assert.Equal(t, 403, resp.Code, "agent key without read scope")
+	resp = do("GET", "/api/v1/users", userKey, nil)
+	assert.Equal(t, 200, resp.Code, "user key read")
+	resp = do("POST", "/api/v1/agents/2/heartbeat", userKey, nil)
+	assert.Equal(t, 403, resp.Code, "user key without agents:write")
+
+	log.Println("= Agent keys only reach their own agent")
+	_, wideKey := create("/admin/apikeys", "", APIKey{Name: "web1 wide", AgentId: 1, Scopes: "*"})
+	resp = do("POST", "/api/v1/agents/1/heartbeat", wideKey, nil)
+	assert.Equal(t, 200, resp.Code, "own agent")
+	resp = do("GET", "/api/v1/agents", wideKey, nil)
+	assert.Equal(t, 403, resp.Code, "agent key on agent list")
+	resp = do("GET", "/api/v1/users", wideKey, nil)
+	assert.Equal(t, 403, resp.Code, "agent key on users")
+	resp, _ = create("/api/v1/apikeys", wideKey, APIKey{Name: "user", UserId: 1, Scopes: "users:read"})
+	assert.Equal(t, 403, resp.Code, "agent key creating a user key")
+
+	log.Println("= Last used")
+	var k APIKey
+	dbmap.SelectOne(&k, "SELECT * FROM apikey WHERE id=1")
+	assert.WithinDuration(t, time.Now(), k.LastUsed, time.Second, "last used")
+	assert.Equal(t, "192.0.2.1", k.LastIP, "last ip")
+
+	log.Println("= No escalation through a key")
+	resp, readerKey := create("/api/v1/apikeys", userKey, APIKey{Name: "reader", UserId: 1, Scopes: "agents:read"})
+	assert.Equal(t, 201, resp.Code, "http POST narrower key")
+	resp, _ = create("/api/v1/apikeys", userKey, APIKey{Name: "writer", UserId: 1, Scopes: "agents:write"})
+	assert.Equal(t, 403, resp.Code, "http POST wider key")
+	resp, _ = create("/api/v1/apikeys", userKey, APIKey{Name: "bob", UserId: 2, Scopes: "agents:read"})
+	assert.Equal(t, 403, resp.Code, "http POST key of another user")
+	_, adminKey := create("/admin/apikeys", "", APIKey{Name: "admin", UserId: 1, Scopes: "*:read,apikeys:write,admin"})
+	resp, _ = create("/api/v1/apikeys", adminKey, APIKey{Name: "bob", UserId: 2, Scopes: "agents:read"})
+	assert.Equal(t, 201, resp.Code, "http POST key of another user with admin scope")
+
+	log.Println("= GraphQL and live check scopes per model")
+	_, graphqlKey := create("/admin/apikeys", "", APIKey{Name: "graphql", UserId: 1, Scopes: "graphql:write,live:read"})
+	query := func(key string, q string) string {
+		return do("POST", "/api/v1/graphql", key, gin.H{"query": q}).Body.String()
+	}
+	assert.Contains(t, query(graphqlKey, "{ agents { name } }"), "do not allow read on Agent", "graphql scope alone")
+	body := query(readerKey, "{ agents { name } }")
+	assert.Contains(t, body, "web1", "agents:read on agents")
+	assert.NotContains(t, body, "errors", "agents:read on agents")
+	assert.Contains(t, query(readerKey, "{ users { name } }"), "do not allow read on User", "agents:read on users")
+	assert.Contains(t, query(readerKey, `mutation { deleteAgent(id: 2) }`), "do not allow write on Agent", "agents:read on a mutation")
+
+	subscribe := func(key string, resource string) LiveMessage {
+		header := http.Header{"Authorization": {"Bearer " + key}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/live", header)
+		var m LiveMessage
+		if assert.Nil(t, err, "websocket dial") {
+			defer conn.Close()
+			conn.WriteJSON(LiveMessage{Type: "subscribe", Id: "s1", Resource: resource})
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			conn.ReadJSON(&m)
+		}
+		return m
+	}
+	assert.Equal(t, "error", subscribe(graphqlKey, "agent").Type, "live scope alone")
+	assert.Equal(t, "subscribed", subscribe(readerKey, "agent").Type, "agents:read on agents")
+	assert.Equal(t, "error", subscribe(readerKey, "user").Type, "agents:read on users")
+
+	// Revoke and expire
+	log.Println("= Revoked and expired keys")
+	resp = do("DELETE", "/admin/apikeys/1", "", nil)
+	assert.Equal(t, 200, resp.Code, "http DELETE revoke")
+	resp = do("POST", "/api/v1/agents/1/heartbeat", agentKey, nil)
+	assert.Equal(t, 401, resp.Code, "revoked key")
+	resp = do("DELETE", "/admin/apikeys/9", "", nil)
+	assert.Equal(t, 404, resp.Code, "http DELETE missing key")
+
+	_, expiredKey := create("/admin/apikeys", "", APIKey{Name: "old", UserId: 1, Scopes: "*", Expires: time.Now().Add(-time.Minute)})
+	resp = do("GET", "/api/v1/users", expiredKey, nil)
+	assert.Equal(t, 401, resp.Code, "expired key")
+}
@@ -0,0 +1,341 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/gorp.v2"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backup file names, no path
+var (
+	backupName     = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*\.sqlite3$`)
+	maxRestoreSize = int64(1 << 30) // uploaded backup, XXX fix for your data
+)
+
+// Backup write a consistent copy of the live database to a new file path
+func Backup(dbmap *gorp.DbMap, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return errors.New("backup file exists: " + path)
+	}
+	_, err := dbmap.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// Restore replace content of the database by a backup file, with the sqlite
+// backup API, then apply migrations of an older backup. Callers must stop
+// other writers, like Backups.Restore does.
+func Restore(dbmap *gorp.DbMap, path string) error {
+	if err := checkBackup(path); err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	ctx := context.Background()
+	sconn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sconn.Close()
+	dconn, err := dbmap.Db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dconn.Close()
+
+	err = dconn.Raw(func(d interface{}) error {
+		return sconn.Raw(func(s interface{}) error {
+			bk, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err = bk.Step(-1); err != nil {
+				bk.Finish()
+				return err
+			}
+			return bk.Finish()
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err = dbmap.CreateTablesIfNotExists(); err != nil {
+		return err
+	}
+	return Migrate(dbmap)
+}
+
+// checkBackup open a backup read only, check its integrity and that it
+// is a database of these models
+func checkBackup(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return errors.New("invalid backup: " + err.Error())
+	}
+	if result != "ok" {
+		return errors.New("invalid backup: " + result)
+	}
+	var n int
+	if err = db.QueryRow("SELECT COUNT(*) FROM Migration").Scan(&n); err != nil {
+		return errors.New("invalid backup: no migration table")
+	}
+	return nil
+}
+
+// Backups online backup and restore endpoints of one database,
+// restores wait for running requests and hold new ones
+type Backups struct {
+	Dir      string         // backup files
+	Cache    *ResponseCache // optional, flushed after restore
+	Sweeper  *Sweeper       // optional, paused during restore
+	Webhooks *Dispatcher    // optional, delivery logs paused during restore
+	dbmap    *gorp.DbMap
+	gate     sync.RWMutex // read by requests, written by restore
+}
+
+// BackupInfo json type of a backup file
+type BackupInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// NewBackups create backups of dbmap into dir
+func NewBackups(dbmap *gorp.DbMap, dir string) *Backups {
+	return &Backups{Dir: dir, dbmap: dbmap}
+}
+
+// Middleware gin Middlware to quiesce requests during a restore,
+// streams leave the gate with unquiesce
+func (b *Backups) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		b.gate.RLock()
+		defer b.gate.RUnlock()
+		c.Set("Backups", b)
+		c.Next()
+	}
+}
+
+// unquiesce let a restore run while request goes on, like a stream
+// which never ends, call returned func when done
+func unquiesce(c *gin.Context) func() {
+	v, _ := c.Get("Backups")
+	b, ok := v.(*Backups)
+	if !ok || b == nil { // no gate, or already left
+		return func() {}
+	}
+	c.Set("Backups", (*Backups)(nil))
+	b.gate.RUnlock()
+	return b.gate.RLock
+}
+
+// Restore replace database content by a backup file once running requests,
+// sweeps and delivery logs end
+func (b *Backups) Restore(path string) error {
+	b.gate.Lock()
+	defer b.gate.Unlock()
+	if b.Sweeper != nil {
+		defer b.Sweeper.pause()()
+	}
+	if b.Webhooks != nil {
+		defer b.Webhooks.pause()()
+	}
+	err := Restore(b.dbmap, path)
+	if err == nil && b.Cache != nil {
+		b.Cache.flush()
+	}
+	return err
+}
+
+// path of a backup file by name, "" for an invalid name
+func (b *Backups) path(name string) string {
+	if !backupName.MatchString(name) {
+		return ""
+	}
+	return filepath.Join(b.Dir, name)
+}
+
+// newBackupName name of a backup taken now, UTC time with nanoseconds so
+// names sort in time order and do not collide
+func newBackupName() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z") + ".sqlite3"
+}
+
+func info(fi os.FileInfo) BackupInfo {
+	return BackupInfo{Name: fi.Name(), Size: fi.Size(), Created: fi.ModTime()}
+}
+
+// GetBackups return backup files, last first
+func (b *Backups) GetBackups(c *gin.Context) {
+	entries, err := os.ReadDir(b.Dir)
+	if err != nil {
+		renderError(c, 404, "no backup directory")
+		return
+	}
+	backups := []BackupInfo{}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err == nil && fi.Mode().IsRegular() && backupName.MatchString(e.Name()) {
+			backups = append(backups, info(fi))
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	render(c, 200, backups)
+
+	// curl -i http://localhost:8080/admin/backups
+}
+
+// PostBackup write a new backup file into Dir
+func (b *Backups) PostBackup(c *gin.Context) {
+	name := newBackupName()
+	path := b.path(name)
+
+	start := time.Now()
+	err := Backup(b.dbmap, path)
+	trace(c, "VACUUM INTO "+name, start, err)
+	if err != nil {
+		logger(c).Error("backup failed", "error", err)
+		renderError(c, 500, "backup failed")
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		renderError(c, 500, "backup failed")
+		return
+	}
+	logger(c).Info("backup", "name", name, "size", fi.Size())
+	render(c, 201, info(fi))
+
+	// curl -i -X POST http://localhost:8080/admin/backups
+}
+
+// GetBackup download a backup file by name, or a new backup for name "now"
+func (b *Backups) GetBackup(c *gin.Context) {
+	name := c.Params.ByName("name")
+	path := b.path(name)
+	if name == "now" {
+		tmp, err := b.tempPath()
+		if err == nil {
+			err = Backup(b.dbmap, tmp)
+		}
+		defer os.Remove(tmp)
+		if err != nil {
+			logger(c).Error("backup failed", "error", err)
+			renderError(c, 500, "backup failed")
+			return
+		}
+		name, path = newBackupName(), tmp
+	}
+	if path == "" {
+		renderError(c, 404, "backup not found")
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		renderError(c, 404, "backup not found")
+		return
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(c.Writer, c.Request, name, fi.ModTime(), f)
+
+	// curl -o backup.sqlite3 http://localhost:8080/admin/backups/now
+}
+
+// tempPath new file name for a backup written then removed
+func (b *Backups) tempPath() (string, error) {
+	f, err := os.CreateTemp(b.Dir, "tmp-*.sqlite3")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), os.Remove(f.Name()) // VACUUM INTO wants a new file
+}
+
+// RestoreRequest body of restore endpoint
+type RestoreRequest struct {
+	Name string `json:"name"`
+}
+
+// PostRestore restore a backup file of Dir, body {"name":"..."}, or an
+// uploaded backup with Content-Type application/octet-stream
+func (b *Backups) PostRestore(c *gin.Context) {
+	var path string
+	if strings.HasPrefix(c.ContentType(), "application/octet-stream") {
+		tmp, err := b.tempPath()
+		if err == nil {
+			err = b.save(c, tmp)
+		}
+		defer os.Remove(tmp)
+		if err != nil {
+			renderError(c, 400, "upload failed")
+			return
+		}
+		path = tmp
+	} else {
+		var req RestoreRequest
+		if bind(c, &req) != nil {
+			return
+		}
+		if path = b.path(req.Name); path == "" {
+			renderError(c, 404, "backup not found")
+			return
+		}
+	}
+
+	defer unquiesce(c)() // this request holds the gate too
+	start := time.Now()
+	err := b.Restore(path)
+	trace(c, "RESTORE", start, err)
+	if err != nil {
+		logger(c).Error("restore failed", "error", err)
+		if os.IsNotExist(err) {
+			renderError(c, 404, "backup not found")
+		} else {
+			renderError(c, 400, err.Error())
+		}
+		return
+	}
+	logger(c).Warn("database restored", "backup", filepath.Base(path))
+	render(c, 200, gin.H{"status": "restored"})
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"name\": \"20240102T150405.000000000Z.sqlite3\" }" http://localhost:8080/admin/restore
+	// curl -i -X POST -H "Content-Type: application/octet-stream" --data-binary @backup.sqlite3 http://localhost:8080/admin/restore
+}
+
+// save uploaded body to path
+func (b *Backups) save(c *gin.Context, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, http.MaxBytesReader(c.Writer, c.Request.Body, maxRestoreSize))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackups(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	backups := NewBackups(dbmap, t.TempDir())
+	cache := NewCache(time.Minute)
+	backups.Cache = cache
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(cache.Middleware())
+	router.Use(backups.Middleware())
+	router.GET("/api/v1/agents", GetAgents)
+	router.POST("/api/v1/agents", PostAgent)
+	router.GET("/admin/backups", backups.GetBackups)
+	router.POST("/admin/backups", backups.PostBackup)
+	router.GET("/admin/backups/:name", backups.GetBackup)
+	router.POST("/admin/restore", backups.PostRestore)
+
+	do := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	post := func(path string, obj interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(obj)
+		return do("POST", path, "application/json", b)
+	}
+	count := func() string {
+		return do("GET", "/api/v1/agents", "", nil).Header().Get("X-Total-Count")
+	}
+
+	post("/api/v1/agents", Agent{Name: "web1", IP: "10.0.0.1"})
+	post("/api/v1/agents", Agent{Name: "web2", IP: "10.0.0.2"})
+
+	// Backup
+	log.Println("= Backup to a file")
+	resp := do("POST", "/admin/backups", "", nil)
+	assert.Equal(t, 201, resp.Code, "http POST backup")
+	var backup BackupInfo
+	json.Unmarshal(resp.Body.Bytes(), &backup)
+	assert.Regexp(t, `^[0-9T.]+Z\.sqlite3$`, backup.Name, "backup name")
+	assert.True(t, backup.Size > 0, "backup size")
+	resp = do("GET", "/admin/backups", "", nil)
+	assert.Contains(t, resp.Body.String(), backup.Name, "http GET backups")
+
+	log.Println("= Streamed backup")
+	resp = do("GET", "/admin/backups/now", "", nil)
+	assert.Equal(t, 200, resp.Code, "http GET backup now")
+	assert.True(t, bytes.HasPrefix(resp.Body.Bytes(), []byte("SQLite format 3\x00")), "sqlite file")
+	assert.Regexp(t, `attachment; filename="?[0-9]{8}T[0-9]{6}\.[0-9]{9}Z\.sqlite3`, resp.Header().Get("Content-Disposition"), "named like backup files")
+	download := resp.Body.Bytes()
+	resp = do("GET", "/admin/backups/"+backup.Name, "", nil)
+	assert.Equal(t, 200, resp.Code, "http GET backup file")
+	resp = do("GET", "/admin/backups/..%2Ftest.sqlite3", "", nil)
+	assert.Equal(t, 404, resp.Code, "no path in name")
+
+	// Restore
+	log.Println("= Restore a backup file")
+	post("/api/v1/agents", Agent{Name: "web3", IP: "10.0.0.3"})
+	assert.Equal(t, "3", count(), "three agents, cached")
+	resp = post("/admin/restore", RestoreRequest{Name: backup.Name})
+	assert.Equal(t, 200, resp.Code, "http POST restore")
+	assert.Equal(t, "2", count(), "two agents, cache flushed")
+	pending, _ := PendingMigrations(dbmap)
+	assert.Empty(t, pending, "migrated")
+	resp = post("/admin/restore", RestoreRequest{Name: "missing.sqlite3"})
+	assert.Equal(t, 404, resp.Code, "http POST restore missing")
+
+	log.Println("= Restore an upload")
+	post("/api/v1/agents", Agent{Name: "web3", IP: "10.0.0.3"})
+	resp = do("POST", "/admin/restore", "application/octet-stream", download)
+	assert.Equal(t, 200, resp.Code, "http POST restore upload")
+	assert.Equal(t, "2", count(), "two agents")
+	resp = do("POST", "/admin/restore", "application/octet-stream", []byte("not a database"))
+	assert.Equal(t, 400, resp.Code, "http POST restore garbage")
+	assert.Equal(t, "2", count(), "database kept")
+
+	log.Println("= Restore waits for running requests")
+	backups.gate.RLock() // a running request
+	done := make(chan error)
+	go func() { done <- backups.Restore(backups.path(backup.Name)) }()
+	select {
+	case <-done:
+		t.Error("restore did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	backups.gate.RUnlock()
+	assert.Nil(t, <-done, "restored")
+
+	log.Println("= Restore waits for sweeps and delivery logs")
+	backups.Sweeper = NewSweeper(dbmap, time.Minute)
+	backups.Webhooks = NewDispatcher()
+	for name, gate := range map[string]*sync.RWMutex{"sweep": &backups.Sweeper.gate, "delivery log": &backups.Webhooks.gate} {
+		gate.RLock() // a running sweep or delivery log
+		go func() { done <- backups.Restore(backups.path(backup.Name)) }()
+		select {
+		case <-done:
+			t.Error("restore did not wait for " + name)
+		case <-time.After(50 * time.Millisecond):
+		}
+		gate.RUnlock()
+		assert.Nil(t, <-done, "restored after "+name)
+	}
+	_, err := backups.Sweeper.Sweep()
+	assert.Nil(t, err, "sweeps resumed")
+}
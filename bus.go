@@ -0,0 +1,183 @@
+package models
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Bus in-process pub/sub of record changes, keeps last events to resume streams
+type Bus struct {
+	mu     sync.Mutex
+	size   int
+	lastId uint64
+	buffer []Event
+	subs   map[chan Event]bool
+}
+
+// NewBus create a bus keeping size last events
+func NewBus(size int) *Bus {
+	return &Bus{size: size, subs: make(map[chan Event]bool)}
+}
+
+// Middleware gin Middlware to publish events of handlers
+func (b *Bus) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("Bus", b)
+		c.Next()
+	}
+}
+
+// Publish number an event and send it to subscribers,
+// a subscriber too slow to receive is unsubscribed
+func (b *Bus) Publish(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastId++
+	e.Id = b.lastId
+	b.buffer = append(b.buffer, e)
+	if len(b.buffer) > b.size {
+		b.buffer = b.buffer[len(b.buffer)-b.size:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// Subscribe return a channel of next events and buffered events after since
+func (b *Bus) Subscribe(since uint64, capacity int) (chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, capacity)
+	b.subs[ch] = true
+	var missed []Event
+	if since > 0 {
+		for _, e := range b.buffer {
+			if e.Id > since {
+				missed = append(missed, e)
+			}
+		}
+	}
+	return ch, missed
+}
+
+// Unsubscribe stop sending events to channel
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[ch] {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// recordFilter _filters of a stream, matched on event records
+type recordFilter struct {
+	like  map[string]string            // LIKE searches of ParseQuery
+	exact map[string][]string          // numbers and lists of exactFilters
+	ips   map[string]map[string]string // address operators of ipFilters
+}
+
+func newRecordFilter(q map[string][]string) recordFilter {
+	return recordFilter{like: parseFilters(q), exact: exactValues(q), ips: ipOperators(q)}
+}
+
+// Matches return true if event is about resource and its record matches
+// _filters of q, with the LIKE, exact and address operators semantic of
+// ParseQuery
+func (e Event) Matches(resource string, q map[string][]string) bool {
+	return e.matches(resource, newRecordFilter(q))
+}
+
+func (e Event) matches(resource string, f recordFilter) bool {
+	if e.Resource() != resource {
+		return false
+	}
+	rv := reflect.ValueOf(e.record)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return len(f.like) == 0 && len(f.exact) == 0 && len(f.ips) == 0
+	}
+	for col, search := range f.like {
+		v, ok := columnValue(rv, col)
+		if !ok || !strings.Contains(strings.ToLower(v), strings.ToLower(search)) {
+			return false
+		}
+	}
+	for col, values := range f.exact {
+		v, ok := columnValue(rv, col)
+		if !ok || !oneOf(v, values) {
+			return false
+		}
+	}
+	for col, ops := range f.ips {
+		v, ok := columnValue(rv, col)
+		first, last, valid := ipBounds(ops)
+		key := ipKey(v)
+		if !ok || !valid || key == "" || key < first || key > last {
+			return false
+		}
+	}
+	return true
+}
+
+// oneOf return true if v is the text of one of SQL literals values
+func oneOf(v string, values []string) bool {
+	for _, s := range values {
+		if v == strings.Trim(s, "\"") {
+			return true
+		}
+	}
+	return false
+}
+
+// columnValue text of the field of a record with db column col
+func columnValue(rv reflect.Value, col string) (string, bool) {
+	for i := 0; i < rv.NumField(); i++ {
+		name := strings.TrimSpace(strings.Split(rv.Type().Field(i).Tag.Get("db"), ",")[0])
+		if strings.EqualFold(name, col) {
+			return fmt.Sprint(rv.Field(i).Interface()), true
+		}
+	}
+	return "", false
+}
+
+// Change return true for created, updated and deleted events, one per
+// write, derived events like agent.status are for webhooks
+func (e Event) Change() bool {
+	switch e.Action() {
+	case "created", "updated", "deleted":
+		return true
+	}
+	return false
+}
+
+// Visible return true if event may be sent to clients of tenant,
+// clients without tenant see every event
+func (e Event) Visible(tenant string) bool {
+	return tenant == "" || e.tenant == tenant
+}
+
+// Resource of event, agent for agent.created
+func (e Event) Resource() string {
+	return strings.SplitN(e.Event, ".", 2)[0]
+}
+
+// Action of event, created for agent.created
+func (e Event) Action() string {
+	parts := strings.SplitN(e.Event, ".", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gopkg.in/gorp.v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache in-process cache of list responses, invalidated on writes
+type ResponseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]map[string]cacheEntry // db+table -> tenant+query -> entry
+}
+
+type cacheEntry struct {
+	tag     string
+	count   int64
+	data    interface{}
+	expires time.Time
+}
+
+// NewCache create a response cache, entries expire after ttl
+func NewCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{ttl: ttl, entries: make(map[string]map[string]cacheEntry)}
+}
+
+// Middleware gin Middlware to set cache for handlers
+func (rc *ResponseCache) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("Cache", rc)
+		c.Next()
+	}
+}
+
+// cacheGet return a fresh cached list for table and query
+func cacheGet(c *gin.Context, table string, query string) (cacheEntry, bool) {
+	v, ok := c.Get("Cache")
+	if !ok {
+		return cacheEntry{}, false
+	}
+	rc := v.(*ResponseCache)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.entries[cacheTable(c, table)][tenantOf(c)+"?"+query]
+	if !ok || time.Now().After(e.expires) {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+// cachePut store a list response for table and query
+func cachePut(c *gin.Context, table string, query string, e cacheEntry) {
+	v, ok := c.Get("Cache")
+	if !ok {
+		return
+	}
+	rc := v.(*ResponseCache)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	t := cacheTable(c, table)
+	if rc.entries[t] == nil {
+		rc.entries[t] = make(map[string]cacheEntry)
+	}
+	e.expires = time.Now().Add(rc.ttl)
+	rc.entries[t][tenantOf(c)+"?"+query] = e
+}
+
+// invalidate drop cached lists of a table after a write
+func invalidate(c *gin.Context, table string) {
+	v, ok := c.Get("Cache")
+	if !ok {
+		return
+	}
+	v.(*ResponseCache).invalidate(c.MustGet("DBmap"), table)
+}
+
+// invalidate drop cached lists of a table of dbmap, for writes out of requests
+func (rc *ResponseCache) invalidate(dbmap interface{}, table string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.entries, tableKey(dbmap, table))
+}
+
+// flush drop all cached lists, like after a restore
+func (rc *ResponseCache) flush() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = make(map[string]map[string]cacheEntry)
+}
+
+// cacheTable key a table by its database, handlers may share a cache between dbs
+func cacheTable(c *gin.Context, table string) string {
+	return tableKey(c.MustGet("DBmap"), table)
+}
+
+func tableKey(dbmap interface{}, table string) string {
+	return fmt.Sprintf("%p/%s", dbmap, table)
+}
+
+// etag weak entity tag from values
+func etag(values ...string) string {
+	h := sha1.Sum([]byte(strings.Join(values, "|")))
+	return `W/"` + hex.EncodeToString(h[:10]) + `"`
+}
+
+// notModified set ETag and Last-Modified headers, return true and
+// respond 304 when If-None-Match or If-Modified-Since match
+func notModified(c *gin.Context, tag string, modified time.Time) bool {
+	if f := format(c); f != binding.MIMEJSON { // one tag per representation
+		tag = etag(tag, f)
+	}
+	if t := tenantOf(c); t != "" { // and per tenant
+		tag = etag(tag, t)
+	}
+	c.Header("Vary", "Accept")
+	c.Header("ETag", tag)
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == strings.TrimPrefix(tag, "W/") {
+				c.Status(304)
+				return true
+			}
+		}
+		return false // If-Modified-Since is ignored with If-None-Match
+	}
+
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modified.Truncate(time.Second).After(t) {
+			c.Status(304)
+			return true
+		}
+	}
+	return false
+}
+
+// listVersion count and last update time, as text, of rows of table
+// matching where, for list ETags
+func listVersion(c *gin.Context, table string, where string) (int64, string) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	query := "SELECT COUNT(*) FROM " + table + where
+	start := time.Now()
+	count, err := dbmap.SelectInt(query)
+	trace(c, query, start, err)
+
+	query = "SELECT COALESCE(MAX(updated), '') FROM " + table + where
+	start = time.Now()
+	updated, err := dbmap.SelectStr(query)
+	trace(c, query, start, err)
+	return count, updated
+}
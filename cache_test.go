@@ -0,0 +1,134 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(NewCache(time.Minute).Middleware())
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla, GetAgents)
+	router.GET(urla+"/:id", GetAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(Agent{Name: "Name test", IP: "10.0.0.1"})
+	req, _ := http.NewRequest("POST", urla, b)
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST success")
+
+	log.Println("= ETag on list")
+	req, _ = http.NewRequest("GET", urla, nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET all success")
+	tag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, tag, "ETag set")
+	assert.Empty(t, resp.Header().Get("Last-Modified"), "no Last-Modified on lists")
+
+	req, _ = http.NewRequest("GET", urla, nil)
+	req.Header.Set("If-None-Match", tag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 304, resp.Code, "http GET all not modified")
+	assert.Empty(t, resp.Body.String(), "no body")
+
+	req, _ = http.NewRequest("GET", urla, nil)
+	req.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "If-Modified-Since ignored on lists")
+
+	req, _ = http.NewRequest("GET", urla+"?_sortField=name&_sortDir=ASC", nil)
+	req.Header.Set("If-None-Match", tag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "other query, other ETag")
+
+	log.Println("= Cache hit")
+	_, err := dbmap.Exec("UPDATE agent SET name='changed behind cache'")
+	assert.Nil(t, err, "direct update")
+	req, _ = http.NewRequest("GET", urla, nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET all from cache")
+	assert.NotContains(t, resp.Body.String(), "changed behind cache", "cached body")
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "cached count")
+
+	log.Println("= Invalidate on write")
+	b.Reset()
+	json.NewEncoder(b).Encode(Agent{Name: "Name test2", IP: "10.0.0.2"})
+	req, _ = http.NewRequest("POST", urla, b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST success")
+
+	req, _ = http.NewRequest("GET", urla, nil)
+	req.Header.Set("If-None-Match", tag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET all modified")
+	assert.Contains(t, resp.Body.String(), "changed behind cache", "fresh body")
+	assert.Equal(t, "2", resp.Header().Get("X-Total-Count"), "fresh count")
+	assert.NotEqual(t, tag, resp.Header().Get("ETag"), "new ETag")
+
+	log.Println("= ETag on one")
+	req, _ = http.NewRequest("GET", urla+"/1", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET one success")
+	tag = resp.Header().Get("ETag")
+	modified := resp.Header().Get("Last-Modified")
+
+	req, _ = http.NewRequest("GET", urla+"/1", nil)
+	req.Header.Set("If-None-Match", tag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 304, resp.Code, "http GET one not modified")
+
+	req, _ = http.NewRequest("GET", urla+"/1", nil)
+	req.Header.Set("If-Modified-Since", modified)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 304, resp.Code, "http GET one not modified since")
+
+	req, _ = http.NewRequest("GET", urla+"/1", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET one modified since")
+
+	b.Reset()
+	json.NewEncoder(b).Encode(Agent{Name: "Name test updated", IP: "10.0.0.1"})
+	req, _ = http.NewRequest("PUT", urla+"/1", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http PUT success")
+
+	req, _ = http.NewRequest("GET", urla+"/1", nil)
+	req.Header.Set("If-None-Match", tag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET one modified")
+}
@@ -0,0 +1,155 @@
+// Package client is a typed Go client of the models REST API
+//
+//	c := client.New("http://localhost:8080/api/v1")
+//	c.Header.Set("Authorization", "Bearer gmt_...")
+//	agents, total, err := c.Agents.List(ctx, client.Filter{"status": "offline"}, client.Sort{Field: "created", Desc: true}, client.Page{Number: 1, PerPage: 20})
+//
+// GET responses are kept with their ETag and revalidated with If-None-Match,
+// unchanged records and lists are not sent again.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	models "github.com/yvesago/gin-model-template"
+)
+
+// maxCached GET responses kept for revalidation, all are dropped beyond
+const maxCached = 1000
+
+// Client of an API, like http://localhost:8080/api/v1
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	Header  http.Header // added to requests, like Authorization or X-Tenant
+
+	Agents *Resource[models.Agent]
+	Users  *Resource[models.User]
+
+	mu    sync.Mutex
+	cache map[string]cached // GET responses by URL
+}
+
+type cached struct {
+	tag    string
+	header http.Header
+	body   []byte
+}
+
+// New return a client of the API at baseURL
+func New(baseURL string) *Client {
+	c := &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTP:    http.DefaultClient,
+		Header:  make(http.Header),
+		cache:   make(map[string]cached),
+	}
+	c.Agents = NewResource[models.Agent](c, "agents")
+	c.Users = NewResource[models.User](c, "users")
+	return c
+}
+
+// Error a response with an error status and its message
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Message
+}
+
+// IsNotFound return true for 404 errors, like unknown ids
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// do send a JSON request, decode the response body into out and return its headers
+func (c *Client) do(ctx context.Context, method string, path string, q url.Values, body interface{}, out interface{}) (http.Header, error) {
+	u := c.BaseURL + "/" + path
+	if len(q) > 0 {
+		u = u + "?" + q.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.mu.Lock()
+	entry, ok := c.cache[u]
+	c.mu.Unlock()
+	if method == "GET" && ok {
+		req.Header.Set("If-None-Match", entry.tag)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	header := resp.Header
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		header, b = entry.header, entry.body
+	case resp.StatusCode >= 400:
+		return header, responseError(resp.StatusCode, b)
+	case method == "GET" && resp.Header.Get("ETag") != "":
+		c.mu.Lock()
+		if len(c.cache) >= maxCached {
+			c.cache = make(map[string]cached)
+		}
+		c.cache[u] = cached{tag: resp.Header.Get("ETag"), header: resp.Header, body: b}
+		c.mu.Unlock()
+	}
+	if out == nil {
+		return header, nil
+	}
+	if err = json.Unmarshal(b, out); err != nil {
+		return header, fmt.Errorf("%s %s: %w", method, u, err)
+	}
+	return header, nil
+}
+
+// responseError error of a {"error": "..."} body, or of its status
+func responseError(status int, body []byte) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		return &Error{Status: status, Message: e.Error}
+	}
+	if msg := strings.TrimSpace(string(body)); msg != "" && len(msg) < 200 {
+		return &Error{Status: status, Message: msg}
+	}
+	return &Error{Status: status, Message: http.StatusText(status)}
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	models "github.com/yvesago/gin-model-template"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// statuses of responses
+type statuses struct {
+	mu    sync.Mutex
+	codes []int
+}
+
+func (s *statuses) take() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := s.codes
+	s.codes = nil
+	return codes
+}
+
+// server run the real handlers, s records response statuses
+func server(t *testing.T, s *statuses, middlewares ...gin.HandlerFunc) *Client {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		s.mu.Lock()
+		s.codes = append(s.codes, c.Writer.Status())
+		s.mu.Unlock()
+	})
+	r.Use(models.Database(filepath.Join(t.TempDir(), "test.sqlite3")))
+	r.Use(middlewares...)
+	v1 := r.Group("api/v1")
+	v1.GET("/agents", models.GetAgents)
+	v1.GET("/agents/:id", models.GetAgent)
+	v1.POST("/agents", models.PostAgent)
+	v1.PUT("/agents/:id", models.UpdateAgent)
+	v1.DELETE("/agents/:id", models.DeleteAgent)
+	v1.GET("/users", models.GetUsers)
+	v1.POST("/users", models.PostUser)
+
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return New(ts.URL + "/api/v1/")
+}
+
+func TestAgents(t *testing.T) {
+	var s statuses
+	c := server(t, &s)
+	ctx := context.Background()
+
+	log.Println("= Create")
+	a, err := c.Agents.Create(ctx, models.Agent{Name: "web1", IP: "10.0.0.1"})
+	assert.Nil(t, err, "create")
+	assert.Equal(t, int64(1), a.Id, "id")
+	assert.Equal(t, models.AgentNew, a.Status, "stored status")
+	for i := 2; i <= 5; i++ {
+		_, err = c.Agents.Create(ctx, models.Agent{Name: fmt.Sprintf("web%d", i), IP: fmt.Sprintf("10.0.0.%d", i), Role: "web"})
+		assert.Nil(t, err, "create")
+	}
+	_, err = c.Agents.Create(ctx, models.Agent{Name: "missing ip"})
+	var e *Error
+	if assert.ErrorAs(t, err, &e, "error body") {
+		assert.Equal(t, 400, e.Status, "status")
+		assert.Contains(t, e.Message, "mandatory", "message")
+	}
+
+	log.Println("= Get and update")
+	a, err = c.Agents.Get(ctx, 2)
+	assert.Nil(t, err, "get")
+	assert.Equal(t, "web2", a.Name, "name")
+	a.Role = "proxy"
+	a, err = c.Agents.Update(ctx, a.Id, a)
+	assert.Nil(t, err, "update")
+	assert.Equal(t, "proxy", a.Role, "updated")
+	_, err = c.Agents.Get(ctx, 99)
+	assert.True(t, IsNotFound(err), "unknown id")
+
+	log.Println("= List with filter, sort and page")
+	list, total, err := c.Agents.List(ctx, Filter{"role": "web"}, Sort{Field: "ip", Desc: true}, Page{Number: 1, PerPage: 2})
+	assert.Nil(t, err, "list")
+	assert.Equal(t, int64(3), total, "X-Total-Count of filtered records")
+	if assert.Len(t, list, 2, "page") {
+		assert.Equal(t, "web5", list[0].Name, "sorted desc")
+		assert.Equal(t, "web4", list[1].Name, "sorted desc")
+	}
+	list, _, _ = c.Agents.List(ctx, Filter{"role": "web"}, Sort{Field: "ip", Desc: true}, Page{Number: 2, PerPage: 2})
+	if assert.Len(t, list, 1, "last page") {
+		assert.Equal(t, "web3", list[0].Name, "no record skipped")
+	}
+	list, total, _ = c.Agents.List(ctx, nil, Sort{}, Page{})
+	assert.Equal(t, 5, len(list), "all records")
+	assert.Equal(t, int64(5), total, "total")
+
+	log.Println("= Iterate over pages")
+	it := c.Agents.All(ctx, nil, Sort{Field: "id"}, 2)
+	var names []string
+	for it.Next() {
+		names = append(names, it.Value().Name)
+	}
+	assert.Nil(t, it.Err(), "iteration")
+	assert.Equal(t, []string{"web1", "web2", "web3", "web4", "web5"}, names, "all records once")
+	assert.Equal(t, int64(5), it.Total(), "total")
+
+	log.Println("= ETags")
+	c.Agents.Get(ctx, 2) // updated since first get
+	s.take()
+	a, err = c.Agents.Get(ctx, 2)
+	assert.Nil(t, err, "get again")
+	assert.Equal(t, "proxy", a.Role, "cached record")
+	list, total, err = c.Agents.List(ctx, nil, Sort{}, Page{})
+	assert.Nil(t, err, "list again")
+	assert.Equal(t, 5, len(list), "cached list")
+	assert.Equal(t, int64(5), total, "cached total")
+	assert.Equal(t, []int{304, 304}, s.take(), "not sent again")
+
+	log.Println("= Delete")
+	assert.Nil(t, c.Agents.Delete(ctx, 2), "delete")
+	_, err = c.Agents.Get(ctx, 2)
+	assert.True(t, IsNotFound(err), "deleted, not from cache")
+	assert.True(t, IsNotFound(c.Agents.Delete(ctx, 2)), "delete again")
+	_, total, _ = c.Agents.List(ctx, nil, Sort{}, Page{})
+	assert.Equal(t, int64(4), total, "list revalidated")
+
+	log.Println("= Unknown route")
+	_, err = NewResource[models.Agent](c, "robots").Get(ctx, 1)
+	assert.True(t, IsNotFound(err), "route not found")
+}
+
+func TestHeader(t *testing.T) {
+	var s statuses
+	c := server(t, &s, models.Tenant(models.TenantHeader("X-Tenant")))
+	ctx := context.Background()
+
+	log.Println("= Requests carry Header")
+	_, err := c.Users.Create(ctx, models.User{Name: "Thea"})
+	if assert.Error(t, err, "no tenant") {
+		assert.Equal(t, 400, err.(*Error).Status, "bad request")
+	}
+	c.Header.Set("X-Tenant", "acme")
+	_, err = c.Users.Create(ctx, models.User{Name: "Thea"})
+	assert.Nil(t, err, "tenant acme")
+
+	other := New(c.BaseURL)
+	other.Header.Set("X-Tenant", "globex")
+	_, total, err := other.Users.List(ctx, nil, Sort{}, Page{})
+	assert.Nil(t, err, "list")
+	assert.Equal(t, int64(0), total, "other tenant")
+	_, total, _ = c.Users.List(ctx, nil, Sort{}, Page{})
+	assert.Equal(t, int64(1), total, "same tenant")
+}
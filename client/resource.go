@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+)
+
+// Resource REST endpoints of one model, like agents
+type Resource[T any] struct {
+	c    *Client
+	path string
+}
+
+// NewResource return endpoints of a model at path, for models added to the
+// API: client.NewResource[models.Host](c, "hosts")
+func NewResource[T any](c *Client, path string) *Resource[T] {
+	return &Resource[T]{c: c, path: path}
+}
+
+// Filter records with value in their column, sent as _filters
+type Filter map[string]string
+
+// Sort records by column, sent as _sortField and _sortDir
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// Page of PerPage records, Number from 1, zero Page for all records
+type Page struct {
+	Number  int
+	PerPage int
+}
+
+// query of list parameters
+func query(filter Filter, sort Sort, page Page) url.Values {
+	q := url.Values{}
+	if len(filter) > 0 {
+		b, _ := json.Marshal(filter)
+		q.Set("_filters", string(b))
+	}
+	if sort.Field != "" {
+		q.Set("_sortField", sort.Field)
+		q.Set("_sortDir", "ASC")
+		if sort.Desc {
+			q.Set("_sortDir", "DESC")
+		}
+	}
+	if page.PerPage > 0 {
+		if page.Number < 1 {
+			page.Number = 1
+		}
+		start := (page.Number-1)*page.PerPage + 1 // _start and _end from 1, included
+		q.Set("_start", strconv.Itoa(start))
+		q.Set("_end", strconv.Itoa(start+page.PerPage-1))
+	}
+	return q
+}
+
+// List return a page of records and the count of all filtered records
+func (r *Resource[T]) List(ctx context.Context, filter Filter, sort Sort, page Page) ([]T, int64, error) {
+	var records []T
+	header, err := r.c.do(ctx, "GET", r.path, query(filter, sort, page), nil, &records)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, _ := strconv.ParseInt(header.Get("X-Total-Count"), 10, 64)
+	return records, total, nil
+}
+
+// Get return one record by id
+func (r *Resource[T]) Get(ctx context.Context, id int64) (T, error) {
+	var record T
+	_, err := r.c.do(ctx, "GET", r.path+"/"+strconv.FormatInt(id, 10), nil, nil, &record)
+	return record, err
+}
+
+// Create add a record and return it as stored
+func (r *Resource[T]) Create(ctx context.Context, record T) (T, error) {
+	var created T
+	_, err := r.c.do(ctx, "POST", r.path, nil, record, &created)
+	return created, err
+}
+
+// Update replace fields of a record and return it as stored
+func (r *Resource[T]) Update(ctx context.Context, id int64, record T) (T, error) {
+	var updated T
+	_, err := r.c.do(ctx, "PUT", r.path+"/"+strconv.FormatInt(id, 10), nil, record, &updated)
+	return updated, err
+}
+
+// Delete a record by id
+func (r *Resource[T]) Delete(ctx context.Context, id int64) error {
+	_, err := r.c.do(ctx, "DELETE", r.path+"/"+strconv.FormatInt(id, 10), nil, nil, nil)
+	return err
+}
+
+// All iterate over filtered records, perPage at a time:
+//
+//	it := c.Agents.All(ctx, nil, client.Sort{Field: "id"}, 100)
+//	for it.Next() {
+//		agent := it.Value()
+//	}
+//	err := it.Err()
+//
+// Sort by a unique column, records created or deleted while iterating may
+// shift pages.
+func (r *Resource[T]) All(ctx context.Context, filter Filter, sort Sort, perPage int) *Iterator[T] {
+	if perPage < 1 {
+		perPage = 100
+	}
+	return &Iterator[T]{r: r, ctx: ctx, filter: filter, sort: sort, page: Page{PerPage: perPage}}
+}
+
+// Iterator over pages of a list
+type Iterator[T any] struct {
+	r      *Resource[T]
+	ctx    context.Context
+	filter Filter
+	sort   Sort
+	page   Page
+	items  []T
+	i      int
+	seen   int64
+	total  int64
+	last   bool
+	err    error
+}
+
+// Next move to the next record, fetching the next page when needed,
+// return false at the end or on error
+func (it *Iterator[T]) Next() bool {
+	it.i++
+	for it.i >= len(it.items) {
+		if it.last || it.err != nil {
+			return false
+		}
+		it.page.Number++
+		it.items, it.total, it.err = it.r.List(it.ctx, it.filter, it.sort, it.page)
+		it.i = 0
+		it.seen += int64(len(it.items))
+		it.last = len(it.items) < it.page.PerPage || it.seen >= it.total
+	}
+	return true
+}
+
+// Value current record
+func (it *Iterator[T]) Value() T {
+	return it.items[it.i]
+}
+
+// Err first error of the iteration
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Total count of filtered records, known after the first Next
+func (it *Iterator[T]) Total() int64 {
+	return it.total
+}
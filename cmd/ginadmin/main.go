@@ -0,0 +1,478 @@
+// Command ginadmin run database operations on a models database
+//
+//	ginadmin -db test.sqlite3 fixtures load sample/fixtures.yml
+//	ginadmin -db test.sqlite3 user create -name Admin -mail admin@example.org
+//	ginadmin -db test.sqlite3 apikey create -user admin@example.org -name cli -scopes '*'
+//	ginadmin -db test.sqlite3 agent list -filter status=offline -sort -created
+//	ginadmin -db test.sqlite3 migrate status
+//
+// Commands other than migrate and backup apply pending migrations, like
+// servers do on start.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	models "github.com/yvesago/gin-model-template"
+)
+
+// command a subcommand, run with remaining arguments
+type command struct {
+	usage string
+	run   func(db string, args []string) error
+}
+
+var commands = map[string]command{
+	"fixtures load":  {"FILE...  insert or update seed records", fixturesLoad},
+	"agent list":     {"[-filter col=value]... [-sort [-]col] [-limit n] [-json]  list agents", list("Agent")},
+	"user list":      {"[-filter col=value]... [-sort [-]col] [-limit n] [-json]  list users", list("User")},
+	"user create":    {"-name NAME -mail MAIL [-status active] [-tenant T] [-pass P]  add a user, password read from stdin without -pass", userCreate},
+	"user passwd":    {"[-tenant T] [-pass P] NAME|MAIL  set the password of a user, read from stdin without -pass", userPasswd},
+	"apikey create":  {"-user NAME|MAIL -name NAME -scopes S [-tenant T]  add an api key of a user, like a first key for /apikeys", apikeyCreate},
+	"migrate up":     {"  apply pending migrations", migrateUp},
+	"migrate down":   {"[N]  revert the last N applied migrations, 1 by default", migrateDown},
+	"migrate status": {"[-json]  list applied and pending migrations", migrateStatus},
+	"backup":         {"FILE  write an online copy of the database", backup},
+}
+
+// out and in of commands, replaced by tests
+var (
+	out io.Writer = os.Stdout
+	in  io.Reader = os.Stdin
+)
+
+func main() {
+	db := flag.String("db", "test.sqlite3", "sqlite database file")
+	flag.Usage = usage
+	flag.Parse()
+
+	name, args := lookup(flag.Args())
+	if name == "" {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[name].run(*db, args); err != nil {
+		fmt.Fprintln(os.Stderr, "ginadmin "+name+":", err)
+		os.Exit(1)
+	}
+}
+
+// lookup command name of args, and its own args
+func lookup(args []string) (string, []string) {
+	for name := range commands {
+		words := strings.Fields(name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == name {
+			return name, args[len(words):]
+		}
+	}
+	return "", nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ginadmin [-db file] command [args]")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+	flag.PrintDefaults()
+}
+
+// flags of a command, errors are returned instead of exiting
+func flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("ginadmin "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func fixturesLoad(db string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no fixtures file")
+	}
+	dbmap := models.InitDb(db)
+	defer dbmap.Db.Close()
+	for _, file := range args {
+		r, err := models.LoadFixtureFile(dbmap, file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		fmt.Fprintf(out, "%s: %d inserted, %d updated, %d unchanged\n", file, r.Inserted, r.Updated, r.Unchanged)
+	}
+	return nil
+}
+
+// filterFlags repeated -filter col=value
+type filterFlags []string
+
+func (f *filterFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *filterFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// filterColumn and filterValue kept by ParseQuery, others would be
+// silently ignored: mail=a@b.org, path=/etc
+var (
+	filterColumn = regexp.MustCompile("^[A-Za-z0-9_]+$")
+	filterValue  = regexp.MustCompile("^[A-Za-z0-9_.:/@]+$")
+)
+
+// list records of a model, with the query semantics of GET handlers:
+// -filter status=offline matches like _filters, -sort -created sorts
+// like sort=-created
+func list(model string) func(db string, args []string) error {
+	return func(db string, args []string) error {
+		fs := flags(strings.ToLower(model) + " list")
+		var filters filterFlags
+		fs.Var(&filters, "filter", "col=value, records with value in col")
+		sortField := fs.String("sort", "", "sort column, -col for descending order")
+		limit := fs.Int("limit", 0, "max records")
+		asJSON := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+
+		dbmap := models.InitDb(db) // registers models
+		defer dbmap.Db.Close()
+		m, _ := models.ModelFor(model)
+		columns := make(map[string]string) // by json name of list headers, like mail for email
+		for _, f := range m.Fields() {
+			columns[f.JSON] = f.Column
+		}
+		q := url.Values{}
+		for _, f := range filters {
+			col, value, ok := strings.Cut(f, "=")
+			if !ok || !filterColumn.MatchString(col) || !filterValue.MatchString(value) {
+				return fmt.Errorf("invalid filter %s, like status=offline", f)
+			}
+			if c, ok := columns[col]; ok {
+				col = c
+			}
+			q.Set("filter["+col+"]", value)
+		}
+		if *sortField != "" {
+			q.Set("sort", *sortField)
+		}
+		if *limit > 0 {
+			q.Set("_perPage", strconv.Itoa(*limit))
+		}
+		s, o, l := models.ParseQuery(q)
+		if s != "" {
+			s = " WHERE " + s
+		}
+
+		records := m.NewSlice()
+		if _, err := dbmap.Select(records, "SELECT * FROM "+m.Name+s+o+l); err != nil {
+			return err
+		}
+		return printRecords(m, reflect.ValueOf(records).Elem(), *asJSON)
+	}
+}
+
+// printRecords print a table or JSON of records, without fields tagged `log:"redact"`
+func printRecords(m models.Model, records reflect.Value, asJSON bool) error {
+	var fields []models.Field
+	for _, f := range m.Fields() {
+		if m.Type.Field(f.Index).Tag.Get("log") != "redact" {
+			fields = append(fields, f)
+		}
+	}
+
+	if asJSON {
+		list := make([]map[string]interface{}, records.Len())
+		for i := range list {
+			list[i] = make(map[string]interface{})
+			for _, f := range fields {
+				list[i][f.JSON] = records.Index(i).Field(f.Index).Interface()
+			}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for i, f := range fields {
+		if i > 0 {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprint(w, strings.ToUpper(f.JSON))
+	}
+	fmt.Fprintln(w)
+	for i := 0; i < records.Len(); i++ {
+		for j, f := range fields {
+			if j > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, cell(records.Index(i).Field(f.Index).Interface()))
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// cell table value of a field
+func cell(v interface{}) string {
+	if t, ok := v.(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(v)
+}
+
+// password from -pass or the first line of stdin
+func password(pass string) (string, error) {
+	if pass != "" {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func userCreate(db string, args []string) error {
+	fs := flags("user create")
+	name := fs.String("name", "", "user name")
+	mail := fs.String("mail", "", "user mail")
+	status := fs.String("status", models.UserActive, "user status: "+strings.Join(models.UserStates.States(), ", "))
+	tenant := fs.String("tenant", "", "user tenant")
+	pass := fs.String("pass", "", "password, prefer stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *mail == "" {
+		return errors.New("no -mail")
+	}
+	if !models.UserStates.Valid(*status) {
+		return fmt.Errorf("unknown status %s", *status)
+	}
+
+	user := models.User{Name: *name, Email: *mail, Status: *status, Tenant: *tenant}
+	if err := user.Validate(); err != nil {
+		return err
+	}
+	p, err := password(*pass)
+	if err != nil {
+		return err
+	}
+	if err = user.SetPassword(p); err != nil {
+		return err
+	}
+
+	dbmap := models.InitDb(db)
+	defer dbmap.Db.Close()
+	n, err := dbmap.SelectInt("SELECT COUNT(*) FROM user WHERE email=? AND tenant=?", user.Email, user.Tenant)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("mail %s already used", user.Email)
+	}
+	if err = dbmap.Insert(&user); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "user %d %s created\n", user.Id, user.Email)
+	return nil
+}
+
+func userPasswd(db string, args []string) error {
+	fs := flags("user passwd")
+	tenant := fs.String("tenant", "", "user tenant")
+	pass := fs.String("pass", "", "password, prefer stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("need a user name or mail")
+	}
+
+	dbmap := models.InitDb(db)
+	defer dbmap.Db.Close()
+	var users []models.User
+	_, err := dbmap.Select(&users, "SELECT * FROM user WHERE (email=? OR name=?) AND tenant=?", fs.Arg(0), fs.Arg(0), *tenant)
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 {
+		return fmt.Errorf("%d user(s) %s", len(users), fs.Arg(0))
+	}
+	p, err := password(*pass)
+	if err != nil {
+		return err
+	}
+	if err = users[0].SetPassword(p); err != nil {
+		return err
+	}
+	if _, err = dbmap.Update(&users[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "password of user %d %s changed\n", users[0].Id, users[0].Email)
+	return nil
+}
+
+func apikeyCreate(db string, args []string) error {
+	fs := flags("apikey create")
+	user := fs.String("user", "", "user name or mail, owner of the key")
+	name := fs.String("name", "", "key name")
+	scopes := fs.String("scopes", "", "comma separated scopes like agents:write,*:read or *")
+	tenant := fs.String("tenant", "", "user tenant")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *user == "" || *name == "" || *scopes == "" {
+		return errors.New("need -user, -name and -scopes")
+	}
+
+	dbmap := models.InitDb(db)
+	defer dbmap.Db.Close()
+	var users []models.User
+	_, err := dbmap.Select(&users, "SELECT * FROM user WHERE (email=? OR name=?) AND tenant=?", *user, *user, *tenant)
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 {
+		return fmt.Errorf("%d user(s) %s", len(users), *user)
+	}
+	k := models.APIKey{Name: *name, UserId: users[0].Id, Scopes: *scopes, Tenant: *tenant}
+	key, err := models.CreateAPIKey(dbmap, &k)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "api key %d %s created, shown once:\n%s\n", k.Id, k.Name, key)
+	return nil
+}
+
+// existing return an error for a missing database file, that OpenDb
+// would create empty
+func existing(db string) error {
+	path := strings.TrimPrefix(strings.SplitN(db, "?", 2)[0], "file:")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no database %s", path)
+	}
+	return nil
+}
+
+func migrateUp(db string, args []string) error {
+	dbmap, err := models.OpenDb(db)
+	if err != nil {
+		return err
+	}
+	defer dbmap.Db.Close()
+	pending, err := models.PendingMigrations(dbmap)
+	if err != nil {
+		return err
+	}
+	if err = models.Migrate(dbmap); err != nil {
+		return err
+	}
+	for _, id := range pending {
+		fmt.Fprintln(out, "applied", id)
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "no pending migration")
+	}
+	return nil
+}
+
+func migrateDown(db string, args []string) error {
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			return fmt.Errorf("invalid count %s", args[0])
+		}
+	}
+	if err := existing(db); err != nil {
+		return err
+	}
+	dbmap, err := models.OpenDb(db)
+	if err != nil {
+		return err
+	}
+	defer dbmap.Db.Close()
+	reverted, err := models.MigrateDown(dbmap, n)
+	for _, id := range reverted {
+		fmt.Fprintln(out, "reverted", id)
+	}
+	return err
+}
+
+func migrateStatus(db string, args []string) error {
+	fs := flags("migrate status")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := existing(db); err != nil {
+		return err
+	}
+	dbmap, err := models.OpenDb(db)
+	if err != nil {
+		return err
+	}
+	defer dbmap.Db.Close()
+	status, err := models.MigrationStatus(dbmap)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAPPLIED")
+	for _, s := range status {
+		applied := cell(s.Applied)
+		if applied == "" {
+			applied = "pending"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", s.Id, applied)
+	}
+	return w.Flush()
+}
+
+func backup(db string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("need a backup file")
+	}
+	if err := existing(db); err != nil {
+		return err
+	}
+	dbmap, err := models.OpenDb(db)
+	if err != nil {
+		return err
+	}
+	defer dbmap.Db.Close()
+	if err = models.Backup(dbmap, args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "database copied to", args[0])
+	return nil
+}
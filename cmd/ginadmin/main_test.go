@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	models "github.com/yvesago/gin-model-template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// run a command, return its output
+func run(t *testing.T, db string, stdin string, args ...string) (string, error) {
+	var b bytes.Buffer
+	out, in = &b, strings.NewReader(stdin)
+	name, args := lookup(args)
+	if name == "" {
+		t.Fatalf("unknown command %v", args)
+	}
+	err := commands[name].run(db, args)
+	return b.String(), err
+}
+
+func TestUsers(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.sqlite3")
+
+	log.Println("= Create first admin")
+	o, err := run(t, db, "change-me-now\n", "user", "create", "-name", "Admin", "-mail", "admin@example.org")
+	assert.Nil(t, err, "create")
+	assert.Equal(t, "user 1 admin@example.org created\n", o, "output")
+	_, err = run(t, db, "", "user", "create", "-name", "Admin2", "-mail", "admin@example.org", "-pass", "change-me-now")
+	assert.NotNil(t, err, "mail already used")
+	_, err = run(t, db, "", "user", "create", "-name", "Thea", "-mail", "thea@example.org", "-pass", "short")
+	assert.NotNil(t, err, "short password")
+	_, err = run(t, db, "", "user", "create", "-name", "Thea", "-mail", "thea@example.org", "-status", "boss", "-pass", "change-me-now")
+	assert.NotNil(t, err, "unknown status")
+	_, err = run(t, db, "", "user", "create", "-mail", "thea@example.org", "-pass", "change-me-now")
+	assert.NotNil(t, err, "mandatory name")
+	_, err = run(t, db, "", "user", "create", "-name", "Thea", "-mail", "thea@example.org", "-status", "pending", "-pass", "change-me-now")
+	assert.Nil(t, err, "second user")
+
+	log.Println("= Change password")
+	o, err = run(t, db, "", "user", "passwd", "-pass", "new-password", "Admin")
+	assert.Nil(t, err, "passwd by name")
+	assert.Equal(t, "password of user 1 admin@example.org changed\n", o, "output")
+	_, err = run(t, db, "other-password\n", "user", "passwd", "admin@example.org")
+	assert.Nil(t, err, "passwd by mail from stdin")
+	_, err = run(t, db, "", "user", "passwd", "-pass", "new-password", "nobody")
+	assert.NotNil(t, err, "unknown user")
+	_, err = run(t, db, "", "user", "passwd", "-tenant", "acme", "-pass", "new-password", "Admin")
+	assert.NotNil(t, err, "other tenant")
+
+	dbmap := models.InitDb(db)
+	var admin models.User
+	dbmap.SelectOne(&admin, "SELECT * FROM user WHERE id=1")
+	dbmap.Db.Close()
+	assert.True(t, admin.CheckPassword("other-password"), "password changed")
+	assert.Equal(t, models.UserActive, admin.Status, "default status")
+
+	log.Println("= List users without passwords")
+	o, err = run(t, db, "", "user", "list", "-filter", "status=pending")
+	assert.Nil(t, err, "list")
+	lines := strings.Split(strings.TrimSpace(o), "\n")
+	assert.Equal(t, 2, len(lines), "header and one user")
+	assert.True(t, strings.HasPrefix(lines[0], "ID  NAME  MAIL"), "header")
+	assert.Contains(t, lines[1], "thea@example.org", "pending user")
+	assert.NotContains(t, o, "PASS", "no password column")
+	o, err = run(t, db, "", "user", "list", "-filter", "mail=thea@example.org")
+	assert.Nil(t, err, "filter by mail")
+	assert.Equal(t, 2, strings.Count(o, "\n"), "one user")
+	assert.Contains(t, o, "thea@example.org", "user of mail")
+
+	o, err = run(t, db, "", "user", "list", "-json", "-sort", "-id")
+	assert.Nil(t, err, "list json")
+	var users []map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(o), &users), "json")
+	if assert.Equal(t, 2, len(users), "users") {
+		assert.Equal(t, "Thea", users[0]["name"], "sorted by id desc")
+		assert.NotContains(t, users[0], "pass", "no password")
+	}
+}
+
+func TestAgents(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.sqlite3")
+	_, err := run(t, db, "", "fixtures", "load", "../../sample/fixtures.yml")
+	assert.Nil(t, err, "fixtures")
+
+	dbmap := models.InitDb(db)
+	dbmap.Exec("UPDATE agent SET status='offline' WHERE name IN ('web2', 'db1')")
+	dbmap.Db.Close()
+
+	log.Println("= Filter and sort agents")
+	o, err := run(t, db, "", "agent", "list", "--filter", "status=offline", "--sort", "-ip")
+	assert.Nil(t, err, "list")
+	lines := strings.Split(strings.TrimSpace(o), "\n")
+	if assert.Equal(t, 3, len(lines), "header and 2 agents") {
+		assert.Contains(t, lines[1], "db1", "sorted by ip desc")
+		assert.Contains(t, lines[2], "web2", "sorted by ip desc")
+	}
+	o, _ = run(t, db, "", "agent", "list", "-sort", "ip", "-limit", "1")
+	assert.Equal(t, 2, strings.Count(o, "\n"), "limit")
+	assert.Contains(t, o, "web1", "first ip")
+	o, _ = run(t, db, "", "agent", "list", "-filter", "role=web", "-filter", "status=new")
+	assert.Equal(t, 2, strings.Count(o, "\n"), "filters joined with AND")
+
+	_, err = run(t, db, "", "agent", "list", "-filter", "status")
+	assert.NotNil(t, err, "filter without value")
+	_, err = run(t, db, "", "agent", "list", "-filter", "name=x' OR 1=1")
+	assert.NotNil(t, err, "invalid filter value")
+}
+
+func TestMigrateAndBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.sqlite3")
+
+	log.Println("= Missing database is not created")
+	_, err := run(t, db, "", "migrate", "status")
+	assert.NotNil(t, err, "status of missing database")
+	_, err = run(t, db, "", "migrate", "down")
+	assert.NotNil(t, err, "down of missing database")
+	_, err = run(t, db, "", "backup", filepath.Join(dir, "missing.sqlite3"))
+	assert.NotNil(t, err, "backup of missing database")
+	_, err = os.Stat(db)
+	assert.True(t, os.IsNotExist(err), "no empty database")
+
+	log.Println("= Migrations of a new database")
+	o, err := run(t, db, "", "migrate", "up")
+	assert.Nil(t, err, "up")
+	assert.Contains(t, o, "applied 0001_agent_owner\n", "applied")
+	o, _ = run(t, db, "", "migrate", "up")
+	assert.Equal(t, "no pending migration\n", o, "nothing to apply")
+
+	log.Println("= Revert migrations")
+	o, err = run(t, db, "", "migrate", "down", "2")
+	assert.Nil(t, err, "down")
+	assert.Equal(t, "reverted 0005_webhook_tenant\nreverted 0004_tenant\n", o, "reverted last first")
+	o, _ = run(t, db, "", "migrate", "status", "-json")
+	var status []models.MigrationRecord
+	json.Unmarshal([]byte(o), &status)
+	if assert.Equal(t, 5, len(status), "status") {
+		assert.False(t, status[2].Applied.IsZero(), "0003 applied")
+		assert.True(t, status[3].Applied.IsZero(), "0004 pending")
+	}
+	_, err = run(t, db, "", "migrate", "down", "zero")
+	assert.NotNil(t, err, "invalid count")
+	run(t, db, "", "migrate", "up")
+
+	log.Println("= Backup")
+	copy := filepath.Join(dir, "copy.sqlite3")
+	o, err = run(t, db, "", "backup", copy)
+	assert.Nil(t, err, "backup")
+	assert.Equal(t, "database copied to "+copy+"\n", o, "output")
+	_, err = os.Stat(copy)
+	assert.Nil(t, err, "backup file")
+	_, err = run(t, db, "", "backup", copy)
+	assert.NotNil(t, err, "existing file")
+}
+
+func TestAPIKeys(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.sqlite3")
+	run(t, db, "", "user", "create", "-name", "Admin", "-mail", "admin@example.org", "-pass", "change-me-now")
+
+	log.Println("= Create a first key")
+	o, err := run(t, db, "", "apikey", "create", "-user", "Admin", "-name", "cli", "-scopes", "*")
+	assert.Nil(t, err, "create")
+	assert.Regexp(t, `^api key 1 cli created, shown once:\ngmt_[0-9a-f]{8}_\S+\n$`, o, "output")
+	_, err = run(t, db, "", "apikey", "create", "-user", "nobody", "-name", "cli", "-scopes", "*")
+	assert.NotNil(t, err, "unknown user")
+	_, err = run(t, db, "", "apikey", "create", "-user", "Admin", "-name", "cli", "-scopes", "agents:delete")
+	assert.NotNil(t, err, "invalid scope")
+	_, err = run(t, db, "", "apikey", "create", "-user", "Admin", "-scopes", "*")
+	assert.NotNil(t, err, "mandatory name")
+
+	dbmap := models.InitDb(db)
+	defer dbmap.Db.Close()
+	var k models.APIKey
+	dbmap.SelectOne(&k, "SELECT * FROM apikey WHERE id=1")
+	assert.Equal(t, int64(1), k.UserId, "owner")
+	assert.NotContains(t, o, k.Hash, "hash not shown")
+}
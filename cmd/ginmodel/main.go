@@ -0,0 +1,597 @@
+// Command ginmodel generate a model like agent.go: its file with struct and
+// REST handlers, its test, its registration in InitDb and its routes
+//
+//	ginmodel Host name:string:required ip:string:required owner:int64:ref=User
+//	ginmodel -from host.go Host
+//	ginmodel -routes sample/_server.go Host name:string:required
+//
+// Fields are name:type with options required, ref=Model and redact. The
+// generated file runs ginmodel -update with go generate: after adding a
+// field to the struct, "go generate" updates the field mapping of UpdateHost.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "models package directory")
+	from := flag.String("from", "", "Go file with the model struct")
+	routes := flag.String("routes", "", "file where to add routes, above its \"// ginmodel:routes\" line, printed if empty")
+	update := flag.String("update", "", "model file where to update the field mapping, for go generate")
+	force := flag.Bool("force", false, "overwrite existing files")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ginmodel [flags] Model field:type[:required][:ref=Model][:redact]...")
+		fmt.Fprintln(os.Stderr, "       ginmodel [flags] -from file.go [Model]")
+		fmt.Fprintln(os.Stderr, "       ginmodel -update model.go")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	if *update != "" {
+		var changed bool
+		if changed, err = updateFile(*update); changed {
+			fmt.Println("updated", *update+", new columns of existing databases need a migration")
+		}
+	} else {
+		var m model
+		if m, err = load(*from, flag.Args()); err == nil {
+			err = generate(*dir, m, *routes, *force)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ginmodel:", err)
+		os.Exit(1)
+	}
+}
+
+// field of a model struct
+type field struct {
+	Name string // Go name
+	Type string
+	Tag  string // without back quotes
+}
+
+// Column db column name
+func (f field) Column() string {
+	return strings.TrimSpace(strings.Split(reflect.StructTag(f.Tag).Get("db"), ",")[0])
+}
+
+// JSON json name, "-" for internal fields
+func (f field) JSON() string {
+	return strings.Split(reflect.StructTag(f.Tag).Get("json"), ",")[0]
+}
+
+// Required tagged `valid:"required"`
+func (f field) Required() bool {
+	return reflect.StructTag(f.Tag).Get("valid") == "required"
+}
+
+// model to generate
+type model struct {
+	Name    string // Host
+	Fields  []field
+	Imports []string // of field types, like "time" or sql "database/sql"
+	From    string   // struct file, replaced by the model file
+}
+
+// Inst lower case instance and table name: host
+func (m model) Inst() string {
+	return strings.ToLower(m.Name)
+}
+
+// Names plural name of list handlers: GetHosts, GetStatuses
+func (m model) Names() string {
+	return plural(m.Name)
+}
+
+// Resource route path and list variable: hosts
+func (m model) Resource() string {
+	return strings.ToLower(m.Names())
+}
+
+// plural of a name, same rule as models routes and lists: statuses, policies
+func plural(name string) string {
+	lower := strings.ToLower(name)
+	n := len(lower)
+	switch {
+	case strings.HasSuffix(lower, "s") || strings.HasSuffix(lower, "x") || strings.HasSuffix(lower, "z") ||
+		strings.HasSuffix(lower, "ch") || strings.HasSuffix(lower, "sh"):
+		return name + "es"
+	case n > 1 && lower[n-1] == 'y' && !strings.ContainsRune("aeiou", rune(lower[n-2])):
+		return name[:n-1] + "ies"
+	}
+	return name + "s"
+}
+
+var modelName = regexp.MustCompile("^[A-Z][A-Za-z0-9]*$")
+
+// reserved lower case names of models, used as Go variables and sql tables:
+// Go keywords and predeclared names, packages and variables of generated
+// code, sqlite keywords
+var reserved = make(map[string]bool)
+
+func init() {
+	for _, w := range strings.Fields(`
+		break case chan const continue default defer else fallthrough for func go goto if
+		import interface map package range return select struct switch type var
+		any append bool byte cap close complex copy delete error false float64 int int64
+		len make new nil panic print real recover rune string true uint
+		assert bytes errors fmt gin gorp http httptest log modeltest sql strconv strings
+		testing time
+		c cached config count dbmap err i id json l modified o ok previous q query req resp
+		router s start t tag updated where
+		abort action add after all alter always analyze and as asc attach autoincrement
+		before begin between by cascade cast check collate column commit conflict
+		constraint create cross current current_date current_time current_timestamp
+		database deferrable deferred desc detach distinct do drop each end escape
+		except exclude exclusive exists explain fail filter first following foreign
+		from full generated glob group groups having ignore immediate in index indexed
+		initially inner insert instead intersect into is isnull join key last left like
+		limit match materialized natural no not nothing notnull null nulls of offset on
+		or order others outer over partition plan pragma preceding primary raise
+		recursive references regexp reindex release rename replace restrict returning
+		right rollback row rows savepoint set table temp temporary then ties to
+		transaction trigger unbounded union unique update using vacuum values view
+		virtual when window with without`) {
+		reserved[w] = true
+	}
+}
+
+// checkName model name like Host, not reserved as variable or table name
+func checkName(name string) error {
+	if !modelName.MatchString(name) {
+		return fmt.Errorf("invalid model name %s, like Host", name)
+	}
+	m := model{Name: name}
+	if reserved[m.Inst()] || reserved[m.Resource()] {
+		return fmt.Errorf("reserved model name %s, a Go or sql keyword", name)
+	}
+	return nil
+}
+
+// load model from field specs or from a struct file
+func load(from string, args []string) (model, error) {
+	var m model
+	if from != "" {
+		if len(args) > 1 {
+			return m, errors.New("no field spec with -from")
+		}
+		name := ""
+		if len(args) == 1 {
+			name = args[0]
+		}
+		m, err := parseStruct(from, name)
+		if err == nil {
+			m.From = from
+			m.complete()
+		}
+		return m, err
+	}
+	if len(args) < 2 {
+		return m, errors.New("need a model name and fields")
+	}
+	if err := checkName(args[0]); err != nil {
+		return m, err
+	}
+	fields, err := parseSpecs(args[1:])
+	if err != nil {
+		return m, err
+	}
+	m = model{Name: args[0], Fields: fields}
+	m.complete()
+	return m, nil
+}
+
+var specTypes = map[string]string{
+	"string": "string", "int": "int64", "int64": "int64", "float": "float64",
+	"float64": "float64", "bool": "bool", "time": "time.Time",
+}
+
+var specName = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+// parseSpecs fields of name:type[:required][:ref=Model][:redact] specs
+func parseSpecs(specs []string) ([]field, error) {
+	var fields []field
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || !specName.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid field %s, like name:string:required", spec)
+		}
+		typ, ok := specTypes[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("field %s: unknown type %s", parts[0], parts[1])
+		}
+		f := field{Name: goName(parts[0]), Type: typ}
+		column := strings.ToLower(f.Name)
+		if seen[column] || column == "id" || column == "tenant" || column == "created" || column == "updated" {
+			return nil, fmt.Errorf("field %s: duplicate or reserved name", parts[0])
+		}
+		seen[column] = true
+		f.Tag = fmt.Sprintf(`db:"%s" json:"%s"`, column, column)
+		for _, opt := range parts[2:] {
+			switch {
+			case opt == "required":
+				f.Tag += ` valid:"required"`
+			case opt == "redact":
+				f.Tag += ` log:"redact"`
+			case strings.HasPrefix(opt, "ref=") && modelName.MatchString(opt[4:]) && typ == "int64":
+				f.Tag += ` ref:"` + opt[4:] + `"`
+			default:
+				return nil, fmt.Errorf("field %s: unknown option %s", parts[0], opt)
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+var initialisms = map[string]string{"id": "ID", "ip": "IP", "url": "URL", "api": "API", "uuid": "UUID", "http": "HTTP"}
+
+// goName exported name of a field spec name: file_survey is FileSurvey
+func goName(name string) string {
+	var b strings.Builder
+	for _, w := range strings.Split(name, "_") {
+		if up, ok := initialisms[w]; ok {
+			b.WriteString(up)
+		} else if w != "" {
+			b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+		}
+	}
+	return b.String()
+}
+
+// complete add the id, tenant and timestamps fields handlers need
+func (m *model) complete() {
+	has := make(map[string]bool)
+	for _, f := range m.Fields {
+		has[f.Name] = true
+	}
+	if !has["Id"] {
+		m.Fields = append([]field{{"Id", "int64", `db:"id" json:"id"`}}, m.Fields...)
+	}
+	for _, f := range []field{
+		{"Tenant", "string", `db:"tenant" json:"-"`},
+		{"Created", "time.Time", `db:"created" json:"created"`},
+		{"Updated", "time.Time", `db:"updated" json:"updated"`},
+	} {
+		if !has[f.Name] {
+			m.Fields = append(m.Fields, f)
+		}
+	}
+	for _, p := range []string{`"github.com/gin-gonic/gin"`, `"gopkg.in/gorp.v2"`, `"strconv"`, `"time"`} {
+		if !contains(m.Imports, p) {
+			m.Imports = append(m.Imports, p)
+		}
+	}
+	sort.Slice(m.Imports, func(i, j int) bool { // by path, like goimports
+		return m.Imports[i][strings.Index(m.Imports[i], `"`):] < m.Imports[j][strings.Index(m.Imports[j], `"`):]
+	})
+}
+
+// parseStruct model of the struct name, or of the only struct, of a Go file
+func parseStruct(path string, name string) (model, error) {
+	var m model
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return m, err
+	}
+	var found []*ast.TypeSpec
+	ast.Inspect(file, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSpec); ok {
+			if _, ok := ts.Type.(*ast.StructType); ok && (name == "" || ts.Name.Name == name) {
+				found = append(found, ts)
+			}
+		}
+		return true
+	})
+	if len(found) != 1 {
+		return m, fmt.Errorf("%s: %d struct(s) %s found, need one", path, len(found), name)
+	}
+	m.Name = found[0].Name.Name
+	if err := checkName(m.Name); err != nil {
+		return m, fmt.Errorf("%s: %w", path, err)
+	}
+	m.Fields, err = structFields(fset, found[0].Type.(*ast.StructType))
+	if err != nil {
+		return m, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, imp := range file.Imports { // of field types only
+		p, _ := strconv.Unquote(imp.Path.Value)
+		name, spec := p[strings.LastIndex(p, "/")+1:], imp.Path.Value
+		if imp.Name != nil {
+			name, spec = imp.Name.Name, imp.Name.Name+" "+imp.Path.Value
+		}
+		for _, f := range m.Fields {
+			if strings.Contains(f.Type, name+".") && !contains(m.Imports, spec) {
+				m.Imports = append(m.Imports, spec)
+			}
+		}
+	}
+	return m, nil
+}
+
+// structFields fields of a struct type
+func structFields(fset *token.FileSet, st *ast.StructType) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			return nil, errors.New("embedded fields are not supported")
+		}
+		var typ bytes.Buffer
+		printer.Fprint(&typ, fset, f.Type)
+		tag := ""
+		if f.Tag != nil {
+			tag, _ = strconv.Unquote(f.Tag.Value)
+		}
+		for _, n := range f.Names {
+			fields = append(fields, field{Name: n.Name, Type: typ.String(), Tag: tag})
+		}
+	}
+	return fields, nil
+}
+
+// mapping lines of the record built by UpdateX: fields from the request
+// body, except internal and server set ones read from the stored record.
+// Lines of known fields are kept, so hand edits survive go generate.
+func (m model) mapping(known map[string]string) []string {
+	var lines []string
+	for _, f := range m.Fields {
+		if line, ok := known[f.Name]; ok {
+			lines = append(lines, line)
+			continue
+		}
+		switch {
+		case f.Name == "Id":
+			lines = append(lines, "Id: "+m.Inst()+"Id,")
+		case f.Name == "Updated": // set by PreUpdate
+		case f.Column() == "-":
+		case f.Name == "Created" || f.JSON() == "-" || !ast.IsExported(f.Name):
+			lines = append(lines, f.Name+": "+m.Inst()+"."+f.Name+",")
+		default:
+			lines = append(lines, f.Name+": json."+f.Name+",")
+		}
+	}
+	return lines
+}
+
+// filter json name of the first string field, searched by the test
+func (m model) filter() *field {
+	for i, f := range m.Fields {
+		if f.Type == "string" && f.JSON() != "" && f.JSON() != "-" {
+			return &m.Fields[i]
+		}
+	}
+	return nil
+}
+
+// valid record literal of the test, with distinct values by the i
+// expression, without skip field
+func (m model) valid(skip string, i string) string {
+	var values []string
+	filter := m.filter()
+	for _, f := range m.Fields {
+		if f.Name == skip || !f.Required() && (filter == nil || f.Name != filter.Name) {
+			continue
+		}
+		v := ""
+		switch {
+		case f.Type == "string" && i == "0":
+			v = strconv.Quote(f.JSON() + "0")
+		case f.Type == "string":
+			v = fmt.Sprintf("fmt.Sprintf(%q, %s)", f.JSON()+"%d", i)
+		case f.Type == "int" || f.Type == "int32" || f.Type == "int64" || f.Type == "float64":
+			v = f.Type + "(" + i + " + 1)"
+			if i == "0" {
+				v = "1"
+			}
+		case f.Type == "bool":
+			v = "true"
+		case f.Type == "time.Time":
+			v = "time.Now()"
+		default:
+			continue // XXX set in test
+		}
+		values = append(values, f.Name+": "+v)
+	}
+	return m.Name + "{" + strings.Join(values, ", ") + "}"
+}
+
+// invalid record literals of the test, each missing a mandatory field
+func (m model) invalid() []string {
+	var records []string
+	for _, f := range m.Fields {
+		if f.Required() {
+			records = append(records, m.valid(f.Name, "0"))
+		}
+	}
+	return records
+}
+
+// generate write model and test files, register the model and add routes
+func generate(dir string, m model, routes string, force bool) error {
+	data := map[string]interface{}{
+		"M":       m,
+		"Imports": m.Imports,
+		"Mapping": m.mapping(nil),
+	}
+	file := filepath.Join(dir, m.Inst()+".go")
+	if err := write(file, modelTemplate, data, force || sameFile(file, m.From)); err != nil {
+		return err
+	}
+
+	testImports := []string{`"github.com/gin-gonic/gin"`, `"github.com/yvesago/gin-model-template/modeltest"`, `"testing"`}
+	valid := m.valid("", "i")
+	for _, p := range []string{"fmt", "time"} {
+		if strings.Contains(valid+strings.Join(m.invalid(), ""), p+".") {
+			testImports = append(testImports, `"`+p+`"`)
+		}
+	}
+	sort.Strings(testImports)
+	data["Imports"] = testImports
+	data["Valid"] = valid
+	data["Invalid"] = m.invalid()
+	data["Filter"] = ""
+	if f := m.filter(); f != nil {
+		data["Filter"] = f.JSON()
+	}
+	if err := write(filepath.Join(dir, m.Inst()+"_test.go"), testTemplate, data, force); err != nil {
+		return err
+	}
+
+	if err := register(filepath.Join(dir, "repo.go"), m); err != nil {
+		return err
+	}
+	return addRoutes(routes, m)
+}
+
+// write a template to a gofmt-ed file
+func write(path string, tmpl *template.Template, data interface{}, force bool) error {
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s exists, -force to overwrite", path)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return err
+	}
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fmt.Println("wrote", path)
+	return os.WriteFile(path, src, 0644)
+}
+
+var registerLine = regexp.MustCompile(`(?m)^\s*register\(dbmap, .*\n`)
+
+// register add the model table after the last one registered by InitDb
+func register(repo string, m model) error {
+	line := "\tregister(dbmap, " + m.Name + "{}, \"" + m.Name + "\")\n"
+	src, err := os.ReadFile(repo)
+	if err != nil {
+		fmt.Print("add to InitDb:\n", line)
+		return nil
+	}
+	if bytes.Contains(src, []byte("register(dbmap, "+m.Name+"{}")) {
+		return nil
+	}
+	found := registerLine.FindAllIndex(src, -1)
+	if found == nil {
+		return fmt.Errorf("%s: no register(dbmap, ...) line", repo)
+	}
+	end := found[len(found)-1][1]
+	src = append(src[:end:end], append([]byte(line), src[end:]...)...)
+	fmt.Println("registered", m.Name, "in", repo)
+	return os.WriteFile(repo, src, 0644)
+}
+
+// addRoutes add routes of the model above the "// ginmodel:routes" line
+// of file, or print them
+func addRoutes(file string, m model) error {
+	var b bytes.Buffer
+	routesTemplate.Execute(&b, m)
+	if file == "" {
+		fmt.Print("routes:\n", b.String())
+		return nil
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(src, []byte("\"/"+m.Resource()+"\"")) {
+		return nil
+	}
+	i := bytes.Index(src, []byte("// ginmodel:routes"))
+	if i < 0 {
+		return fmt.Errorf("%s: no \"// ginmodel:routes\" line", file)
+	}
+	i = bytes.LastIndexByte(src[:i], '\n') + 1
+	out := append([]byte{}, src[:i]...)
+	out = append(out, b.Bytes()...)
+	out = append(out, '\n')
+	out = append(out, src[i:]...)
+	fmt.Println("added routes to", file)
+	return os.WriteFile(file, out, 0644)
+}
+
+var (
+	mappingStart = regexp.MustCompile(`(?m)^\s*// ginmodel:mapping begin.*\n\s*(\w+) := (\w+)\{\n`)
+	mappingEnd   = regexp.MustCompile(`(?m)^\s*\}\n\s*// ginmodel:mapping end`)
+	mappingLine  = regexp.MustCompile(`^(\w+):`)
+)
+
+// updateFile rewrite the field mapping of a model file from its struct
+func updateFile(path string) (bool, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	start := mappingStart.FindSubmatchIndex(src)
+	if start == nil {
+		return false, fmt.Errorf("%s: no \"// ginmodel:mapping begin\" block", path)
+	}
+	end := mappingEnd.FindIndex(src[start[1]:])
+	if end == nil {
+		return false, fmt.Errorf("%s: no \"// ginmodel:mapping end\" line", path)
+	}
+	m, err := parseStruct(path, string(src[start[4]:start[5]]))
+	if err != nil {
+		return false, err
+	}
+	if inst := string(src[start[2]:start[3]]); inst != m.Inst() {
+		return false, fmt.Errorf("%s: mapping of %s, not %s", path, inst, m.Inst())
+	}
+
+	known := make(map[string]string)
+	for _, line := range strings.Split(string(src[start[1]:start[1]+end[0]]), "\n") {
+		line = strings.TrimSpace(line)
+		if name := mappingLine.FindStringSubmatch(line); name != nil {
+			known[name[1]] = line
+		}
+	}
+	body := strings.Join(m.mapping(known), "\n") + "\n"
+	out := append([]byte{}, src[:start[1]]...)
+	out = append(out, body...)
+	out = append(out, src[start[1]+end[0]:]...)
+	if out, err = format.Source(out); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	if bytes.Equal(out, src) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, out, 0644)
+}
+
+func sameFile(a string, b string) bool {
+	sa, err := os.Stat(a)
+	sb, errb := os.Stat(b)
+	return err == nil && errb == nil && os.SameFile(sa, sb)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
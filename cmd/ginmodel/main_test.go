@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const repoStub = `package models
+
+func openDb() {
+	register(dbmap, Agent{}, "Agent")
+	register(dbmap, User{}, "User")
+	dbmap.AddTableWithName(Token{}, "Token").SetKeys(true, "Id")
+}
+`
+
+const serverStub = `package main
+
+func main() {
+	{
+		v1.GET("/agents", GetAgents)
+
+		// ginmodel:routes
+	}
+}
+`
+
+func TestParseSpecs(t *testing.T) {
+	log.Println("= Field specs")
+	fields, err := parseSpecs([]string{"name:string:required", "ip_addr:string", "owner:int:ref=User", "pass:string:redact", "seen:time"})
+	assert.Nil(t, err, "specs")
+	assert.Equal(t, field{"Name", "string", `db:"name" json:"name" valid:"required"`}, fields[0], "required")
+	assert.Equal(t, field{"IPAddr", "string", `db:"ipaddr" json:"ipaddr"`}, fields[1], "initialism")
+	assert.Equal(t, `db:"owner" json:"owner" ref:"User"`, fields[2].Tag, "reference")
+	assert.Equal(t, "int64", fields[2].Type, "int is int64")
+	assert.Equal(t, `db:"pass" json:"pass" log:"redact"`, fields[3].Tag, "redact")
+	assert.Equal(t, "time.Time", fields[4].Type, "time")
+
+	log.Println("= Invalid specs")
+	for _, spec := range []string{"name", "Name:string", "name:text", "name:string:unique", "name:string:ref=User", "created:time"} {
+		_, err = parseSpecs([]string{spec})
+		assert.NotNil(t, err, spec)
+	}
+	_, err = parseSpecs([]string{"name:string", "name:string"})
+	assert.NotNil(t, err, "duplicate")
+	_, err = load("", []string{"host", "name:string"})
+	assert.NotNil(t, err, "model name")
+	for _, name := range []string{"Order", "Map", "Group", "Time", "Json"} {
+		_, err = load("", []string{name, "name:string"})
+		assert.NotNil(t, err, "reserved "+name)
+	}
+
+	log.Println("= Plural names")
+	for name, resource := range map[string]string{"Host": "hosts", "Status": "statuses", "Policy": "policies", "Key": "keys", "Box": "boxes", "Switch": "switches"} {
+		assert.Equal(t, resource, model{Name: name}.Resource(), name)
+	}
+	assert.Equal(t, "Statuses", model{Name: "Status"}.Names(), "handler name")
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "repo.go"), []byte(repoStub), 0644)
+	server := filepath.Join(dir, "server.go")
+	os.WriteFile(server, []byte(serverStub), 0644)
+
+	log.Println("= Generate model, test, registration and routes")
+	m, err := load("", []string{"Host", "name:string:required", "port:int:required", "seen:time"})
+	assert.Nil(t, err, "load")
+	assert.Nil(t, generate(dir, m, server, false), "generate")
+
+	src := parse(t, filepath.Join(dir, "host.go"))
+	assert.Contains(t, src, "//go:generate go run github.com/yvesago/gin-model-template/cmd/ginmodel -update $GOFILE", "go generate")
+	for _, s := range []string{"Tenant  string", "func GetHosts(", "func PostHost(", "func UpdateHost(", "func DeleteHost(", "Port:    json.Port,", "Created: host.Created,"} {
+		assert.Contains(t, src, s, "model file")
+	}
+	assert.NotContains(t, src, "Updated: ", "updated set by PreUpdate")
+
+	test := parse(t, filepath.Join(dir, "host_test.go"))
+	assert.Contains(t, test, `return Host{Name: fmt.Sprintf("name%d", i), Port: int64(i + 1)}`, "valid records")
+	assert.Contains(t, test, `Host{Port: 1},`, "missing name")
+	assert.Contains(t, test, `Filter: "name",`, "filter")
+
+	repo, _ := os.ReadFile(filepath.Join(dir, "repo.go"))
+	assert.Contains(t, string(repo), "register(dbmap, User{}, \"User\")\n\tregister(dbmap, Host{}, \"Host\")\n\tdbmap.AddTable", "registered")
+	routes, _ := os.ReadFile(server)
+	assert.Contains(t, string(routes), "v1.DELETE(\"/hosts/:id\", DeleteHost)\n\t\tv1.OPTIONS(\"/hosts\", Options)     // POST\n\t\tv1.OPTIONS(\"/hosts/:id\", Options) // PUT, DELETE\n\n\t\t// ginmodel:routes", "routes")
+
+	log.Println("= Existing files are kept")
+	assert.NotNil(t, generate(dir, m, server, false), "no overwrite")
+	assert.Nil(t, generate(dir, m, server, true), "force")
+	repo, _ = os.ReadFile(filepath.Join(dir, "repo.go"))
+	assert.Equal(t, 1, strings.Count(string(repo), "Host{}"), "registered once")
+	routes, _ = os.ReadFile(server)
+	assert.Equal(t, 1, strings.Count(string(routes), "GetHosts"), "routes once")
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	m, _ := load("", []string{"Host", "name:string:required", "seen:time"})
+	assert.Nil(t, generate(dir, m, "", false), "generate")
+	file := filepath.Join(dir, "host.go")
+
+	log.Println("= Unchanged struct")
+	changed, err := updateFile(file)
+	assert.Nil(t, err, "update")
+	assert.False(t, changed, "same mapping")
+
+	log.Println("= Added and removed fields, edited lines")
+	src, _ := os.ReadFile(file)
+	s := strings.Replace(string(src), "\tName    string", "\tRack string `db:\"rack\" json:\"rack\"`\n\tName    string", 1)
+	s = strings.Replace(s, "\tSeen    time.Time `db:\"seen\" json:\"seen\"`\n", "\tSeen time.Time `db:\"seen\" json:\"seen\"`\n\tKey string `db:\"key\" json:\"-\"`\n", 1)
+	s = strings.Replace(s, "Seen:    json.Seen,", "Seen: host.Seen, // set by agents", 1)
+	s = strings.Replace(s, "\tName    string    `db:\"name\" json:\"name\" valid:\"required\"`\n", "", 1)
+	os.WriteFile(file, []byte(s), 0644)
+
+	changed, err = updateFile(file)
+	assert.Nil(t, err, "update")
+	assert.True(t, changed, "new mapping")
+	src = []byte(parse(t, file))
+	mapping := string(src[strings.Index(string(src), "ginmodel:mapping begin"):strings.Index(string(src), "ginmodel:mapping end")])
+	assert.Contains(t, mapping, "Rack:    json.Rack,", "added field")
+	assert.Contains(t, mapping, "Key:     host.Key,", "internal field")
+	assert.Contains(t, mapping, "Seen:    host.Seen, // set by agents", "edited line")
+	assert.NotContains(t, mapping, "Name:", "removed field")
+
+	log.Println("= Files without mapping")
+	_, err = updateFile(filepath.Join(dir, "host_test.go"))
+	assert.NotNil(t, err, "no mapping block")
+}
+
+func TestFromStruct(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rack.go")
+	os.WriteFile(file, []byte("package models\n\nimport (\n\t\"database/sql\"\n\t\"fmt\"\n)\n\n"+
+		"type Rack struct {\n\tName string `db:\"name\" json:\"name\" valid:\"required\"`\n\tRoom, Row int64\n\tNote sql.NullString `db:\"note\" json:\"note\"`\n}\n\n"+
+		"func (r Rack) String() string { return fmt.Sprint(r.Name) }\n"), 0644)
+
+	log.Println("= Struct file")
+	m, err := load(file, nil)
+	assert.Nil(t, err, "load")
+	assert.Equal(t, "Rack", m.Name, "model name")
+	var names []string
+	for _, f := range m.Fields {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"Id", "Name", "Room", "Row", "Note", "Tenant", "Created", "Updated"}, names, "fields")
+	assert.Equal(t, []string{`"database/sql"`, `"github.com/gin-gonic/gin"`, `"gopkg.in/gorp.v2"`, `"strconv"`, `"time"`}, m.Imports, "imports of field types")
+
+	assert.Nil(t, generate(filepath.Join(dir), m, "", false), "generate")
+	parse(t, filepath.Join(dir, "rack_test.go"))
+	src := parse(t, filepath.Join(dir, "rack.go")) // replaced by the model file
+	assert.Contains(t, src, "Note    sql.NullString `db:\"note\" json:\"note\"`", "struct")
+
+	_, err = load(file, []string{"Host"})
+	assert.NotNil(t, err, "no Host struct")
+}
+
+// parse check a generated file is valid Go and return it
+func parse(t *testing.T, path string) string {
+	src, err := os.ReadFile(path)
+	assert.Nil(t, err, path)
+	_, err = parser.ParseFile(token.NewFileSet(), path, src, parser.ParseComments)
+	assert.Nil(t, err, path)
+	return string(src)
+}
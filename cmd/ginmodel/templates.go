@@ -0,0 +1,289 @@
+package main
+
+import "text/template"
+
+// modelTemplate model file, like agent.go
+var modelTemplate = template.Must(template.New("model").Parse(`package models
+
+//go:generate go run github.com/yvesago/gin-model-template/cmd/ginmodel -update $GOFILE
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+// XXX custom fields, then go generate to update the mapping of Update{{.M.Name}}
+// {{.M.Name}} db and json type
+type {{.M.Name}} struct {
+{{- range .M.Fields}}
+	{{.Name}} {{.Type}} ` + "`{{.Tag}}`" + `
+{{- end}}
+}
+
+// Validate check mandatory fields before Insert and Update
+func (a *{{.M.Name}}) Validate() error {
+	return required(a) // XXX add custom checks
+}
+
+// Hooks : PreInsert and PreUpdate
+
+// PreInsert set created an updated time before insert in db
+func (a *{{.M.Name}}) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	a.Updated = a.Created
+	return nil
+}
+
+// PreUpdate set updated time before insert in db
+func (a *{{.M.Name}}) PreUpdate(s gorp.SqlExecutor) error {
+	a.Updated = time.Now()
+	return nil
+}
+
+// REST handlers
+{{with .M}}
+// Get{{.Names}} return all {{.Resource}} filtered by URL query
+func Get{{.Names}}(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	query := "SELECT * FROM {{.Inst}}"
+
+	// Parse query string
+	q := c.Request.URL.Query()
+	if err := checkFilters("{{.Inst}}", q); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	s, o, l := ParseQuery(q)
+	s = tenantScope(c, "{{.Inst}}", s)
+
+	if cached, ok := cacheGet(c, "{{.Inst}}", c.Request.URL.RawQuery); ok {
+		if !notModified(c, cached.tag, time.Time{}) {
+			c.Header("X-Total-Count", strconv.FormatInt(cached.count, 10))
+			render(c, 200, cached.data)
+		}
+		return
+	}
+
+	where := ""
+	if s != "" {
+		where = " WHERE " + s
+	}
+	count, updated := listVersion(c, "{{.Inst}}", where)
+	tag := etag("{{.Inst}}", strconv.FormatInt(count, 10), updated, c.Request.URL.RawQuery)
+	if notModified(c, tag, time.Time{}) { // no Last-Modified, MAX(updated) stays the same after a delete
+		return
+	}
+
+	query = query + where
+	if o != "" {
+		query = query + o
+	}
+	if l != "" {
+		query = query + l
+	}
+
+	logger(c).Debug("list {{.Resource}}", "params", q)
+
+	var {{.Resource}} []{{.Name}}
+	start := time.Now()
+	_, err := dbmap.Select(&{{.Resource}}, query)
+	trace(c, query, start, err)
+
+	if err == nil {
+		countRows(c, len({{.Resource}}))
+		cachePut(c, "{{.Inst}}", c.Request.URL.RawQuery, cacheEntry{tag: tag, count: count, data: {{.Resource}}})
+		c.Header("X-Total-Count", strconv.FormatInt(count, 10)) // float64 to string
+		render(c, 200, {{.Resource}})
+	} else {
+		renderError(c, 404, "no {{.Inst}}(s) into the table")
+	}
+
+	// curl -i http://localhost:8080/api/v1/{{.Resource}}
+}
+
+// Get{{.Name}} return one {{.Inst}} by id
+func Get{{.Name}}(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var {{.Inst}} {{.Name}}
+	err := dbmap.SelectOne(&{{.Inst}}, "SELECT * FROM {{.Inst}} WHERE "+tenantScope(c, "{{.Inst}}", "id=?")+" LIMIT 1", id)
+
+	if err == nil {
+		if notModified(c, etag("{{.Inst}}", id, {{.Inst}}.Updated.Format(time.RFC3339Nano)), {{.Inst}}.Updated) {
+			return
+		}
+		render(c, 200, {{.Inst}})
+	} else {
+		renderError(c, 404, "{{.Inst}} not found")
+	}
+
+	// curl -i http://localhost:8080/api/v1/{{.Resource}}/1
+}
+
+// Post{{.Name}} create and return {{.Inst}}
+func Post{{.Name}}(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	var {{.Inst}} {{.Name}}
+	if bind(c, &{{.Inst}}) != nil {
+		return
+	}
+
+	logger(c).Debug("post {{.Inst}}", "{{.Inst}}", Redact({{.Inst}}))
+	setTenant(c, &{{.Inst}})
+
+	err := {{.Inst}}.Validate()
+	if err == nil {
+		err = checkStatus(&{{.Inst}}, nil)
+	}
+	if err == nil {
+		start := time.Now()
+		err = dbmap.Insert(&{{.Inst}})
+		trace(c, "INSERT {{.Inst}}", start, err)
+		if err == nil {
+			invalidate(c, "{{.Inst}}")
+			notify(c, "{{.Inst}}", "created", {{.Inst}}, nil)
+			render(c, 201, {{.Inst}})
+		} else {
+			checkErr(err, "Insert failed")
+		}
+
+	} else {
+		renderError(c, 400, err.Error())
+	}
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ ... }" http://localhost:8080/api/v1/{{.Resource}}
+}
+
+// Update{{.Name}} by id
+func Update{{.Name}}(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var {{.Inst}} {{.Name}}
+	err := dbmap.SelectOne(&{{.Inst}}, "SELECT * FROM {{.Inst}} WHERE "+tenantScope(c, "{{.Inst}}", "id=?"), id)
+	if err == nil {
+		var json {{.Name}}
+		if bind(c, &json) != nil {
+			return
+		}
+		logger(c).Debug("update {{.Inst}}", "id", id, "{{.Inst}}", Redact(json))
+		previous := {{.Inst}}
+		{{.Inst}}Id, _ := strconv.ParseInt(id, 0, 64)
+
+		// ginmodel:mapping begin, go generate adds and removes fields, keeps edited lines
+		{{.Inst}} := {{.Name}}{
+{{- end}}
+{{- range .Mapping}}
+			{{.}}
+{{- end}}
+{{- with .M}}
+		}
+		// ginmodel:mapping end
+
+		err = {{.Inst}}.Validate()
+		if err == nil {
+			err = checkStatus(&{{.Inst}}, &previous)
+		}
+		if err == nil {
+			start := time.Now()
+			_, err = dbmap.Update(&{{.Inst}})
+			trace(c, "UPDATE {{.Inst}} id="+id, start, err)
+			if err == nil {
+				invalidate(c, "{{.Inst}}")
+				notify(c, "{{.Inst}}", "updated", {{.Inst}}, previous)
+				render(c, 200, {{.Inst}})
+			} else {
+				checkErr(err, "Updated failed")
+			}
+
+		} else {
+			renderError(c, errorStatus(err), err.Error())
+		}
+
+	} else {
+		renderError(c, 404, "{{.Inst}} not found")
+	}
+
+	// curl -i -X PUT -H "Content-Type: application/json" -d "{ ... }" http://localhost:8080/api/v1/{{.Resource}}/1
+}
+
+// Delete{{.Name}} by id
+func Delete{{.Name}}(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var {{.Inst}} {{.Name}}
+	err := dbmap.SelectOne(&{{.Inst}}, "SELECT * FROM {{.Inst}} WHERE "+tenantScope(c, "{{.Inst}}", "id=?"), id)
+
+	if err == nil {
+		start := time.Now()
+		_, err = dbmap.Delete(&{{.Inst}})
+		trace(c, "DELETE {{.Inst}} id="+id, start, err)
+
+		if err == nil {
+			invalidate(c, "{{.Inst}}")
+			notify(c, "{{.Inst}}", "deleted", {{.Inst}}, nil)
+			render(c, 200, gin.H{"id": {{.Inst}}.Id, "status": "deleted"})
+		} else {
+			checkErr(err, "Delete failed")
+		}
+
+	} else {
+		renderError(c, 404, "{{.Inst}} not found")
+	}
+
+	// curl -i -X DELETE http://localhost:8080/api/v1/{{.Resource}}/1
+}
+{{- end}}
+`))
+
+// testTemplate model test, with the modeltest suite
+var testTemplate = template.Must(template.New("test").Parse(`package models
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+func Test{{.M.Name}}(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+
+	var url{{.M.Inst}} = "/api/v1/{{.M.Resource}}"
+	router.POST(url{{.M.Inst}}, Post{{.M.Name}})
+	router.GET(url{{.M.Inst}}, Get{{.M.Names}})
+	router.GET(url{{.M.Inst}}+"/:id", Get{{.M.Name}})
+	router.DELETE(url{{.M.Inst}}+"/:id", Delete{{.M.Name}})
+	router.PUT(url{{.M.Inst}}+"/:id", Update{{.M.Name}})
+
+	modeltest.Suite{
+		Router: router,
+		Path:   url{{.M.Inst}},
+		Valid:  func(i int) interface{} { return {{.Valid}} },
+		Invalid: []interface{}{
+{{- range .Invalid}}
+			{{.}},
+{{- end}}
+		},
+		Filter: "{{.Filter}}",
+	}.Run(t)
+}
+`))
+
+// routesTemplate routes of the model in the api/v1 group of a server
+var routesTemplate = template.Must(template.New("routes").Parse(`		v1.GET("/{{.Resource}}", Get{{.Names}})
+		v1.GET("/{{.Resource}}/:id", Get{{.Name}})
+		v1.POST("/{{.Resource}}", Post{{.Name}})
+		v1.PUT("/{{.Resource}}/:id", Update{{.Name}})
+		v1.DELETE("/{{.Resource}}/:id", Delete{{.Name}})
+		v1.OPTIONS("/{{.Resource}}", Options)     // POST
+		v1.OPTIONS("/{{.Resource}}/:id", Options) // PUT, DELETE
+`))
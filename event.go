@@ -0,0 +1,81 @@
+package models
+
+import (
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"log/slog"
+	"time"
+)
+
+// Event change of one record, sent to webhooks and bus subscribers
+type Event struct {
+	Id       uint64      `json:"id,omitempty"` // set by bus
+	Event    string      `json:"event"`        // resource.action, like agent.created
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data"`
+	Previous interface{} `json:"previous,omitempty"`
+	record   interface{} // to match filters on db columns
+	tenant   string      // of record or request, to filter streams
+}
+
+// notify publish a record change after Insert, Update or Delete,
+// and record status transitions of stateful models
+func notify(c *gin.Context, resource string, action string, data interface{}, previous interface{}) {
+	e := newEvent(resource, action, data, previous)
+	if e.tenant == "" {
+		e.tenant = tenantOf(c)
+	}
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	if action != "deleted" {
+		t := StatusTransition{User: c.GetString("User"), Reason: c.GetString("Reason")}
+		recordTransition(dbmap, logger(c), t, resource, data, previous)
+	}
+
+	var bus *Bus
+	if v, ok := c.Get("Bus"); ok {
+		bus = v.(*Bus)
+	}
+	var webhooks *Dispatcher
+	if v, ok := c.Get("Webhooks"); ok {
+		webhooks = v.(*Dispatcher)
+	}
+	publish(bus, webhooks, logger(c), dbmap, retainDb(c), e)
+}
+
+// newEvent of a record change, previous is nil for created and deleted
+func newEvent(resource string, action string, data interface{}, previous interface{}) Event {
+	e := Event{
+		Event:  resource + "." + action,
+		Time:   time.Now(),
+		Data:   withoutSecrets(data),
+		record: data,
+		tenant: recordTenant(data),
+	}
+	if previous != nil {
+		e.Previous = withoutSecrets(previous)
+	}
+	return e
+}
+
+// publish event to bus and webhooks of dbmap, both optional, then a
+// dedicated event when Status field changed, like agent.status. retain
+// keeps dbmap of a TenantPool opened for deliveries, nil for a shared one.
+func publish(bus *Bus, webhooks *Dispatcher, l *slog.Logger, dbmap *gorp.DbMap, retain func() func(), e Event) {
+	send := func(e Event) {
+		if bus != nil {
+			e = bus.Publish(e)
+		}
+		if webhooks != nil {
+			webhooks.dispatch(l, dbmap, retain, e)
+		}
+	}
+	send(e)
+
+	if e.Action() == "updated" && e.Previous != nil {
+		status, ok := e.Data.(map[string]interface{})["status"]
+		if ok && status != e.Previous.(map[string]interface{})["status"] {
+			e.Event = e.Resource() + ".status"
+			send(e)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"strconv"
+	"time"
+)
+
+// observations per report, XXX fix for your agents
+var maxFileReport = 10000
+
+// AgentFile db and json type of one file of an agent baseline
+type AgentFile struct {
+	Id      int64     `db:"id" json:"id"`
+	AgentId int64     `db:"agentid" json:"agentid"`
+	Path    string    `db:"path, size:4096" json:"path"`
+	Hash    string    `db:"hash, size:128" json:"hash"`
+	Size    int64     `db:"size" json:"size"`
+	Mtime   time.Time `db:"mtime" json:"mtime"`
+	Created time.Time `db:"created" json:"created"`
+	Updated time.Time `db:"updated" json:"updated"`
+}
+
+// AgentFileChange db and json type of a difference between two reports
+type AgentFileChange struct {
+	Id      int64     `db:"id" json:"id"`
+	AgentId int64     `db:"agentid" json:"agentid"`
+	Path    string    `db:"path, size:4096" json:"path"`
+	Change  string    `db:"change" json:"change"` // added, removed or modified
+	OldHash string    `db:"oldhash, size:128" json:"oldhash"`
+	Hash    string    `db:"hash, size:128" json:"hash"`
+	Size    int64     `db:"size" json:"size"`
+	Mtime   time.Time `db:"mtime" json:"mtime"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+// FileReport batch of observations sent by an agent, a full report
+// removes missing files from the baseline, a partial one only adds or modifies
+type FileReport struct {
+	Partial bool        `json:"partial"`
+	Files   []AgentFile `json:"files"`
+}
+
+// FileReportResult changes found by a report, published as agent.files event
+type FileReportResult struct {
+	AgentId  int64             `json:"agentid"`
+	Files    int               `json:"files"`
+	Added    int               `json:"added"`
+	Removed  int               `json:"removed"`
+	Modified int               `json:"modified"`
+	Changes  []AgentFileChange `json:"changes"`
+}
+
+// PreInsert set created an updated time before insert in db
+func (a *AgentFile) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	a.Updated = a.Created
+	return nil
+}
+
+// PreUpdate set updated time before insert in db
+func (a *AgentFile) PreUpdate(s gorp.SqlExecutor) error {
+	a.Updated = time.Now()
+	return nil
+}
+
+// PreInsert set created time before insert in db
+func (a *AgentFileChange) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	return nil
+}
+
+// PostAgentFiles store a report of agent files and return its diff
+// against the baseline of previous reports
+func PostAgentFiles(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var agent Agent
+	if err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE "+tenantScope(c, "agent", "id=?"), id); err != nil {
+		renderError(c, 404, "agent not found")
+		return
+	}
+
+	var report FileReport
+	if bind(c, &report) != nil {
+		return
+	}
+	if len(report.Files) > maxFileReport {
+		renderError(c, 413, "too many files, max "+strconv.Itoa(maxFileReport))
+		return
+	}
+	for _, f := range report.Files {
+		if f.Path == "" || f.Hash == "" {
+			renderError(c, 400, "mandatory fields are empty")
+			return
+		}
+	}
+
+	start := time.Now()
+	result, err := applyFileReport(dbmap, agent.Id, report)
+	trace(c, "REPORT agent files id="+id, start, err)
+	if err != nil {
+		renderUnavailable(c, "file report failed", err)
+		return
+	}
+	logger(c).Info("file report", "agent", agent.Id, "files", result.Files,
+		"added", result.Added, "removed", result.Removed, "modified", result.Modified)
+	if len(result.Changes) > 0 {
+		notify(c, "agent", "files", result, nil)
+	}
+	render(c, 200, result)
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"files\": [{ \"path\": \"/etc/passwd\", \"hash\": \"sha256:...\", \"size\": 1234, \"mtime\": \"2024-01-02T15:04:05Z\" }] }" http://localhost:8080/api/v1/agents/1/files
+}
+
+// applyFileReport update baseline and record changes in one transaction
+func applyFileReport(dbmap *gorp.DbMap, agentId int64, report FileReport) (FileReportResult, error) {
+	result := FileReportResult{AgentId: agentId, Changes: []AgentFileChange{}}
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return result, err
+	}
+
+	var files []AgentFile
+	if _, err = tx.Select(&files, "SELECT * FROM agentfile WHERE agentid=?", agentId); err != nil {
+		tx.Rollback()
+		return result, err
+	}
+	baseline := make(map[string]AgentFile, len(files))
+	for _, f := range files {
+		baseline[f.Path] = f
+	}
+
+	last := make(map[string]int, len(report.Files))
+	for i, f := range report.Files {
+		last[f.Path] = i
+	}
+	for i, f := range report.Files {
+		if last[f.Path] != i { // last observation of a path wins
+			continue
+		}
+		f.Id, f.AgentId = 0, agentId
+
+		old, ok := baseline[f.Path]
+		change := AgentFileChange{AgentId: agentId, Path: f.Path, Hash: f.Hash, Size: f.Size, Mtime: f.Mtime}
+		switch {
+		case !ok:
+			err = tx.Insert(&f)
+			change.Change = "added"
+			result.Added++
+		case old.Hash != f.Hash || old.Size != f.Size:
+			f.Id, f.Created = old.Id, old.Created
+			_, err = tx.Update(&f)
+			change.Change, change.OldHash = "modified", old.Hash
+			result.Modified++
+		case !old.Mtime.Equal(f.Mtime): // touched, same content
+			f.Id, f.Created = old.Id, old.Created
+			_, err = tx.Update(&f)
+		}
+		if err == nil && change.Change != "" {
+			err = tx.Insert(&change)
+			result.Changes = append(result.Changes, change)
+		}
+		if err != nil {
+			tx.Rollback()
+			return result, err
+		}
+	}
+
+	if !report.Partial {
+		for path, old := range baseline {
+			if _, ok := last[path]; ok {
+				continue
+			}
+			change := AgentFileChange{AgentId: agentId, Path: path, Change: "removed", OldHash: old.Hash, Size: old.Size, Mtime: old.Mtime}
+			if _, err = tx.Delete(&old); err == nil {
+				err = tx.Insert(&change)
+			}
+			if err != nil {
+				tx.Rollback()
+				return result, err
+			}
+			result.Changes = append(result.Changes, change)
+			result.Removed++
+		}
+	}
+
+	count, err := tx.SelectInt("SELECT COUNT(*) FROM agentfile WHERE agentid=?", agentId)
+	if err != nil {
+		tx.Rollback()
+		return result, err
+	}
+	result.Files = int(count)
+	return result, tx.Commit()
+}
+
+// GetAgentFiles return baseline of one agent filtered by URL query
+func GetAgentFiles(c *gin.Context) {
+	listAgentFiles(c, "agentfile", " ORDER BY path ASC", &[]AgentFile{})
+
+	// curl -i http://localhost:8080/api/v1/agents/1/files?_filters={"path":"/etc"}
+}
+
+// GetAgentFileChanges return file changes of one agent filtered by URL query
+func GetAgentFileChanges(c *gin.Context) {
+	listAgentFiles(c, "agentfilechange", " ORDER BY id DESC", &[]AgentFileChange{})
+
+	// curl -i http://localhost:8080/api/v1/agents/1/file-changes?_filters={"change":"modified"}
+}
+
+func listAgentFiles(c *gin.Context, table string, order string, list interface{}) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	// files of an agent are scoped by its tenant
+	if n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM agent WHERE "+tenantScope(c, "agent", "id=?"), id); n == 0 {
+		renderError(c, 404, "agent not found")
+		return
+	}
+
+	if err := checkFilters(table, c.Request.URL.Query()); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	s, o, l := ParseQuery(c.Request.URL.Query())
+	where := " WHERE agentid=?"
+	if s != "" {
+		where = where + " AND " + s
+	}
+	if o == "" {
+		o = order
+	}
+	count, _ := dbmap.SelectInt("SELECT COUNT(*) FROM "+table+where, id)
+
+	query := "SELECT * FROM " + table + where + o + l
+	start := time.Now()
+	_, err := dbmap.Select(list, query, id)
+	trace(c, query, start, err)
+
+	if err == nil {
+		c.Header("X-Total-Count", strconv.FormatInt(count, 10))
+		render(c, 200, list)
+	} else {
+		renderError(c, 404, "no file(s) into the table")
+	}
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFileSurvey(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	bus := NewBus(100)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(bus.Middleware())
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.DELETE(urla+"/:id", DeleteAgent)
+	router.POST(urla+"/:id/files", PostAgentFiles)
+	router.GET(urla+"/:id/files", GetAgentFiles)
+	router.GET(urla+"/:id/file-changes", GetAgentFileChanges)
+
+	do := func(method string, path string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	report := func(path string, r FileReport) (*httptest.ResponseRecorder, FileReportResult) {
+		resp := do("POST", path, r)
+		var res FileReportResult
+		json.Unmarshal(resp.Body.Bytes(), &res)
+		return resp, res
+	}
+
+	do("POST", urla, Agent{Name: "web1", IP: "10.0.0.1", FileSurvey: "/etc"})
+	do("POST", urla, Agent{Name: "web2", IP: "10.0.0.1"})
+	events, _ := bus.Subscribe(0, 10)
+	defer bus.Unsubscribe(events)
+	mtime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	// Reports
+	log.Println("= First report fills baseline")
+	resp, res := report(urla+"/1/files", FileReport{Files: []AgentFile{
+		{Path: "/etc/passwd", Hash: "h1", Size: 10, Mtime: mtime},
+		{Path: "/etc/group", Hash: "h2", Size: 20, Mtime: mtime},
+		{Path: "/etc/hosts", Hash: "h3", Size: 30, Mtime: mtime},
+	}})
+	assert.Equal(t, 200, resp.Code, "http POST report")
+	assert.Equal(t, 3, res.Files, "baseline size")
+	assert.Equal(t, 3, res.Added, "added")
+	e := <-events
+	assert.Equal(t, "agent.files", e.Event, "report published")
+
+	log.Println("= Full report diff")
+	_, res = report(urla+"/1/files", FileReport{Files: []AgentFile{
+		{Path: "/etc/passwd", Hash: "h1", Size: 10, Mtime: mtime.Add(time.Hour)}, // touched
+		{Path: "/etc/group", Hash: "h2b", Size: 21, Mtime: mtime},
+		{Path: "/etc/shadow", Hash: "h4", Size: 40, Mtime: mtime},
+	}})
+	assert.Equal(t, 3, res.Files, "baseline size")
+	assert.Equal(t, 1, res.Added, "added")
+	assert.Equal(t, 1, res.Removed, "removed")
+	assert.Equal(t, 1, res.Modified, "modified")
+	assert.Equal(t, 3, len(res.Changes), "changes")
+	<-events
+
+	log.Println("= Partial report never removes")
+	_, res = report(urla+"/1/files", FileReport{Partial: true, Files: []AgentFile{
+		{Path: "/etc/passwd", Hash: "h1c", Size: 11, Mtime: mtime},
+	}})
+	assert.Equal(t, 3, res.Files, "baseline size")
+	assert.Equal(t, 0, res.Removed, "no removed")
+	assert.Equal(t, 1, res.Modified, "modified")
+	<-events
+
+	log.Println("= Same report, no change, no event")
+	resp, res = report(urla+"/1/files", FileReport{Partial: true, Files: []AgentFile{
+		{Path: "/etc/passwd", Hash: "h1c", Size: 11, Mtime: mtime},
+	}})
+	assert.Equal(t, 200, resp.Code, "http POST report")
+	assert.Equal(t, 0, len(res.Changes), "no change")
+	assert.Equal(t, 0, len(events), "no event")
+
+	log.Println("= Invalid reports")
+	resp, _ = report(urla+"/1/files", FileReport{Files: []AgentFile{{Path: "/etc/motd"}}})
+	assert.Equal(t, 400, resp.Code, "http POST missing hash")
+	resp, _ = report(urla+"/9/files", FileReport{})
+	assert.Equal(t, 404, resp.Code, "http POST missing agent")
+	maxFileReport = 1
+	resp, _ = report(urla+"/2/files", FileReport{Files: []AgentFile{{Path: "/a", Hash: "a"}, {Path: "/b", Hash: "b"}}})
+	assert.Equal(t, 413, resp.Code, "http POST too many files")
+	maxFileReport = 10000
+
+	// Lists
+	log.Println("= http GET files and changes")
+	var files []AgentFile
+	resp = do("GET", urla+"/1/files", nil)
+	assert.Equal(t, 200, resp.Code, "http GET files")
+	assert.Equal(t, "3", resp.Header().Get("X-Total-Count"), "files count")
+	json.Unmarshal(resp.Body.Bytes(), &files)
+	assert.Equal(t, "/etc/group", files[0].Path, "sorted by path")
+	assert.Equal(t, "h2b", files[0].Hash, "current hash")
+
+	var changes []AgentFileChange
+	resp = do("GET", urla+"/1/file-changes?_filters="+url.QueryEscape(`{"change":"modified"}`), nil)
+	assert.Equal(t, "2", resp.Header().Get("X-Total-Count"), "modified count")
+	json.Unmarshal(resp.Body.Bytes(), &changes)
+	assert.Equal(t, "/etc/passwd", changes[0].Path, "last change first")
+	assert.Equal(t, "h1", changes[0].OldHash, "old hash")
+
+	resp = do("GET", urla+"/1/file-changes?_filters="+url.QueryEscape(`{"path":"hosts"}`), nil)
+	json.Unmarshal(resp.Body.Bytes(), &changes)
+	assert.Equal(t, 2, len(changes), "filter by path")
+	assert.Equal(t, "removed", changes[0].Change, "removed")
+	assert.Equal(t, "added", changes[1].Change, "added")
+
+	resp = do("GET", urla+"/1/files?_filters="+url.QueryEscape(`{"path":"/etc"}`), nil)
+	assert.Equal(t, "3", resp.Header().Get("X-Total-Count"), "filter by directory")
+	resp = do("GET", urla+"/1/files?_filters="+url.QueryEscape(`{"path":"/etc/s"}`), nil)
+	json.Unmarshal(resp.Body.Bytes(), &files)
+	if assert.Equal(t, 1, len(files), "filter by path prefix") {
+		assert.Equal(t, "/etc/shadow", files[0].Path, "path")
+	}
+
+	log.Println("= Last observation of a path wins")
+	_, res = report(urla+"/1/files", FileReport{Partial: true, Files: []AgentFile{
+		{Path: "/etc/shadow", Hash: "h4b", Size: 41, Mtime: mtime},
+		{Path: "/etc/shadow", Hash: "h4", Size: 40, Mtime: mtime},
+	}})
+	assert.Equal(t, 0, len(res.Changes), "same as baseline")
+	_, res = report(urla+"/1/files", FileReport{Partial: true, Files: []AgentFile{
+		{Path: "/etc/shadow", Hash: "h4", Size: 40, Mtime: mtime},
+		{Path: "/etc/shadow", Hash: "h4c", Size: 42, Mtime: mtime},
+	}})
+	if assert.Equal(t, 1, len(res.Changes), "one change") {
+		assert.Equal(t, "h4c", res.Changes[0].Hash, "last hash")
+	}
+	<-events
+
+	resp = do("GET", urla+"/2/files", nil)
+	assert.Equal(t, "0", resp.Header().Get("X-Total-Count"), "other agent baseline")
+	resp = do("GET", urla+"/9/file-changes", nil)
+	assert.Equal(t, 404, resp.Code, "http GET missing agent")
+
+	log.Println("= Delete agent drops its files")
+	do("DELETE", urla+"/1", nil)
+	n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM agentfile")
+	assert.Equal(t, int64(0), n, "files deleted")
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/gorp.v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fixture db and json type of a loaded seed record, maps its key to its row
+type Fixture struct {
+	Id       int64     `db:"id" json:"id"`
+	Model    string    `db:"model" json:"model"`
+	Key      string    `db:"key" json:"key"`
+	RecordId int64     `db:"recordid" json:"recordid"`
+	Created  time.Time `db:"created" json:"created"`
+}
+
+// PreInsert set created time before insert in db
+func (a *Fixture) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	return nil
+}
+
+// FixtureResult counts of a load
+type FixtureResult struct {
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// LoadFixtureFile load a YAML or JSON fixtures file, see LoadFixtures
+func LoadFixtureFile(dbmap *gorp.DbMap, path string) (FixtureResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FixtureResult{}, err
+	}
+	return LoadFixtures(dbmap, data)
+}
+
+// LoadFixtures insert or update seed records of registered models, by
+// model then record key, with json field names:
+//
+//	User:
+//	  thea: {name: Thea, mail: thea@example.org}
+//	Agent:
+//	  web1: {name: web1, ip: 10.0.0.1, owner: "@thea"}
+//
+// "@key" values of reference fields are ids of other fixtures. Loading the
+// same data again updates records of known keys, in one transaction.
+func LoadFixtures(dbmap *gorp.DbMap, data []byte) (FixtureResult, error) {
+	var result FixtureResult
+	var file map[string]map[string]map[string]interface{}
+	if err := yaml.Unmarshal(data, &file); err != nil { // JSON is YAML too
+		return result, err
+	}
+	fixtures := make(map[string]map[string]map[string]interface{})
+	for name, records := range file { // users or user for User
+		m, ok := ModelFor(name)
+		if !ok {
+			return result, fmt.Errorf("unknown model %s", name)
+		}
+		fixtures[m.Name] = records
+	}
+	models, err := fixtureOrder(fixtures)
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return result, err
+	}
+	for _, m := range models {
+		keys := make([]string, 0, len(fixtures[m.Name]))
+		for k := range fixtures[m.Name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // same ids for same data
+		for _, key := range keys {
+			if err = loadFixture(tx, m, key, fixtures[m.Name][key], &result); err != nil {
+				tx.Rollback()
+				return result, fmt.Errorf("%s %s: %w", m.Name, key, err)
+			}
+		}
+	}
+	return result, tx.Commit()
+}
+
+// fixtureOrder models of fixtures, referenced ones first
+func fixtureOrder(fixtures map[string]map[string]map[string]interface{}) ([]Model, error) {
+	var names []string
+	for name := range fixtures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []Model
+	done := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		m, _ := ModelFor(name)
+		if done[m.Name] {
+			return nil
+		}
+		if contains(path, m.Name) {
+			return fmt.Errorf("reference cycle %s", strings.Join(append(path, m.Name), " > "))
+		}
+		for _, f := range m.Fields() {
+			if _, ok := fixtures[f.Ref]; ok && f.Ref != m.Name {
+				if err := visit(f.Ref, append(path, m.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		done[m.Name] = true
+		order = append(order, m)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// loadFixture insert a record or update the record of a known key
+func loadFixture(tx *gorp.Transaction, m Model, key string, values map[string]interface{}, result *FixtureResult) error {
+	for _, f := range m.Fields() { // resolve "@key" references
+		ref, ok := values[f.JSON].(string)
+		if f.Ref == "" || !ok || !strings.HasPrefix(ref, "@") {
+			continue
+		}
+		id, err := tx.SelectInt("SELECT recordid FROM fixture WHERE model=? AND key=?", f.Ref, ref[1:])
+		if err != nil || id == 0 {
+			return fmt.Errorf("unknown reference %s %s", f.Ref, ref)
+		}
+		values[f.JSON] = id
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	var fixture Fixture
+	record := m.New()
+	known := tx.SelectOne(&fixture, "SELECT * FROM fixture WHERE model=? AND key=?", m.Name, key) == nil &&
+		tx.SelectOne(record, "SELECT * FROM "+m.Name+" WHERE id=?", fixture.RecordId) == nil
+	if !known {
+		record = m.New()
+	}
+	before, _ := json.Marshal(record)
+	previous := reflect.ValueOf(record).Elem().Interface()
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(record); err != nil {
+		return err
+	}
+	keepPassword(record, previous)
+	if err = validate(record); err != nil {
+		return err
+	}
+
+	if !known {
+		if err = checkStatus(record, nil); err != nil {
+			return err
+		}
+		if err = tx.Insert(record); err != nil {
+			return err
+		}
+		id := reflect.ValueOf(record).Elem().FieldByName("Id").Int()
+		if fixture.Id != 0 { // record was deleted, map key to the new one
+			fixture.RecordId = id
+			_, err = tx.Update(&fixture)
+		} else {
+			err = tx.Insert(&Fixture{Model: m.Name, Key: key, RecordId: id})
+		}
+		result.Inserted++
+		return err
+	}
+
+	if after, _ := json.Marshal(record); bytes.Equal(before, after) {
+		result.Unchanged++
+		return nil
+	}
+	if err = checkStatus(record, previous); err != nil {
+		return err
+	}
+	_, err = tx.Update(record)
+	result.Updated++
+	return err
+}
+
+// keepPassword keep stored hash when a fixture clear password matches it,
+// so loading again leaves users unchanged
+func keepPassword(record interface{}, previous interface{}) {
+	prev := reflect.New(reflect.TypeOf(previous))
+	prev.Elem().Set(reflect.ValueOf(previous))
+	checker, ok := prev.Interface().(interface{ CheckPassword(string) bool })
+	pass := reflect.ValueOf(record).Elem().FieldByName("Pass")
+	if ok && pass.Kind() == reflect.String && pass.String() != "" && checker.CheckPassword(pass.String()) {
+		pass.SetString(prev.Elem().FieldByName("Pass").String())
+	}
+}
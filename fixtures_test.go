@@ -0,0 +1,61 @@
+package models
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"testing"
+)
+
+func TestFixtures(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	dbmap := InitDb(config.DBname)
+
+	log.Println("= Load sample fixtures")
+	r, err := LoadFixtureFile(dbmap, "sample/fixtures.yml")
+	assert.Nil(t, err, "load")
+	assert.Equal(t, FixtureResult{Inserted: 5}, r, "inserted")
+
+	var agent Agent
+	dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE name='db1'")
+	owner, _ := dbmap.SelectStr("SELECT name FROM user WHERE id=?", agent.Owner)
+	assert.Equal(t, "Thea", owner, "reference by key")
+	assert.Equal(t, AgentNew, agent.Status, "initial status")
+	var admin User
+	dbmap.SelectOne(&admin, "SELECT * FROM user WHERE name='Admin'")
+	assert.True(t, admin.CheckPassword("change-me-now"), "password hashed")
+
+	log.Println("= Load again is idempotent")
+	r, err = LoadFixtureFile(dbmap, "sample/fixtures.yml")
+	assert.Nil(t, err, "load again")
+	assert.Equal(t, FixtureResult{Unchanged: 5}, r, "unchanged")
+	n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM agent")
+	assert.Equal(t, int64(3), n, "no duplicates")
+
+	log.Println("= JSON fixtures update known keys")
+	r, err = LoadFixtures(dbmap, []byte(`{"agents": {"web1": {"role": "proxy", "owner": "@thea"}, "web9": {"name": "web9", "ip": "10.0.0.9"}}}`))
+	assert.Nil(t, err, "load json")
+	assert.Equal(t, FixtureResult{Inserted: 1, Updated: 1}, r, "updated and inserted")
+	dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE name='web1'")
+	assert.Equal(t, "proxy", agent.Role, "role updated")
+	assert.Equal(t, "10.0.0.1", agent.IP, "ip kept")
+
+	log.Println("= Deleted records are inserted again")
+	dbmap.Exec("DELETE FROM agent WHERE name='web2'")
+	r, _ = LoadFixtureFile(dbmap, "sample/fixtures.yml")
+	assert.Equal(t, 1, r.Inserted, "web2 again")
+	n, _ = dbmap.SelectInt("SELECT COUNT(*) FROM fixture WHERE model='Agent'")
+	assert.Equal(t, int64(4), n, "one fixture per key")
+
+	log.Println("= Invalid fixtures are not loaded")
+	_, err = LoadFixtures(dbmap, []byte("Agent:\n  web5: {name: web5, ip: 10.0.0.5}\n  web6: {name: web6, ip: 10.0.0.6, owner: '@nobody'}\n"))
+	assert.NotNil(t, err, "unknown reference")
+	n, _ = dbmap.SelectInt("SELECT COUNT(*) FROM agent WHERE name='web5'")
+	assert.Equal(t, int64(0), n, "rolled back")
+	_, err = LoadFixtures(dbmap, []byte("Robot:\n  r1: {name: r1}\n"))
+	assert.NotNil(t, err, "unknown model")
+	_, err = LoadFixtures(dbmap, []byte("Agent:\n  web7: {name: web7}\n"))
+	assert.NotNil(t, err, "mandatory field")
+	_, err = LoadFixtures(dbmap, []byte("Agent:\n  web8: {name: web8, ip: 10.0.0.8, color: red}\n"))
+	assert.NotNil(t, err, "unknown field")
+}
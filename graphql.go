@@ -0,0 +1,402 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"gopkg.in/gorp.v2"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gqlOnce   sync.Once
+	gqlSchema graphql.Schema
+	gqlErr    error
+)
+
+type ginContextKey struct{}
+
+// GraphQL serve queries and mutations generated from registered models
+//
+//	{ users(filters: "{\"name\":\"t\"}", sortField: "name", sortDir: "ASC") { id name agents { name ip } } }
+//	mutation { createAgent(input: {name: "a", ip: "10.0.0.1", owner: 1}) { id } }
+func GraphQL(c *gin.Context) {
+	gqlOnce.Do(func() {
+		gqlSchema, gqlErr = Schema(Models())
+	})
+	if gqlErr != nil {
+		c.JSON(500, gin.H{"error": gqlErr.Error()})
+		return
+	}
+
+	var req struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Query == "" {
+		c.JSON(400, gin.H{"error": "query is missing"})
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         gqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(c.Request.Context(), ginContextKey{}, c),
+	})
+	c.JSON(200, result)
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"query\": \"{ agents { id name } }\" }" http://localhost:8080/graphql
+}
+
+// Schema build a GraphQL schema from models: for Agent, queries agent(id)
+// and agents(filters, sortField, sortDir, page, perPage), mutations
+// createAgent(input), updateAgent(id, input) and deleteAgent(id).
+// Fields tagged `ref:"User"` resolve to the referenced record and User
+// gets the reverse agents list.
+func Schema(models []Model) (graphql.Schema, error) {
+	objects := make(map[string]*graphql.Object)
+	for _, m := range models {
+		m := m
+		objects[m.Name] = graphql.NewObject(graphql.ObjectConfig{
+			Name: m.Name,
+			Fields: graphql.FieldsThunk(func() graphql.Fields {
+				return objectFields(m, models, objects)
+			}),
+		})
+	}
+
+	query := graphql.Fields{}
+	mutation := graphql.Fields{}
+	for _, m := range models {
+		r := m.Resource()
+		input := graphql.NewInputObject(graphql.InputObjectConfig{
+			Name:   m.Name + "Input",
+			Fields: inputFields(m),
+		})
+		id := graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}}
+
+		query[r] = &graphql.Field{Type: objects[m.Name], Args: id, Resolve: getResolver(m)}
+		query[plural(r)] = &graphql.Field{Type: graphql.NewList(objects[m.Name]), Args: listArgs(), Resolve: listResolver(m, "")}
+		query[plural(r)+"Count"] = &graphql.Field{Type: graphql.Int, Args: listArgs(), Resolve: countResolver(m)}
+
+		mutation["create"+m.Name] = &graphql.Field{
+			Type: objects[m.Name],
+			Args: graphql.FieldConfigArgument{
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(input)},
+			},
+			Resolve: createResolver(m),
+		}
+		mutation["update"+m.Name] = &graphql.Field{
+			Type: objects[m.Name],
+			Args: graphql.FieldConfigArgument{
+				"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(input)},
+			},
+			Resolve: updateResolver(m),
+		}
+		mutation["delete"+m.Name] = &graphql.Field{Type: graphql.Boolean, Args: id, Resolve: deleteResolver(m)}
+	}
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutation}),
+	})
+}
+
+func objectFields(m Model, models []Model, objects map[string]*graphql.Object) graphql.Fields {
+	fields := graphql.Fields{}
+	for _, f := range m.Fields() {
+		f := f
+		if secret(m.Type.Field(f.Index)) { // like User.Pass
+			continue
+		}
+		if ref, ok := objects[f.Ref]; ok {
+			target, _ := ModelFor(f.Ref)
+			fields[f.JSON] = &graphql.Field{Type: ref, Resolve: refResolver(target, f)}
+			continue
+		}
+		fields[f.JSON] = &graphql.Field{
+			Type: scalarFor(f.Type),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return reflect.Indirect(reflect.ValueOf(p.Source)).Field(f.Index).Interface(), nil
+			},
+		}
+	}
+	// reverse of references: User.agents
+	for _, o := range models {
+		for _, f := range o.Fields() {
+			if f.Ref == m.Name {
+				fields[plural(o.Resource())] = &graphql.Field{
+					Type:    graphql.NewList(objects[o.Name]),
+					Args:    listArgs(),
+					Resolve: listResolver(o, f.Column),
+				}
+			}
+		}
+	}
+	return fields
+}
+
+func inputFields(m Model) graphql.InputObjectConfigFieldMap {
+	fields := graphql.InputObjectConfigFieldMap{}
+	for _, f := range m.Fields() {
+		if f.Column == "id" || f.Column == "created" || f.Column == "updated" {
+			continue
+		}
+		if secret(m.Type.Field(f.Index)) { // passwords are set by REST and account handlers
+			continue
+		}
+		if f.Readonly {
+			continue
+		}
+		fields[f.JSON] = &graphql.InputObjectFieldConfig{Type: scalarFor(f.Type)}
+	}
+	return fields
+}
+
+func listArgs() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"filters":   &graphql.ArgumentConfig{Type: graphql.String, Description: "json map like _filters"},
+		"sortField": &graphql.ArgumentConfig{Type: graphql.String},
+		"sortDir":   &graphql.ArgumentConfig{Type: graphql.String},
+		"page":      &graphql.ArgumentConfig{Type: graphql.Int},
+		"perPage":   &graphql.ArgumentConfig{Type: graphql.Int},
+	}
+}
+
+func scalarFor(t reflect.Type) *graphql.Scalar {
+	if t == reflect.TypeOf(time.Time{}) {
+		return graphql.DateTime
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return graphql.Int
+	case reflect.Float32, reflect.Float64:
+		return graphql.Float
+	case reflect.Bool:
+		return graphql.Boolean
+	}
+	return graphql.String
+}
+
+// argsQuery translate list arguments to ParseQuery parameters
+func argsQuery(args map[string]interface{}) map[string][]string {
+	q := make(map[string][]string)
+	for arg, key := range map[string]string{"filters": "_filters", "sortField": "_sortField", "sortDir": "_sortDir"} {
+		if v, ok := args[arg].(string); ok {
+			q[key] = []string{v}
+		}
+	}
+	for arg, key := range map[string]string{"page": "_page", "perPage": "_perPage"} {
+		if v, ok := args[arg].(int); ok {
+			q[key] = []string{strconv.Itoa(v)}
+		}
+	}
+	return q
+}
+
+// ginFrom return the gin context of a GraphQL request
+func ginFrom(p graphql.ResolveParams) *gin.Context {
+	return p.Context.Value(ginContextKey{}).(*gin.Context)
+}
+
+func getRecord(c *gin.Context, m Model, id interface{}) (interface{}, error) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	record := m.New()
+	err := dbmap.SelectOne(record, "SELECT * FROM "+m.Name+" WHERE "+tenantScope(c, m.Name, "id=?")+" LIMIT 1", id)
+	if err != nil {
+		return nil, errors.New(m.Resource() + " not found")
+	}
+	return record, nil
+}
+
+func getResolver(m Model) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if err := keyAllows(ginFrom(p), m.Name, "read"); err != nil {
+			return nil, err
+		}
+		return getRecord(ginFrom(p), m, p.Args["id"])
+	}
+}
+
+func refResolver(target Model, f Field) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		id := reflect.Indirect(reflect.ValueOf(p.Source)).Field(f.Index)
+		if id.IsZero() {
+			return nil, nil
+		}
+		if err := keyAllows(ginFrom(p), target.Name, "read"); err != nil {
+			return nil, err
+		}
+		return getRecord(ginFrom(p), target, id.Interface())
+	}
+}
+
+// listResolver select records with list arguments, restricted to
+// records referencing the source when column is set
+func listResolver(m Model, column string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		c := ginFrom(p)
+		dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+		if err := keyAllows(c, m.Name, "read"); err != nil {
+			return nil, err
+		}
+		if err := checkFilters(m.Name, argsQuery(p.Args)); err != nil {
+			return nil, err
+		}
+		s, o, l := ParseQuery(argsQuery(p.Args))
+		s = tenantScope(c, m.Name, s)
+		var where []string
+		var params []interface{}
+		if column != "" {
+			where = append(where, column+"=?")
+			params = append(params, reflect.Indirect(reflect.ValueOf(p.Source)).FieldByName("Id").Interface())
+		}
+		if s != "" {
+			where = append(where, s)
+		}
+		query := "SELECT * FROM " + m.Name
+		if len(where) > 0 {
+			query = query + " WHERE " + strings.Join(where, " AND ")
+		}
+		query = query + o + l
+
+		records := m.NewSlice()
+		start := time.Now()
+		_, err := dbmap.Select(records, query, params...)
+		trace(c, query, start, err)
+		return reflect.ValueOf(records).Elem().Interface(), err
+	}
+}
+
+func countResolver(m Model) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		c := ginFrom(p)
+		dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+		if err := keyAllows(c, m.Name, "read"); err != nil {
+			return nil, err
+		}
+		if err := checkFilters(m.Name, argsQuery(p.Args)); err != nil {
+			return nil, err
+		}
+		s, _, _ := ParseQuery(argsQuery(p.Args))
+		s = tenantScope(c, m.Name, s)
+		query := "SELECT COUNT(*) FROM " + m.Name
+		if s != "" {
+			query = query + " WHERE " + s
+		}
+		count, err := dbmap.SelectInt(query)
+		return int(count), err
+	}
+}
+
+// setFields copy GraphQL input values to record fields
+func setFields(m Model, record interface{}, input map[string]interface{}) {
+	rv := reflect.ValueOf(record).Elem()
+	for _, f := range m.Fields() {
+		v, ok := input[f.JSON]
+		if !ok || v == nil {
+			continue
+		}
+		value := reflect.ValueOf(v)
+		if value.Type().ConvertibleTo(f.Type) {
+			rv.Field(f.Index).Set(value.Convert(f.Type))
+		}
+	}
+}
+
+func createResolver(m Model) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		c := ginFrom(p)
+		dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+		if err := keyAllows(c, m.Name, "write"); err != nil {
+			return nil, err
+		}
+		record := m.New()
+		setFields(m, record, p.Args["input"].(map[string]interface{}))
+		setTenant(c, record)
+		if err := validate(record); err != nil {
+			return nil, err
+		}
+		if err := checkStatus(record, nil); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		err := dbmap.Insert(record)
+		trace(c, "INSERT "+m.Resource(), start, err)
+		if err != nil {
+			return nil, err
+		}
+		invalidate(c, m.Resource())
+		notify(c, m.Resource(), "created", reflect.ValueOf(record).Elem().Interface(), nil)
+		return record, nil
+	}
+}
+
+// updateResolver update only fields set in input
+func updateResolver(m Model) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		c := ginFrom(p)
+		dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+		if err := keyAllows(c, m.Name, "write"); err != nil {
+			return nil, err
+		}
+		record, err := getRecord(c, m, p.Args["id"])
+		if err != nil {
+			return nil, err
+		}
+		previous := reflect.ValueOf(record).Elem().Interface()
+		setFields(m, record, p.Args["input"].(map[string]interface{}))
+		if err := validate(record); err != nil {
+			return nil, err
+		}
+		if err := checkStatus(record, previous); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		_, err = dbmap.Update(record)
+		trace(c, "UPDATE "+m.Resource(), start, err)
+		if err != nil {
+			return nil, err
+		}
+		invalidate(c, m.Resource())
+		notify(c, m.Resource(), "updated", reflect.ValueOf(record).Elem().Interface(), previous)
+		return record, nil
+	}
+}
+
+func deleteResolver(m Model) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		c := ginFrom(p)
+		dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+		if err := keyAllows(c, m.Name, "write"); err != nil {
+			return false, err
+		}
+		record, err := getRecord(c, m, p.Args["id"])
+		if err != nil {
+			return false, err
+		}
+		start := time.Now()
+		_, err = dbmap.Delete(record)
+		trace(c, "DELETE "+m.Resource(), start, err)
+		if err != nil {
+			return false, err
+		}
+		invalidate(c, m.Resource())
+		notify(c, m.Resource(), "deleted", reflect.ValueOf(record).Elem().Interface(), nil)
+		return true, nil
+	}
+}
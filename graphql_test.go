@@ -0,0 +1,105 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type gqlResult struct {
+	Data   map[string]interface{}
+	Errors []struct{ Message string }
+}
+
+func TestGraphQL(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	dbmap := InitDb(config.DBname)
+	router.Use(DatabaseMap(dbmap))
+	router.POST("/graphql", GraphQL)
+
+	do := func(query string, variables map[string]interface{}) gqlResult {
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(gin.H{"query": query, "variables": variables})
+		req, _ := http.NewRequest("POST", "/graphql", b)
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code, "http POST graphql")
+		var r gqlResult
+		json.Unmarshal(resp.Body.Bytes(), &r)
+		return r
+	}
+
+	// Mutations
+	log.Println("= GraphQL create")
+	r := do(`mutation { createUser(input: {name: "Thea", mail: "thea@example.org"}) { id name } }`, nil)
+	assert.Empty(t, r.Errors, "no error")
+	assert.Equal(t, float64(1), r.Data["createUser"].(map[string]interface{})["id"], "user id")
+
+	for _, name := range []string{"web1", "web2", "db1"} {
+		r = do(`mutation($name: String) { createAgent(input: {name: $name, ip: "10.0.0.1", owner: 1}) { id } }`,
+			map[string]interface{}{"name": name})
+		assert.Empty(t, r.Errors, "no error")
+	}
+
+	log.Println("= GraphQL validation")
+	r = do(`mutation { createAgent(input: {name: "missing ip"}) { id } }`, nil)
+	assert.Equal(t, 1, len(r.Errors), "mandatory fields error")
+
+	// Queries
+	log.Println("= GraphQL users with agents")
+	r = do(`{ users { name agents(sortField: "name", sortDir: "DESC") { name } } }`, nil)
+	assert.Empty(t, r.Errors, "no error")
+	users := r.Data["users"].([]interface{})
+	assert.Equal(t, 1, len(users), "1 user")
+	agents := users[0].(map[string]interface{})["agents"].([]interface{})
+	assert.Equal(t, 3, len(agents), "3 agents")
+	assert.Equal(t, "web2", agents[0].(map[string]interface{})["name"], "sorted agents")
+
+	log.Println("= GraphQL without secret fields")
+	r = do(`{ users { name pass } }`, nil)
+	if assert.Equal(t, 1, len(r.Errors), "no pass field") {
+		assert.Contains(t, r.Errors[0].Message, "pass", "unknown field")
+	}
+	assert.Nil(t, r.Data["users"], "no data")
+
+	log.Println("= GraphQL filters and pagination")
+	r = do(`{ agents(filters: "{\"name\":\"web\"}", sortField: "name", sortDir: "ASC", perPage: 1) { name owner { name } } agentsCount(filters: "{\"name\":\"web\"}") }`, nil)
+	assert.Empty(t, r.Errors, "no error")
+	agents = r.Data["agents"].([]interface{})
+	assert.Equal(t, 1, len(agents), "1 agent per page")
+	assert.Equal(t, "web1", agents[0].(map[string]interface{})["name"], "first page")
+	assert.Equal(t, "Thea", agents[0].(map[string]interface{})["owner"].(map[string]interface{})["name"], "owner")
+	assert.Equal(t, float64(2), r.Data["agentsCount"], "count")
+
+	r = do(`{ agent(id: 3) { name } }`, nil)
+	assert.Equal(t, "db1", r.Data["agent"].(map[string]interface{})["name"], "one agent")
+
+	log.Println("= GraphQL update and delete")
+	r = do(`mutation { updateAgent(id: 3, input: {status: "offline"}) { name status } }`, nil)
+	assert.Empty(t, r.Errors, "no error")
+	assert.Equal(t, "db1", r.Data["updateAgent"].(map[string]interface{})["name"], "name kept")
+	assert.Equal(t, "offline", r.Data["updateAgent"].(map[string]interface{})["status"], "status updated")
+
+	r = do(`mutation { updateAgent(id: 3, input: {lastip: "192.0.2.1"}) { lastip } }`, nil)
+	assert.Equal(t, 1, len(r.Errors), "lastip set by heartbeat only")
+
+	dbmap.Insert(&AgentFile{AgentId: 3, Path: "/etc/passwd", Hash: "h1"})
+	dbmap.Insert(&AgentFileChange{AgentId: 3, Path: "/etc/passwd", Change: "added", Hash: "h1"})
+	r = do(`mutation { deleteAgent(id: 3) }`, nil)
+	assert.Equal(t, true, r.Data["deleteAgent"], "deleted")
+	r = do(`{ agent(id: 3) { name } }`, nil)
+	assert.Equal(t, "agent not found", r.Errors[0].Message, "no more agent 3")
+	n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM agentfile")
+	m, _ := dbmap.SelectInt("SELECT COUNT(*) FROM agentfilechange")
+	assert.Equal(t, int64(0), n+m, "files and changes deleted with agent")
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+)
+
+// Check status of one readiness check
+type Check struct {
+	Status  string   `json:"status"`
+	Error   string   `json:"error,omitempty"`
+	Pending []string `json:"pending,omitempty"`
+}
+
+// Healthz process is alive
+func Healthz(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+
+	// curl -i http://localhost:8080/healthz
+}
+
+// Readyz check database is reachable and migrations are current
+func Readyz(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	checks := make(map[string]Check)
+	status := "ok"
+
+	err := dbmap.Db.Ping()
+	if err == nil {
+		_, err = dbmap.SelectInt("SELECT COUNT(*) FROM sqlite_master") // read the file
+	}
+	checks["database"] = newCheck(err)
+
+	pending, err := PendingMigrations(dbmap)
+	check := newCheck(err)
+	if err == nil && len(pending) > 0 {
+		check = Check{Status: "fail", Pending: pending}
+	}
+	checks["migrations"] = check
+
+	for _, ch := range checks {
+		if ch.Status != "ok" {
+			status = "fail"
+		}
+	}
+
+	if status == "ok" {
+		c.JSON(200, gin.H{"status": status, "checks": checks})
+	} else {
+		c.JSON(503, gin.H{"status": status, "checks": checks})
+	}
+
+	// curl -i http://localhost:8080/readyz
+}
+
+func newCheck(err error) Check {
+	if err != nil {
+		return Check{Status: "fail", Error: err.Error()}
+	}
+	return Check{Status: "ok"}
+}
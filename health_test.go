@@ -0,0 +1,121 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gorp.v2"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	router := gin.New()
+	router.Use(DatabaseMap(dbmap))
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+
+	log.Println("= http GET healthz")
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET healthz success")
+
+	log.Println("= http GET readyz")
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET readyz success")
+	var r struct {
+		Status string
+		Checks map[string]Check
+	}
+	json.Unmarshal(resp.Body.Bytes(), &r)
+	assert.Equal(t, "ok", r.Status, "ready")
+	assert.Equal(t, "ok", r.Checks["database"].Status, "database ok")
+	assert.Equal(t, "ok", r.Checks["migrations"].Status, "migrations ok")
+
+	log.Println("= Pending migration")
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(migrations, Migration{
+		Id: "9999_test",
+		Up: func(s gorp.SqlExecutor) error {
+			return addColumn(s, "Agent", "extra", "varchar(255)")
+		},
+	})
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 503, resp.Code, "http GET readyz not ready")
+	json.Unmarshal(resp.Body.Bytes(), &r)
+	assert.Equal(t, []string{"9999_test"}, r.Checks["migrations"].Pending, "pending migration")
+
+	log.Println("= Apply migration")
+	err := Migrate(dbmap)
+	assert.Nil(t, err, "migrate")
+	err = Migrate(dbmap)
+	assert.Nil(t, err, "migrate twice")
+	n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM pragma_table_info('Agent') WHERE name='extra'")
+	assert.Equal(t, int64(1), n, "column added")
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET readyz ready again")
+
+	log.Println("= Database closed")
+	dbmap.Db.Close()
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 503, resp.Code, "http GET readyz database down")
+}
+
+func TestMigrateDown(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	dbmap := InitDb(config.DBname)
+	defer dbmap.Db.Close()
+	last := migrations[len(migrations)-1].Id
+
+	log.Println("= Status of applied migrations")
+	status, err := MigrationStatus(dbmap)
+	assert.Nil(t, err, "status")
+	assert.Equal(t, len(migrations), len(status), "one record by migration")
+	for _, s := range status {
+		assert.False(t, s.Applied.IsZero(), s.Id+" applied")
+	}
+
+	log.Println("= Revert last migration")
+	reverted, err := MigrateDown(dbmap, 1)
+	assert.Nil(t, err, "down")
+	assert.Equal(t, []string{last}, reverted, "last reverted")
+	n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM pragma_table_info('Webhook') WHERE name='tenant'")
+	assert.Equal(t, int64(0), n, "column dropped")
+	status, _ = MigrationStatus(dbmap)
+	assert.True(t, status[len(status)-1].Applied.IsZero(), "pending again")
+	pending, _ := PendingMigrations(dbmap)
+	assert.Equal(t, []string{last}, pending, "pending")
+
+	log.Println("= Apply again")
+	assert.Nil(t, Migrate(dbmap), "up")
+	n, _ = dbmap.SelectInt("SELECT COUNT(*) FROM pragma_table_info('Webhook') WHERE name='tenant'")
+	assert.Equal(t, int64(1), n, "column added")
+
+	log.Println("= Migration without Down")
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(migrations, Migration{Id: "9999_test"})
+	Migrate(dbmap)
+	reverted, err = MigrateDown(dbmap, 2)
+	assert.NotNil(t, err, "no Down")
+	assert.Empty(t, reverted, "nothing reverted")
+	pending, _ = PendingMigrations(dbmap)
+	assert.Empty(t, pending, "still applied")
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// PostAgentHeartbeat record last seen time and source IP of an agent,
+// a new or offline agent comes back online unless a guard refuses it,
+// other states are kept
+func PostAgentHeartbeat(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var agent Agent
+	err := dbmap.SelectOne(&agent, "SELECT * FROM agent WHERE "+tenantScope(c, "agent", "id=?"), id)
+	if err != nil {
+		renderError(c, 404, "agent not found")
+		return
+	}
+
+	previous := agent
+	agent.LastSeen = time.Now()
+	agent.LastIP = c.ClientIP()
+	if agent.Status == "" || agent.Status == AgentNew || agent.Status == AgentOffline {
+		agent.Status = AgentOnline
+		if err := checkStatus(&agent, previous); err != nil {
+			logger(c).Debug("agent kept in its status", "id", agent.Id, "error", err)
+			agent.Status = previous.Status
+		} else {
+			c.Set("Reason", "heartbeat")
+		}
+	}
+
+	start := time.Now()
+	_, err = dbmap.Update(&agent)
+	trace(c, "UPDATE agent heartbeat id="+id, start, err)
+	if err != nil {
+		renderUnavailable(c, "heartbeat failed", err)
+		return
+	}
+	invalidate(c, "agent")
+	// only status changes are published, heartbeats would flood webhooks and streams
+	if agent.Status != previous.Status {
+		notify(c, "agent", "updated", agent, previous)
+	}
+	render(c, 200, agent)
+
+	// curl -i -X POST http://localhost:8080/api/v1/agents/1/heartbeat
+}
+
+// Sweeper set online agents offline after Silence without heartbeat
+type Sweeper struct {
+	Silence  time.Duration
+	Interval time.Duration // between sweeps
+	Bus      *Bus          // optional, to publish status changes
+	Webhooks *Dispatcher
+	Cache    *ResponseCache
+	Logger   *slog.Logger
+	dbmap    *gorp.DbMap
+	gate     sync.RWMutex // read by sweeps, written by pause
+}
+
+// NewSweeper create a sweeper of dbmap agents, checked every silence/2
+func NewSweeper(dbmap *gorp.DbMap, silence time.Duration) *Sweeper {
+	return &Sweeper{Silence: silence, Interval: silence / 2, dbmap: dbmap}
+}
+
+// Run sweep agents until ctx is done, start it with go s.Run(ctx)
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sweep set silent agents offline once, return how many changed
+func (s *Sweeper) Sweep() (int, error) {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	l := s.logger()
+	var agents []Agent
+	start := time.Now()
+	_, err := s.dbmap.Select(&agents, "SELECT * FROM agent WHERE status=?", AgentOnline)
+	logQuery(l, "SELECT online agents", start, err)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, a := range agents {
+		if !s.silent(a) {
+			continue
+		}
+		changed, err := s.setOffline(l, a.Id)
+		if err != nil {
+			l.Warn("sweep agent failed", "id", a.Id, "error", err)
+			continue
+		}
+		if changed {
+			n++
+		}
+	}
+	if n > 0 {
+		if s.Cache != nil {
+			s.Cache.invalidate(s.dbmap, "agent")
+		}
+		l.Info("agents offline", "count", n)
+	}
+	return n, nil
+}
+
+// pause wait for a running sweep and hold next ones, like during a
+// restore, call returned func to resume
+func (s *Sweeper) pause() func() {
+	s.gate.Lock()
+	return s.gate.Unlock
+}
+
+// setOffline re-read agent in a transaction, a heartbeat may have come since Select
+func (s *Sweeper) setOffline(l *slog.Logger, id int64) (bool, error) {
+	tx, err := s.dbmap.Begin()
+	if err != nil {
+		return false, err
+	}
+	var agent Agent
+	if err = tx.SelectOne(&agent, "SELECT * FROM agent WHERE id=?", id); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if agent.Status != AgentOnline || !s.silent(agent) {
+		return false, tx.Rollback()
+	}
+
+	previous := agent
+	agent.Status = AgentOffline
+	if err = checkStatus(&agent, previous); err != nil { // a guard may keep it online
+		tx.Rollback()
+		return false, err
+	}
+	start := time.Now()
+	_, err = tx.Update(&agent)
+	logQuery(l, "UPDATE agent offline", start, err)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	recordTransition(s.dbmap, l, StatusTransition{Reason: "no heartbeat"}, "agent", agent, previous)
+	publish(s.Bus, s.Webhooks, l, s.dbmap, nil, newEvent("agent", "updated", agent, previous))
+	return true, nil
+}
+
+func (s *Sweeper) silent(a Agent) bool {
+	last := a.LastSeen
+	if last.IsZero() { // never sent a heartbeat
+		last = a.Created
+	}
+	return time.Since(last) > s.Silence
+}
+
+func (s *Sweeper) logger() *slog.Logger {
+	l := slog.Default()
+	if s.Logger != nil {
+		l = s.Logger
+	}
+	return l.With("component", "sweeper")
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	bus := NewBus(100)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(bus.Middleware())
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla+"/:id", GetAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+	router.POST(urla+"/:id/heartbeat", PostAgentHeartbeat)
+
+	do := func(method string, path string, body interface{}) (*httptest.ResponseRecorder, Agent) {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.10:4242"
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var a Agent
+		json.Unmarshal(resp.Body.Bytes(), &a)
+		return resp, a
+	}
+
+	do("POST", urla, Agent{Name: "web1", IP: "10.0.0.1"})
+	do("POST", urla, Agent{Name: "db1", IP: "10.0.0.1", Status: "maintenance"})
+	events, _ := bus.Subscribe(0, 10)
+	defer bus.Unsubscribe(events)
+
+	// Heartbeat
+	log.Println("= Heartbeat sets agent online")
+	resp, a := do("POST", urla+"/1/heartbeat", nil)
+	assert.Equal(t, 200, resp.Code, "http POST heartbeat")
+	assert.Equal(t, AgentOnline, a.Status, "online")
+	assert.Equal(t, "192.0.2.10", a.LastIP, "source ip")
+	assert.WithinDuration(t, time.Now(), a.LastSeen, time.Second, "last seen")
+	e := <-events
+	assert.Equal(t, "agent.updated", e.Event, "status change published")
+	e = <-events
+	assert.Equal(t, "agent.status", e.Event, "status event")
+
+	log.Println("= Heartbeat of an online agent is not published")
+	resp, _ = do("POST", urla+"/1/heartbeat", nil)
+	assert.Equal(t, 200, resp.Code, "http POST heartbeat")
+	assert.Equal(t, 0, len(events), "no event")
+
+	log.Println("= Heartbeat keeps custom status")
+	_, a = do("POST", urla+"/2/heartbeat", nil)
+	assert.Equal(t, "maintenance", a.Status, "status untouched")
+
+	resp, _ = do("POST", urla+"/9/heartbeat", nil)
+	assert.Equal(t, 404, resp.Code, "http POST heartbeat of missing agent")
+
+	log.Println("= Update keeps heartbeat fields")
+	_, a = do("PUT", urla+"/1", Agent{Name: "web1", IP: "10.0.0.1", Status: AgentOnline})
+	assert.Equal(t, "192.0.2.10", a.LastIP, "last ip kept")
+	assert.False(t, a.LastSeen.IsZero(), "last seen kept")
+	e = <-events
+	assert.Equal(t, "agent.updated", e.Event, "update published")
+
+	// Sweeper
+	log.Println("= Sweeper sets silent agents offline")
+	sweeper := NewSweeper(dbmap, time.Hour)
+	sweeper.Bus = bus
+	n, err := sweeper.Sweep()
+	assert.Nil(t, err, "sweep")
+	assert.Equal(t, 0, n, "agent not silent yet")
+
+	sweeper.Silence = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	n, err = sweeper.Sweep()
+	assert.Nil(t, err, "sweep")
+	assert.Equal(t, 1, n, "one online agent swept")
+	_, a = do("GET", urla+"/1", nil)
+	assert.Equal(t, AgentOffline, a.Status, "offline")
+	e = <-events
+	assert.Equal(t, "agent.updated", e.Event, "sweep published")
+	e = <-events
+	assert.Equal(t, "agent.status", e.Event, "sweep status event")
+	reason, _ := dbmap.SelectStr("SELECT reason FROM statustransition WHERE recordid=1 AND tostatus=? ORDER BY id DESC", AgentOffline)
+	assert.Equal(t, "no heartbeat", reason, "sweep transition")
+	_, a = do("GET", urla+"/2", nil)
+	assert.Equal(t, "maintenance", a.Status, "custom status not swept")
+
+	log.Println("= Next heartbeat sets agent back online")
+	_, a = do("POST", urla+"/1/heartbeat", nil)
+	assert.Equal(t, AgentOnline, a.Status, "online again")
+
+	log.Println("= Sweeper follows guards")
+	AgentStates.Guards = map[string]Guard{
+		AgentOffline: func(record interface{}, from string) error { return errors.New("kept online") },
+	}
+	time.Sleep(20 * time.Millisecond)
+	n, _ = sweeper.Sweep()
+	AgentStates.Guards = nil
+	assert.Equal(t, 0, n, "sweep refused by guard")
+	_, a = do("GET", urla+"/1", nil)
+	assert.Equal(t, AgentOnline, a.Status, "still online")
+
+	log.Println("= Sweeper runs until cancelled")
+	sweeper.Interval = 5 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sweeper.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	_, a = do("GET", urla+"/1", nil)
+	assert.Equal(t, AgentOffline, a.Status, "offline by background sweep")
+
+	log.Println("= Failed write answers 503")
+	dbmap.Exec("CREATE TRIGGER readonly BEFORE UPDATE ON agent BEGIN SELECT RAISE(ABORT, 'read only'); END")
+	resp, _ = do("POST", urla+"/1/heartbeat", nil)
+	assert.Equal(t, 503, resp.Code, "http POST heartbeat failed")
+	dbmap.Exec("DROP TRIGGER readonly")
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// normalizeIP validate an IPv4 or IPv6 address and return its canonical
+// form: 10.0.0.1, 2001:db8::1, IPv4-mapped IPv6 as IPv4
+func normalizeIP(s string) (string, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return "", errors.New("invalid ip address " + s)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// ipKey sortable form of an address: 32 hex digits, IPv4 as ::ffff:a.b.c.d,
+// empty for invalid addresses
+func ipKey(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return ""
+	}
+	b := addr.As16()
+	return hex.EncodeToString(b[:])
+}
+
+// ipRange first and last keys of a cidr, like 10.2.0.0/16 or 2001:db8::/32
+func ipRange(cidr string) (string, string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return "", "", errors.New("invalid cidr " + cidr)
+	}
+	p = p.Masked()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	first := p.Addr().As16()
+	last := first
+	for i := bits; i < 128; i++ {
+		last[i/8] |= 1 << (7 - uint(i%8))
+	}
+	return hex.EncodeToString(first[:]), hex.EncodeToString(last[:]), nil
+}
+
+// ipOperators address operators of _filters by column, like
+// {"ip":{"cidr":"10.2.0.0/16"}} or {"ip":{"from":"10.0.0.1","to":"10.0.0.99"}}
+func ipOperators(q map[string][]string) map[string]map[string]string {
+	operators := make(map[string]map[string]string)
+	if q["_filters"] == nil {
+		return operators
+	}
+	data := make(map[string]json.RawMessage)
+	if json.Unmarshal([]byte(q["_filters"][0]), &data) != nil {
+		return operators
+	}
+	valid := regexp.MustCompile("^[A-Za-z0-9_]+$")
+	for col, raw := range data {
+		var ops map[string]string
+		if valid.MatchString(col) && json.Unmarshal(raw, &ops) == nil {
+			operators[col] = ops
+		}
+	}
+	return operators
+}
+
+// ipBounds first and last keys of addresses matched by operators,
+// false for an invalid cidr or address
+func ipBounds(ops map[string]string) (string, string, bool) {
+	first, last := strings.Repeat("0", 32), strings.Repeat("f", 32)
+	if cidr, ok := ops["cidr"]; ok {
+		var err error
+		if first, last, err = ipRange(cidr); err != nil {
+			return "", "", false
+		}
+	}
+	if v, ok := ops["from"]; ok {
+		ip, err := normalizeIP(v)
+		if err != nil {
+			return "", "", false
+		}
+		if k := ipKey(ip); k > first {
+			first = k
+		}
+	}
+	if v, ok := ops["to"]; ok {
+		ip, err := normalizeIP(v)
+		if err != nil {
+			return "", "", false
+		}
+		if k := ipKey(ip); k < last {
+			last = k
+		}
+	}
+	return first, last, true
+}
+
+// ipFilters SQL conditions of _filters address operators on a column
+// with a sortable twin <column>key, like ip and ipkey, see ipOperators
+func ipFilters(q map[string][]string) []string {
+	var conditions []string
+	for col, ops := range ipOperators(q) {
+		first, last, ok := ipBounds(ops)
+		if !ok {
+			conditions = append(conditions, "0") // no match for invalid operands
+			continue
+		}
+		conditions = append(conditions, col+"key BETWEEN '"+first+"' AND '"+last+"'")
+	}
+	return conditions
+}
+
+// ipColumn return true if table has column col and its sortable twin colkey
+func ipColumn(table string, col string) bool {
+	m, ok := ModelFor(table)
+	if !ok {
+		return false
+	}
+	found := 0
+	for i := 0; i < m.Type.NumField(); i++ {
+		name := strings.TrimSpace(strings.Split(m.Type.Field(i).Tag.Get("db"), ",")[0])
+		if name == col || name == col+"key" {
+			found++
+		}
+	}
+	return found == 2
+}
+
+// checkFilters return an error for _filters address operators on a column
+// of table without sortable twin, or for unknown operators, handlers
+// answer 400 instead of an SQL error
+func checkFilters(table string, q map[string][]string) error {
+	for col, ops := range ipOperators(jsonapiQuery(restQuery(q))) {
+		if !ipColumn(table, col) {
+			return errors.New("no address operators on " + col)
+		}
+		for op := range ops {
+			if op != "cidr" && op != "from" && op != "to" {
+				return errors.New("unknown operator " + op + ", use cidr, from or to")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIPRange(t *testing.T) {
+	first, last, err := ipRange("10.2.3.4/16")
+	assert.Nil(t, err, "valid cidr")
+	assert.Equal(t, ipKey("10.2.0.0"), first, "first address")
+	assert.Equal(t, ipKey("10.2.255.255"), last, "last address")
+
+	first, last, _ = ipRange("2001:db8::/32")
+	assert.Equal(t, ipKey("2001:db8::"), first, "first ipv6 address")
+	assert.Equal(t, ipKey("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), last, "last ipv6 address")
+
+	_, _, err = ipRange("10.2.0.0/33")
+	assert.NotNil(t, err, "invalid cidr")
+
+	ip, _ := normalizeIP(" ::ffff:10.0.0.1 ")
+	assert.Equal(t, "10.0.0.1", ip, "ipv4 mapped")
+	ip, _ = normalizeIP("2001:DB8:0:0::1")
+	assert.Equal(t, "2001:db8::1", ip, "ipv6 canonical")
+	assert.True(t, ipKey("10.0.0.9") < ipKey("10.0.0.10"), "numeric order")
+}
+
+func TestIPFilters(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla, GetAgents)
+
+	post := func(a Agent) (*httptest.ResponseRecorder, Agent) {
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(a)
+		req, _ := http.NewRequest("POST", urla, b)
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var res Agent
+		json.Unmarshal(resp.Body.Bytes(), &res)
+		return resp, res
+	}
+	list := func(query string) []string {
+		req, _ := http.NewRequest("GET", urla+"?"+query, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var agents []Agent
+		json.Unmarshal(resp.Body.Bytes(), &agents)
+		ips := []string{}
+		for _, a := range agents {
+			ips = append(ips, a.IP)
+		}
+		return ips
+	}
+	filters := func(f string) string {
+		return "_filters=" + url.QueryEscape(f)
+	}
+
+	// Validation
+	log.Println("= Addresses validated and normalized")
+	for _, ip := range []string{"10.2.0.10", "10.2.0.9", "10.3.0.1", "::ffff:10.2.1.1", "2001:DB8::1"} {
+		resp, _ := post(Agent{Name: "agent " + ip, IP: ip})
+		assert.Equal(t, 201, resp.Code, "http POST "+ip)
+	}
+	resp, a := post(Agent{Name: "bad", IP: "10.2.0.300"})
+	assert.Equal(t, 400, resp.Code, "http POST invalid ip")
+	_, a = post(Agent{Name: "v6", IP: "2001:0db8:0000::2"})
+	assert.Equal(t, "2001:db8::2", a.IP, "normalized")
+
+	// Filters
+	log.Println("= cidr and range filters")
+	assert.Equal(t, []string{"10.2.0.9", "10.2.0.10", "10.2.1.1"},
+		list(filters(`{"ip":{"cidr":"10.2.0.0/16"}}`)+"&_sortField=ip&_sortDir=ASC"), "cidr, numeric sort")
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"},
+		list(filters(`{"ip":{"cidr":"2001:db8::/32"}}`)+"&_sortField=ip&_sortDir=ASC"), "ipv6 cidr")
+	assert.Equal(t, []string{"10.2.1.1", "10.2.0.10"},
+		list(filters(`{"ip":{"from":"10.2.0.10","to":"10.3.0.0"}}`)+"&_sortField=ip&_sortDir=DESC"), "range")
+	assert.Equal(t, []string{"10.3.0.1"},
+		list(filters(`{"ip":{"cidr":"10.0.0.0/8"},"name":"10.3"}`)), "cidr with LIKE filter")
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"},
+		list(filters(`{"ip":"2001:db8:"}`)+"&_sortField=ip&_sortDir=ASC"), "LIKE on ipv6 prefix")
+	assert.Equal(t, []string{}, list(filters(`{"ip":{"cidr":"bad"}}`)), "invalid cidr matches nothing")
+
+	log.Println("= operators on other columns")
+	for _, f := range []string{`{"name":{"cidr":"10.0.0.0/8"}}`, `{"ip":{"mask":"10.0.0.0/8"}}`} {
+		req, _ := http.NewRequest("GET", urla+"?"+filters(f), nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 400, resp.Code, "http GET "+f)
+	}
+	query, _, _ := ParseQuery(map[string][]string{"_filters": {`{"name:x":"web"}`}})
+	assert.Equal(t, "", query, "no ':' in columns")
+}
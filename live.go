@@ -0,0 +1,182 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+// websocket limits, XXX fix for your clients
+var (
+	liveQueue   = 256 // events and replies waiting for a slow client
+	liveSubs    = 32  // subscriptions per connection
+	pongWait    = 60 * time.Second
+	pingPeriod  = 50 * time.Second
+	writeWait   = 10 * time.Second
+	maxLiveRead = int64(4096)
+)
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// LiveMessage json frame of the websocket endpoint
+//
+//	client: {"type":"subscribe","id":"s1","resource":"agent","filters":{"status":"offline","ip":{"cidr":"10.0.0.0/8"}}}
+//	        {"type":"unsubscribe","id":"s1"}
+//	server: {"type":"subscribed","id":"s1"}, {"type":"unsubscribed","id":"s1"},
+//	        {"type":"event","id":"s1","event":{...}}, {"type":"error","id":"s1","error":"..."}
+type LiveMessage struct {
+	Type     string                 `json:"type"`
+	Id       string                 `json:"id,omitempty"`
+	Resource string                 `json:"resource,omitempty"`
+	Filters  map[string]interface{} `json:"filters,omitempty"`
+	Event    *Event                 `json:"event,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+type liveSub struct {
+	resource string
+	filters  recordFilter
+}
+
+// Live websocket endpoint for subscriptions to record changes of several
+// resources, with _filters semantic of lists: one created, updated or
+// deleted event per write, status changes come as updated
+func Live(c *gin.Context) {
+	bus := c.MustGet("Bus").(*Bus)
+	l := logger(c)
+	tenant := tenantOf(c)
+	defer unquiesce(c)()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		l.Warn("websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	events, _ := bus.Subscribe(0, liveQueue)
+	defer bus.Unsubscribe(events)
+
+	var mu sync.Mutex
+	subs := make(map[string]liveSub)
+	out := make(chan LiveMessage, liveQueue)
+	done := make(chan struct{})
+	defer close(done)
+
+	// writer: only goroutine writing frames
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		defer conn.Close() // unblock reader
+
+		write := func(m LiveMessage) bool {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			return conn.WriteJSON(m) == nil
+		}
+		for {
+			select {
+			case m := <-out:
+				if !write(m) {
+					return
+				}
+			case e, ok := <-events:
+				if !ok { // bus dropped a too slow client
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"),
+						time.Now().Add(writeWait))
+					return
+				}
+				mu.Lock()
+				var matched []LiveMessage
+				for id, s := range subs {
+					if e.Change() && e.Visible(tenant) && e.matches(s.resource, s.filters) {
+						ev := e
+						matched = append(matched, LiveMessage{Type: "event", Id: id, Event: &ev})
+					}
+				}
+				mu.Unlock()
+				for _, m := range matched {
+					if !write(m) {
+						return
+					}
+				}
+			case <-ticker.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	reply := func(m LiveMessage) bool {
+		select {
+		case out <- m:
+			return true
+		default:
+			return false
+		}
+	}
+
+	conn.SetReadLimit(maxLiveRead)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var m LiveMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			if !reply(LiveMessage{Type: "error", Error: "invalid message"}) {
+				return
+			}
+			continue
+		}
+
+		r := LiveMessage{Type: "error", Id: m.Id}
+		mu.Lock()
+		switch {
+		case m.Id == "":
+			r.Error = "missing id"
+		case m.Type == "subscribe" && m.Resource == "":
+			r.Error = "missing resource"
+		case m.Type == "subscribe" && len(subs) >= liveSubs && subs[m.Id].resource == "":
+			r.Error = "too many subscriptions"
+		case m.Type == "subscribe":
+			f, _ := json.Marshal(m.Filters)
+			q := map[string][]string{"_filters": {string(f)}}
+			if err := keyAllows(c, m.Resource, "read"); err != nil {
+				r.Error = err.Error()
+				break
+			}
+			if err := checkFilters(m.Resource, q); err != nil {
+				r.Error = err.Error()
+				break
+			}
+			resource := m.Resource
+			if model, ok := ModelFor(m.Resource); ok { // agents or agent, as events name it
+				resource = model.Resource()
+			}
+			subs[m.Id] = liveSub{resource, newRecordFilter(q)}
+			r.Type = "subscribed"
+		case m.Type == "unsubscribe":
+			delete(subs, m.Id)
+			r.Type = "unsubscribed"
+		default:
+			r.Error = "unknown type"
+		}
+		mu.Unlock()
+		if !reply(r) {
+			return
+		}
+	}
+
+	// wscat -c ws://localhost:8080/api/v1/live
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLive(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+	router.Use(NewBus(100).Middleware())
+	router.GET("/live", Live)
+	router.POST("/agents", PostAgent)
+	router.POST("/users", PostUser)
+	router.PUT("/agents/:id", UpdateAgent)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func(path string, v interface{}) {
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(v)
+		resp, err := http.Post(server.URL+path, "application/json", b)
+		assert.Nil(t, err, "http POST")
+		assert.Equal(t, 201, resp.StatusCode, "http POST success")
+		resp.Body.Close()
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/live", nil)
+	assert.Nil(t, err, "websocket dial")
+	defer conn.Close()
+	read := func() LiveMessage {
+		var m LiveMessage
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		err := conn.ReadJSON(&m)
+		assert.Nil(t, err, "read frame")
+		return m
+	}
+
+	log.Println("= Subscribe to agents with filter")
+	conn.WriteJSON(LiveMessage{Type: "subscribe", Id: "s1", Resource: "agent", Filters: map[string]interface{}{"name": "web"}})
+	m := read()
+	assert.Equal(t, "subscribed", m.Type, "subscribed")
+	assert.Equal(t, "s1", m.Id, "subscription id")
+
+	post("/agents", Agent{Name: "db1", IP: "10.0.0.1"})
+	post("/agents", Agent{Name: "web1", IP: "10.0.0.1"})
+	m = read()
+	assert.Equal(t, "event", m.Type, "event frame")
+	assert.Equal(t, "s1", m.Id, "subscription id")
+	if m.Event != nil {
+		assert.Equal(t, "agent.created", m.Event.Event, "created")
+		assert.Equal(t, "web1", m.Event.Data.(map[string]interface{})["name"], "filtered record")
+	}
+
+	log.Println("= Second subscription by plural name, unsubscribe first")
+	conn.WriteJSON(LiveMessage{Type: "subscribe", Id: "s2", Resource: "users"})
+	assert.Equal(t, "subscribed", read().Type, "subscribed s2")
+	conn.WriteJSON(LiveMessage{Type: "unsubscribe", Id: "s1"})
+	assert.Equal(t, "unsubscribed", read().Type, "unsubscribed s1")
+
+	post("/agents", Agent{Name: "web2", IP: "10.0.0.1"})
+	post("/users", User{Name: "Thea"})
+	m = read()
+	assert.Equal(t, "s2", m.Id, "only s2 events")
+	if m.Event != nil {
+		assert.Equal(t, "user.created", m.Event.Event, "user created")
+	}
+
+	log.Println("= One event for a status change")
+	conn.WriteJSON(LiveMessage{Type: "subscribe", Id: "s4", Resource: "agent", Filters: map[string]interface{}{"name": "db1"}})
+	assert.Equal(t, "subscribed", read().Type, "subscribed s4")
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(Agent{Name: "db1", IP: "10.0.0.1", Status: AgentOnline})
+	req, _ := http.NewRequest("PUT", server.URL+"/agents/1", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, "http PUT")
+	resp.Body.Close()
+	post("/users", User{Name: "Leo"})
+	m = read()
+	if assert.Equal(t, "s4", m.Id, "agent event") && m.Event != nil {
+		assert.Equal(t, "agent.updated", m.Event.Event, "status change as updated")
+	}
+	m = read()
+	if assert.Equal(t, "s2", m.Id, "no agent.status frame") && m.Event != nil {
+		assert.Equal(t, "user.created", m.Event.Event, "next event")
+	}
+
+	log.Println("= Invalid messages")
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	m = read()
+	assert.Equal(t, "error", m.Type, "error frame")
+	conn.WriteJSON(LiveMessage{Type: "subscribe", Id: "s3"})
+	m = read()
+	assert.Equal(t, "missing resource", m.Error, "missing resource")
+
+	log.Println("= Ping pong")
+	pong := make(chan bool, 1)
+	conn.SetPongHandler(func(string) error { pong <- true; return nil })
+	conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	go conn.ReadMessage() // process control frames
+	select {
+	case <-pong:
+	case <-time.After(2 * time.Second):
+		t.Error("no pong")
+	}
+}
+
+func TestBusSlowSubscriber(t *testing.T) {
+	bus := NewBus(10)
+	ch, _ := bus.Subscribe(0, 1)
+	bus.Publish(Event{Event: "agent.created"})
+	bus.Publish(Event{Event: "agent.updated"})
+	e, ok := <-ch
+	assert.True(t, ok, "first event queued")
+	assert.Equal(t, uint64(1), e.Id, "first event")
+	_, ok = <-ch
+	assert.False(t, ok, "slow subscriber dropped")
+	bus.Unsubscribe(ch) // no double close
+
+	_, missed := bus.Subscribe(1, 1)
+	assert.Equal(t, 1, len(missed), "buffered event after 1")
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Logger gin Middleware to set a request scoped structured logger
+func Logger(l *slog.Logger) gin.HandlerFunc {
+	if l == nil {
+		l = slog.Default()
+	}
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-Id")
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Header("X-Request-Id", id)
+		c.Set("Logger", l.With("request_id", id, "route", c.FullPath()))
+
+		start := time.Now()
+		c.Next()
+
+		logger(c).Info("request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start))
+	}
+}
+
+// logger return the request logger, with the authenticated user if any
+func logger(c *gin.Context) *slog.Logger {
+	l := slog.Default()
+	if v, ok := c.Get("Logger"); ok {
+		l = v.(*slog.Logger)
+	}
+	if user := c.GetString("User"); user != "" {
+		l = l.With("user", user)
+	}
+	if tenant := c.GetString("Tenant"); tenant != "" {
+		l = l.With("tenant", tenant)
+	}
+	return l
+}
+
+// trace log a SQL query and its duration at debug level
+func trace(c *gin.Context, query string, start time.Time, err error) {
+	if v, ok := c.Get("Metrics"); ok {
+		v.(*Metrics).observe(c, query, time.Since(start), err)
+	}
+	logQuery(logger(c), query, start, err)
+}
+
+// logQuery log a SQL query out of requests, like trace
+func logQuery(l *slog.Logger, query string, start time.Time, err error) {
+	args := []interface{}{"query", query, "duration", time.Since(start)}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	l.Debug("sql", args...)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Redact wrap a struct to log it without fields tagged `log:"redact"`
+func Redact(v interface{}) slog.LogValuer {
+	return redacted{v}
+}
+
+type redacted struct {
+	v interface{}
+}
+
+// LogValue log struct fields by json name, sensitive ones replaced
+func (r redacted) LogValue() slog.Value {
+	rv := reflect.ValueOf(r.v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return slog.AnyValue(r.v)
+	}
+
+	rt := rv.Type()
+	var attrs []slog.Attr
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if secret(f) {
+			attrs = append(attrs, slog.String(name, "[REDACTED]"))
+			continue
+		}
+		attrs = append(attrs, slog.Any(name, rv.Field(i).Interface()))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// withoutSecrets return struct as a json map without fields tagged `log:"redact"`
+func withoutSecrets(v interface{}) map[string]interface{} {
+	b, _ := json.Marshal(v)
+	m := make(map[string]interface{})
+	json.Unmarshal(b, &m)
+
+	rt := reflect.TypeOf(v)
+	for rt != nil && rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt == nil || rt.Kind() != reflect.Struct {
+		return m
+	}
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if secret(f) {
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+			delete(m, name)
+		}
+	}
+	return m
+}
+
+// secret return true for a field tagged `log:"redact"`, never sent to clients
+func secret(f reflect.StructField) bool {
+	return f.Tag.Get("log") == "redact"
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Logger(l))
+	router.GET("/users/:id", func(c *gin.Context) {
+		c.Set("User", "admin")
+		logger(c).Debug("post user", "user", Redact(User{Name: "Thea", Pass: "secret"}))
+		c.JSON(200, gin.H{})
+	})
+
+	log.Println("= Request id and scoped fields")
+	req, _ := http.NewRequest("GET", "/users/1", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET success")
+	assert.NotEmpty(t, resp.Header().Get("X-Request-Id"), "request id set")
+	assert.Contains(t, out.String(), `"request_id":"`+resp.Header().Get("X-Request-Id")+`"`, "request id logged")
+	assert.Contains(t, out.String(), `"route":"/users/:id"`, "route logged")
+	assert.Contains(t, out.String(), `"user":"admin"`, "user logged")
+
+	log.Println("= Sensitive fields redacted")
+	assert.Contains(t, out.String(), `"name":"Thea"`, "name logged")
+	assert.NotContains(t, out.String(), "secret", "pass not logged")
+	assert.Contains(t, out.String(), `"pass":"[REDACTED]"`, "pass redacted")
+
+	log.Println("= Request id forwarded")
+	out.Reset()
+	req, _ = http.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, "abc123", resp.Header().Get("X-Request-Id"), "request id kept")
+	assert.Contains(t, out.String(), `"request_id":"abc123"`, "request id logged")
+}
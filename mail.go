@@ -0,0 +1,132 @@
+package models
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Mailer send one text mail, SMTPMailer or MemoryMailer
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// SetMailer gin Middlware to set mailer for account handlers, and the
+// base URL of mail links: account routes like https://api.example.org/api/v1/account
+// or a frontend page like https://app.example.org/#/account. Links are never
+// built from request headers, a client could set Host to its own server.
+func SetMailer(m Mailer, accountURL string) gin.HandlerFunc {
+	u, err := url.Parse(accountURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		panic("SetMailer: invalid account url " + strconv.Quote(accountURL))
+	}
+	accountURL = strings.TrimSuffix(accountURL, "/")
+	return func(c *gin.Context) {
+		c.Set("Mailer", m)
+		c.Set("AccountURL", accountURL)
+		c.Next()
+	}
+}
+
+// SMTPMailer send mails through a SMTP relay
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth // optional
+}
+
+// NewSMTPMailer create a mailer for relay addr, with PLAIN auth when user is set
+func NewSMTPMailer(addr string, from string, user string, pass string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", user, pass, host)
+	}
+	return m
+}
+
+// Send a text mail
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// Mail sent by MemoryMailer
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer keep mails in memory, for tests and development
+type MemoryMailer struct {
+	mu    sync.Mutex
+	Mails []Mail
+}
+
+// Send store a mail
+func (m *MemoryMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Mails = append(m.Mails, Mail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// Last return last mail sent to address
+func (m *MemoryMailer) Last(to string) (Mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.Mails) - 1; i >= 0; i-- {
+		if m.Mails[i].To == to {
+			return m.Mails[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+// MailTemplates subject and body of account mails, XXX custom texts.
+// Templates get .User, .Link and .Expires
+var MailTemplates = template.Must(template.New("mail").Parse(`
+{{define "verify.subject"}}Verify your email address{{end}}
+{{define "verify.body"}}Hello {{.User.Name}},
+
+Confirm your email address by following this link:
+
+  {{.Link}}
+
+The link expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.
+{{end}}
+{{define "reset.subject"}}Reset your password{{end}}
+{{define "reset.body"}}Hello {{.User.Name}},
+
+Choose a new password by following this link:
+
+  {{.Link}}
+
+The link expires on {{.Expires.Format "2006-01-02 15:04 MST"}}. Ignore this mail if you
+did not ask for a new password.
+{{end}}
+`))
+
+// renderMail execute subject and body templates of a mail kind
+func renderMail(kind string, data interface{}) (string, string, error) {
+	var subject, body bytes.Buffer
+	if err := MailTemplates.ExecuteTemplate(&subject, kind+".subject", data); err != nil {
+		return "", "", err
+	}
+	if err := MailTemplates.ExecuteTemplate(&body, kind+".body", data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/gorp.v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics prometheus collectors for REST handlers and database calls
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	queries  *prometheus.HistogramVec
+	failures *prometheus.CounterVec
+	rows     *prometheus.HistogramVec
+}
+
+// NewMetrics create metrics with their own registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by resource, verb and status code.",
+		}, []string{"resource", "verb", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by resource and verb.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"resource", "verb"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "gorp query duration by resource and operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"resource", "operation"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_query_errors_total",
+			Help: "Failed gorp queries by resource and operation.",
+		}, []string{"resource", "operation"}),
+		rows: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_rows_returned",
+			Help:    "Rows returned by list queries by resource.",
+			Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}, []string{"resource"}),
+	}
+	m.registry.MustRegister(m.requests, m.latency, m.queries, m.failures, m.rows)
+	m.registry.MustRegister(collectors.NewGoCollector())
+	return m
+}
+
+// WatchDb export sql.DB pool stats of a DbMap
+func (m *Metrics) WatchDb(dbmap *gorp.DbMap, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(dbmap.Db, name))
+}
+
+// Middleware gin Middlware to count requests and set metrics for handlers
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("Metrics", m)
+		start := time.Now()
+		c.Next()
+
+		r := resource(c)
+		m.requests.WithLabelValues(r, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		m.latency.WithLabelValues(r, c.Request.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Export serve metrics in prometheus text format
+func (m *Metrics) Export(c *gin.Context) {
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+
+	// curl -i http://localhost:8080/metrics
+}
+
+// observe record a query duration, called by trace
+func (m *Metrics) observe(c *gin.Context, query string, d time.Duration, err error) {
+	r := resource(c)
+	op := strings.ToUpper(strings.SplitN(query, " ", 2)[0])
+	m.queries.WithLabelValues(r, op).Observe(d.Seconds())
+	if err != nil {
+		m.failures.WithLabelValues(r, op).Inc()
+	}
+}
+
+// countRows record rows returned by a list handler
+func countRows(c *gin.Context, n int) {
+	if v, ok := c.Get("Metrics"); ok {
+		v.(*Metrics).rows.WithLabelValues(resource(c)).Observe(float64(n))
+	}
+}
+
+// resource name from route path: /api/v1/agents/:id -> agents
+func resource(c *gin.Context) string {
+	parts := strings.Split(c.FullPath(), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] != "" && !strings.HasPrefix(parts[i], ":") && !strings.HasPrefix(parts[i], "*") {
+			return parts[i]
+		}
+	}
+	return "none"
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	metrics := NewMetrics()
+	metrics.WatchDb(dbmap, "test")
+
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(metrics.Middleware())
+	router.Use(DatabaseMap(dbmap))
+	router.GET("/metrics", metrics.Export)
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla, GetAgents)
+
+	log.Println("= Record requests and queries")
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(Agent{Name: "Name test", IP: "10.0.0.1"})
+	req, _ := http.NewRequest("POST", urla, b)
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST success")
+
+	req, _ = http.NewRequest("GET", urla, nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET all success")
+
+	log.Println("= http GET metrics")
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET metrics success")
+	body := resp.Body.String()
+	assert.Contains(t, body, `http_requests_total{code="201",resource="agents",verb="POST"} 1`, "request count")
+	assert.Contains(t, body, `http_request_duration_seconds_count{resource="agents",verb="GET"} 1`, "request latency")
+	assert.Contains(t, body, `db_query_duration_seconds_count{operation="INSERT",resource="agents"} 1`, "insert duration")
+	assert.Contains(t, body, `db_query_duration_seconds_count{operation="SELECT",resource="agents"} 3`, "count, last update and list durations")
+	assert.Contains(t, body, `db_rows_returned_sum{resource="agents"} 1`, "rows returned")
+	assert.Contains(t, body, `go_sql_open_connections{db_name="test"}`, "pool stats")
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"fmt"
+	"gopkg.in/gorp.v2"
+	"time"
+)
+
+// Migration schema change applied once and recorded into Migration table
+type Migration struct {
+	Id   string
+	Up   func(s gorp.SqlExecutor) error
+	Down func(s gorp.SqlExecutor) error
+}
+
+// XXX append schema changes, never reorder or edit applied ones
+var migrations = []Migration{
+	{
+		Id: "0001_agent_owner",
+		Up: func(s gorp.SqlExecutor) error {
+			return addColumn(s, "Agent", "owner", "integer not null default 0")
+		},
+		Down: func(s gorp.SqlExecutor) error {
+			_, err := s.Exec("ALTER TABLE Agent DROP COLUMN owner")
+			return err
+		},
+	},
+	{
+		Id: "0002_agent_heartbeat",
+		Up: func(s gorp.SqlExecutor) error {
+			err := addColumn(s, "Agent", "lastseen", "datetime not null default '0001-01-01 00:00:00+00:00'")
+			if err != nil {
+				return err
+			}
+			return addColumn(s, "Agent", "lastip", "varchar(255) not null default ''")
+		},
+		Down: func(s gorp.SqlExecutor) error {
+			_, err := s.Exec("ALTER TABLE Agent DROP COLUMN lastseen")
+			if err != nil {
+				return err
+			}
+			_, err = s.Exec("ALTER TABLE Agent DROP COLUMN lastip")
+			return err
+		},
+	},
+	{
+		Id: "0003_agent_ipkey",
+		Up: func(s gorp.SqlExecutor) error {
+			if err := addColumn(s, "Agent", "ipkey", "varchar(255) not null default ''"); err != nil {
+				return err
+			}
+			var agents []struct {
+				Id int64  `db:"id"`
+				IP string `db:"ip"`
+			}
+			if _, err := s.Select(&agents, "SELECT id, ip FROM Agent"); err != nil {
+				return err
+			}
+			for _, a := range agents { // invalid legacy addresses keep an empty key
+				ip, err := normalizeIP(a.IP)
+				if err != nil {
+					continue
+				}
+				if _, err = s.Exec("UPDATE Agent SET ip=?, ipkey=? WHERE id=?", ip, ipKey(ip), a.Id); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(s gorp.SqlExecutor) error {
+			_, err := s.Exec("ALTER TABLE Agent DROP COLUMN ipkey")
+			return err
+		},
+	},
+	{
+		Id: "0004_tenant",
+		Up: func(s gorp.SqlExecutor) error {
+			for _, table := range []string{"Agent", "User", "APIKey"} {
+				if err := addColumn(s, table, "tenant", "varchar(255) not null default ''"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(s gorp.SqlExecutor) error {
+			for _, table := range []string{"Agent", "User", "APIKey"} {
+				if _, err := s.Exec("ALTER TABLE " + table + " DROP COLUMN tenant"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Id: "0005_webhook_tenant",
+		Up: func(s gorp.SqlExecutor) error {
+			return addColumn(s, "Webhook", "tenant", "varchar(255) not null default ''")
+		},
+		Down: func(s gorp.SqlExecutor) error {
+			_, err := s.Exec("ALTER TABLE Webhook DROP COLUMN tenant")
+			return err
+		},
+	},
+}
+
+// MigrationRecord db and json type of an applied migration
+type MigrationRecord struct {
+	Id      string    `db:"id" json:"id"`
+	Applied time.Time `db:"applied" json:"applied"`
+}
+
+// Migrate apply pending migrations, each one in its own transaction
+func Migrate(dbmap *gorp.DbMap) error {
+	pending, err := PendingMigrations(dbmap)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if !contains(pending, m.Id) {
+			continue
+		}
+		tx, err := dbmap.Begin()
+		if err != nil {
+			return err
+		}
+		if m.Up != nil {
+			if err = m.Up(tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Insert(&MigrationRecord{Id: m.Id, Applied: time.Now()}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingMigrations return ids of migrations not yet applied
+func PendingMigrations(dbmap *gorp.DbMap) ([]string, error) {
+	var applied []MigrationRecord
+	_, err := dbmap.Select(&applied, "SELECT * FROM Migration")
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool)
+	for _, a := range applied {
+		done[a.Id] = true
+	}
+	pending := []string{}
+	for _, m := range migrations {
+		if !done[m.Id] {
+			pending = append(pending, m.Id)
+		}
+	}
+	return pending, nil
+}
+
+// MigrationStatus return one record by migration, Applied is zero for pending ones
+func MigrationStatus(dbmap *gorp.DbMap) ([]MigrationRecord, error) {
+	var applied []MigrationRecord
+	if _, err := dbmap.Select(&applied, "SELECT * FROM Migration"); err != nil {
+		return nil, err
+	}
+	status := make([]MigrationRecord, len(migrations))
+	for i, m := range migrations {
+		status[i].Id = m.Id
+		for _, a := range applied {
+			if a.Id == m.Id {
+				status[i].Applied = a.Applied
+			}
+		}
+	}
+	return status, nil
+}
+
+// MigrateDown revert the last n applied migrations, last first, each one in
+// its own transaction, and return their ids. InitDb applies them again.
+func MigrateDown(dbmap *gorp.DbMap, n int) ([]string, error) {
+	pending, err := PendingMigrations(dbmap)
+	if err != nil {
+		return nil, err
+	}
+	var reverted []string
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < n; i-- {
+		m := migrations[i]
+		if contains(pending, m.Id) {
+			continue
+		}
+		if m.Down == nil {
+			return reverted, fmt.Errorf("migration %s has no Down", m.Id)
+		}
+		tx, err := dbmap.Begin()
+		if err != nil {
+			return reverted, err
+		}
+		if err = m.Down(tx); err != nil {
+			tx.Rollback()
+			return reverted, fmt.Errorf("%s: %w", m.Id, err)
+		}
+		if _, err = tx.Exec("DELETE FROM Migration WHERE id=?", m.Id); err != nil {
+			tx.Rollback()
+			return reverted, err
+		}
+		if err = tx.Commit(); err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, m.Id)
+	}
+	return reverted, nil
+}
+
+// addColumn add a column unless the table already has it,
+// tables created by CreateTablesIfNotExists already contain new fields
+func addColumn(s gorp.SqlExecutor, table string, column string, def string) error {
+	n, err := s.SelectInt("SELECT COUNT(*) FROM pragma_table_info('"+table+"') WHERE name=?", column)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = s.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
+	return err
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
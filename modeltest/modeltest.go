@@ -0,0 +1,210 @@
+// Package modeltest run the CRUD conformance suite of a REST resource
+// served with the conventions of the models handlers: X-Total-Count,
+// _filters, _sortField and _sortDir, _perPage, _start and _end, 404 on
+// missing ids and 400 on missing mandatory fields.
+//
+//	func TestAgentConformance(t *testing.T) {
+//		modeltest.Suite{
+//			Router:  router,
+//			Path:    "/api/v1/agents",
+//			Valid:   func(i int) interface{} { return Agent{Name: fmt.Sprintf("web%d", i), IP: "10.0.0.1"} },
+//			Invalid: []interface{}{Agent{Name: "missing ip"}},
+//			Filter:  "name",
+//		}.Run(t)
+//	}
+package modeltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// Suite CRUD conformance suite of one resource
+type Suite struct {
+	Router  http.Handler
+	Path    string                  // resource path, like /api/v1/agents
+	Valid   func(i int) interface{} // i-th valid record, with distinct Filter values
+	Invalid []interface{}           // records missing mandatory fields
+	Filter  string                  // json field searched with _filters, like name
+	Sort    string                  // json field sorted, id by default
+	Count   int                     // created records, 3 by default
+	Missing string                  // id of no record, 999999 by default
+	Header  http.Header             // added to requests, like X-Tenant
+}
+
+// Run create Count records then check lists, filters, sort, pagination,
+// get, update, 404s and delete, each step as a subtest of t
+func (s Suite) Run(t *testing.T) {
+	if s.Sort == "" {
+		s.Sort = "id"
+	}
+	if s.Count < 3 {
+		s.Count = 3
+	}
+	if s.Missing == "" {
+		s.Missing = "999999"
+	}
+
+	before := s.total(t, nil)
+	var ids []string
+
+	if !t.Run("create", func(t *testing.T) {
+		for i := 0; i < s.Count; i++ {
+			resp := s.do("POST", s.Path, s.Valid(i))
+			if !assert.Equal(t, 201, resp.Code, "POST %s valid record %d: %s", s.Path, i, resp.Body) {
+				t.FailNow()
+			}
+			ids = append(ids, id(decode(resp)))
+		}
+	}) {
+		return // next steps need records
+	}
+
+	t.Run("missing mandatory fields", func(t *testing.T) {
+		for i, r := range s.Invalid {
+			resp := s.do("POST", s.Path, r)
+			assert.Equal(t, 400, resp.Code, "POST %s invalid record %d", s.Path, i)
+		}
+		assert.Equal(t, before+s.Count, s.total(t, nil), "no invalid record created")
+	})
+
+	t.Run("list count", func(t *testing.T) {
+		resp := s.do("GET", s.Path, nil)
+		assert.Equal(t, 200, resp.Code, "GET %s", s.Path)
+		assert.Equal(t, before+s.Count, s.total(t, nil), "X-Total-Count")
+		assert.Len(t, decodeList(resp), before+s.Count, "records")
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		if s.Filter == "" {
+			t.Skip("no Filter field")
+		}
+		value := fmt.Sprint(fields(s.Valid(0))[s.Filter])
+		f, _ := json.Marshal(map[string]string{s.Filter: value})
+		q := url.Values{"_filters": {string(f)}}
+		list := decodeList(s.do("GET", s.Path+"?"+q.Encode(), nil))
+		assert.NotEmpty(t, list, "_filters %s", f)
+		found := false
+		for _, r := range list {
+			assert.Contains(t, fmt.Sprint(r[s.Filter]), value, "_filters %s", f)
+			found = found || id(r) == ids[0]
+		}
+		assert.True(t, found, "_filters %s finds record %s", f, ids[0])
+		assert.Equal(t, len(list), s.total(t, q), "X-Total-Count of _filters")
+	})
+
+	t.Run("sort", func(t *testing.T) {
+		asc := decodeList(s.do("GET", s.Path+"?_sortField="+s.Sort+"&_sortDir=ASC", nil))
+		desc := decodeList(s.do("GET", s.Path+"?_sortField="+s.Sort+"&_sortDir=DESC", nil))
+		if assert.Equal(t, len(asc), len(desc), "same records") && len(asc) > 1 {
+			assert.Equal(t, asc[0][s.Sort], desc[len(desc)-1][s.Sort], "DESC is reverse of ASC")
+			assert.Equal(t, asc[len(asc)-1][s.Sort], desc[0][s.Sort], "DESC is reverse of ASC")
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		list := decodeList(s.do("GET", s.Path+"?_perPage=2&_sortField=id&_sortDir=ASC", nil))
+		assert.Len(t, list, 2, "_perPage=2")
+		all := decodeList(s.do("GET", s.Path+"?_sortField=id&_sortDir=ASC", nil))
+		list = decodeList(s.do("GET", s.Path+"?_start=2&_end=3&_sortField=id&_sortDir=ASC", nil))
+		if assert.Len(t, list, 2, "_start=2&_end=3") && len(all) > 2 {
+			assert.Equal(t, id(all[1]), id(list[0]), "_start is the 1-based first record")
+		}
+		assert.Equal(t, before+s.Count, s.total(t, url.Values{"_perPage": {"1"}}), "X-Total-Count ignores pagination")
+	})
+
+	t.Run("get", func(t *testing.T) {
+		resp := s.do("GET", s.Path+"/"+ids[1], nil)
+		if assert.Equal(t, 200, resp.Code, "GET %s/%s", s.Path, ids[1]) && s.Filter != "" {
+			assert.Equal(t, fields(s.Valid(1))[s.Filter], decode(resp)[s.Filter], "field %s", s.Filter)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		next := s.Valid(s.Count)
+		resp := s.do("PUT", s.Path+"/"+ids[1], next)
+		assert.Equal(t, 200, resp.Code, "PUT %s/%s: %s", s.Path, ids[1], resp.Body)
+		if s.Filter != "" {
+			got := decode(s.do("GET", s.Path+"/"+ids[1], nil))
+			assert.Equal(t, fields(next)[s.Filter], got[s.Filter], "updated field %s", s.Filter)
+		}
+		for i, r := range s.Invalid {
+			resp = s.do("PUT", s.Path+"/"+ids[1], r)
+			assert.Equal(t, 400, resp.Code, "PUT %s/%s invalid record %d", s.Path, ids[1], i)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		path := s.Path + "/" + s.Missing
+		assert.Equal(t, 404, s.do("GET", path, nil).Code, "GET %s", path)
+		assert.Equal(t, 404, s.do("PUT", path, s.Valid(0)).Code, "PUT %s", path)
+		assert.Equal(t, 404, s.do("DELETE", path, nil).Code, "DELETE %s", path)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		path := s.Path + "/" + ids[0]
+		assert.Equal(t, 200, s.do("DELETE", path, nil).Code, "DELETE %s", path)
+		assert.Equal(t, 404, s.do("GET", path, nil).Code, "GET deleted %s", path)
+		assert.Equal(t, 404, s.do("DELETE", path, nil).Code, "DELETE deleted %s", path)
+		assert.Equal(t, before+s.Count-1, s.total(t, nil), "X-Total-Count after delete")
+	})
+}
+
+// do send a JSON request to Router
+func (s Suite) do(method string, path string, body interface{}) *httptest.ResponseRecorder {
+	b := new(bytes.Buffer)
+	if body != nil {
+		json.NewEncoder(b).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, b)
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp := httptest.NewRecorder()
+	s.Router.ServeHTTP(resp, req)
+	return resp
+}
+
+// total X-Total-Count of a list query
+func (s Suite) total(t *testing.T, q url.Values) int {
+	resp := s.do("GET", s.Path+"?"+q.Encode(), nil)
+	n, err := strconv.Atoi(resp.Header().Get("X-Total-Count"))
+	assert.Nil(t, err, "X-Total-Count of GET %s?%s", s.Path, q.Encode())
+	return n
+}
+
+func decode(resp *httptest.ResponseRecorder) map[string]interface{} {
+	var r map[string]interface{}
+	json.Unmarshal(resp.Body.Bytes(), &r)
+	return r
+}
+
+func decodeList(resp *httptest.ResponseRecorder) []map[string]interface{} {
+	var list []map[string]interface{}
+	json.Unmarshal(resp.Body.Bytes(), &list)
+	return list
+}
+
+// fields of a record as decoded from its JSON
+func fields(record interface{}) map[string]interface{} {
+	b, _ := json.Marshal(record)
+	var r map[string]interface{}
+	json.Unmarshal(b, &r)
+	return r
+}
+
+func id(r map[string]interface{}) string {
+	if f, ok := r["id"].(float64); ok { // not 1e+06
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(r["id"])
+}
@@ -0,0 +1,70 @@
+package modeltest_test
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	models "github.com/yvesago/gin-model-template"
+	"github.com/yvesago/gin-model-template/modeltest"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func router(t *testing.T, middlewares ...gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(models.Database(filepath.Join(t.TempDir(), "test.sqlite3")))
+	r.Use(middlewares...)
+
+	r.GET("/api/v1/agents", models.GetAgents)
+	r.GET("/api/v1/agents/:id", models.GetAgent)
+	r.POST("/api/v1/agents", models.PostAgent)
+	r.PUT("/api/v1/agents/:id", models.UpdateAgent)
+	r.DELETE("/api/v1/agents/:id", models.DeleteAgent)
+
+	r.GET("/api/v1/users", models.GetUsers)
+	r.GET("/api/v1/users/:id", models.GetUser)
+	r.POST("/api/v1/users", models.PostUser)
+	r.PUT("/api/v1/users/:id", models.UpdateUser)
+	r.DELETE("/api/v1/users/:id", models.DeleteUser)
+	return r
+}
+
+func agents(r http.Handler) modeltest.Suite {
+	return modeltest.Suite{
+		Router: r,
+		Path:   "/api/v1/agents",
+		Valid: func(i int) interface{} {
+			return models.Agent{Name: fmt.Sprintf("web%d", i), IP: fmt.Sprintf("10.0.0.%d", i+1)}
+		},
+		Invalid: []interface{}{models.Agent{Name: "missing ip"}, models.Agent{IP: "10.0.0.1"}},
+		Filter:  "name",
+		Sort:    "ip",
+	}
+}
+
+func TestAgents(t *testing.T) {
+	agents(router(t)).Run(t)
+}
+
+func TestUsers(t *testing.T) {
+	modeltest.Suite{
+		Router: router(t),
+		Path:   "/api/v1/users",
+		Valid: func(i int) interface{} {
+			return models.User{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.org", i)}
+		},
+		Invalid: []interface{}{models.User{Email: "missing@example.org"}},
+		Filter:  "name",
+		Count:   5,
+	}.Run(t)
+}
+
+func TestTenantAgents(t *testing.T) {
+	r := router(t, models.Tenant(models.TenantHeader("X-Tenant")))
+	for _, tenant := range []string{"acme", "globex"} {
+		s := agents(r)
+		s.Header = http.Header{"X-Tenant": {tenant}}
+		t.Run(tenant, s.Run)
+	}
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/yaml.v3"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla, GetAgents)
+	router.GET(urla+"/:id", GetAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+	router.DELETE(urla+"/:id", DeleteAgent)
+
+	do := func(method string, path string, accept string, ctype string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		req.Header.Set("Content-Type", ctype)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Create
+	log.Println("= create from YAML, XML and MessagePack")
+	resp := do("POST", urla, "application/x-yaml", "application/x-yaml", []byte("name: yaml1\nip: 10.0.0.1\n"))
+	assert.Equal(t, 201, resp.Code, "http POST yaml")
+	assert.Contains(t, resp.Header().Get("Content-Type"), "yaml", "yaml response")
+	var a Agent
+	yaml.Unmarshal(resp.Body.Bytes(), &a)
+	assert.Equal(t, "yaml1", a.Name, "yaml round trip")
+
+	resp = do("POST", urla, "application/xml", "application/xml", []byte("<Agent><Name>xml1</Name><IP>10.0.0.1</IP></Agent>"))
+	assert.Equal(t, 201, resp.Code, "http POST xml")
+	a = Agent{}
+	xml.Unmarshal(resp.Body.Bytes(), &a)
+	assert.Equal(t, "xml1", a.Name, "xml round trip")
+
+	var mh codec.MsgpackHandle
+	var body []byte
+	codec.NewEncoderBytes(&body, &mh).Encode(map[string]string{"name": "msgpack1", "ip": "10.0.0.1"})
+	resp = do("POST", urla, "application/x-msgpack", "application/x-msgpack", body)
+	assert.Equal(t, 201, resp.Code, "http POST msgpack")
+	assert.Equal(t, "application/msgpack; charset=utf-8", resp.Header().Get("Content-Type"), "msgpack response")
+	a = Agent{}
+	codec.NewDecoderBytes(resp.Body.Bytes(), &mh).Decode(&a)
+	assert.Equal(t, "msgpack1", a.Name, "msgpack round trip")
+
+	// List
+	log.Println("= list as YAML and XML")
+	resp = do("GET", urla, "text/yaml", "", nil)
+	assert.Equal(t, 200, resp.Code, "http GET yaml")
+	var as []Agent
+	yaml.Unmarshal(resp.Body.Bytes(), &as)
+	assert.Equal(t, 3, len(as), "yaml list")
+
+	resp = do("GET", urla, "application/xml", "", nil)
+	assert.Equal(t, 200, resp.Code, "http GET xml")
+	var list struct {
+		XMLName xml.Name
+		Agents  []Agent `xml:"Agent"`
+	}
+	xml.Unmarshal(resp.Body.Bytes(), &list)
+	assert.Equal(t, "agents", list.XMLName.Local, "xml root")
+	assert.Equal(t, 3, len(list.Agents), "xml list")
+
+	log.Println("= default and weighted Accept")
+	resp = do("GET", urla+"/1", "", "", nil)
+	assert.Contains(t, resp.Header().Get("Content-Type"), "application/json", "json by default")
+	resp = do("GET", urla+"/1", "*/*", "", nil)
+	assert.Contains(t, resp.Header().Get("Content-Type"), "application/json", "json for any")
+	resp = do("GET", urla+"/1", "text/html, application/xml;q=0.9", "", nil)
+	assert.Contains(t, resp.Header().Get("Content-Type"), "application/xml", "xml when preferred")
+
+	log.Println("= ETag per representation")
+	tag := do("GET", urla+"/1", "", "", nil).Header().Get("ETag")
+	resp = do("GET", urla+"/1", "application/x-yaml", "", nil)
+	assert.NotEqual(t, tag, resp.Header().Get("ETag"), "yaml etag")
+	assert.Equal(t, "Accept", resp.Header().Get("Vary"), "vary")
+
+	// Errors
+	log.Println("= 406 and 415")
+	resp = do("GET", urla, "text/html", "", nil)
+	assert.Equal(t, 406, resp.Code, "http GET not acceptable")
+	resp = do("POST", urla, "text/html", "application/json", []byte(`{"name":"html","ip":"10.0.0.1"}`))
+	assert.Equal(t, 406, resp.Code, "http POST not acceptable")
+	resp = do("POST", urla, "", "text/csv", []byte("name,ip\ncsv,10.0.0.1\n"))
+	assert.Equal(t, 415, resp.Code, "http POST unsupported media type")
+	resp = do("PUT", urla+"/1", "", "text/csv", []byte("name,ip\ncsv,10.0.0.1\n"))
+	assert.Equal(t, 415, resp.Code, "http PUT unsupported media type")
+	resp = do("POST", urla, "", "application/json", []byte(`{"name":`))
+	assert.Equal(t, 400, resp.Code, "http POST malformed")
+
+	resp = do("GET", urla, "", "", nil)
+	assert.Contains(t, resp.Body.String(), "yaml1", "no write on errors")
+	assert.NotContains(t, resp.Body.String(), "csv", "no write on errors")
+
+	// Delete
+	log.Println("= delete as XML")
+	resp = do("DELETE", urla+"/2", "application/xml", "", nil)
+	assert.Equal(t, 200, resp.Code, "http DELETE xml")
+	var deleted struct {
+		Id     int64  `xml:"id"`
+		Status string `xml:"status"`
+	}
+	assert.Nil(t, xml.Unmarshal(resp.Body.Bytes(), &deleted), "valid xml")
+	assert.Equal(t, int64(2), deleted.Id, "id")
+	assert.Equal(t, "deleted", deleted.Status, "status")
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"errors"
+	"gopkg.in/gorp.v2"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Model a registered table, served by generic handlers like GraphQL
+type Model struct {
+	Name string // struct and table name, like Agent
+	Type reflect.Type
+}
+
+// Field of a model struct, from its tags
+type Field struct {
+	Name     string // struct field
+	Column   string // `db` tag
+	JSON     string // `json` tag
+	Type     reflect.Type
+	Ref      string // referenced model, `ref:"User"` tag
+	Required bool   // `valid:"required"` tag
+	Readonly bool   // `readonly:"true"` tag, set by handlers like heartbeat
+	Index    int
+}
+
+var (
+	registry   []Model
+	registryMu sync.Mutex
+)
+
+// register add table to dbmap and its model to registry
+func register(dbmap *gorp.DbMap, i interface{}, name string) {
+	dbmap.AddTableWithName(i, name).SetKeys(true, "Id")
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, m := range registry {
+		if m.Name == name {
+			return
+		}
+	}
+	registry = append(registry, Model{Name: name, Type: reflect.TypeOf(i)})
+}
+
+// Models return registered models
+func Models() []Model {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return append([]Model{}, registry...)
+}
+
+// ModelFor find a model by name or resource: Agent, agent or agents
+func ModelFor(name string) (Model, bool) {
+	for _, m := range Models() {
+		if strings.EqualFold(m.Name, name) || strings.EqualFold(plural(m.Name), name) {
+			return m, true
+		}
+	}
+	return Model{}, false
+}
+
+// Resource lower case name used by events and cache: agent
+func (m Model) Resource() string {
+	return strings.ToLower(m.Name)
+}
+
+// plural of a resource for routes and lists: agents, statuses, policies,
+// ginmodel names handlers and routes with the same rule
+func plural(name string) string {
+	lower := strings.ToLower(name)
+	n := len(lower)
+	switch {
+	case strings.HasSuffix(lower, "s") || strings.HasSuffix(lower, "x") || strings.HasSuffix(lower, "z") ||
+		strings.HasSuffix(lower, "ch") || strings.HasSuffix(lower, "sh"):
+		return name + "es"
+	case n > 1 && lower[n-1] == 'y' && !strings.ContainsRune("aeiou", rune(lower[n-2])):
+		return name[:n-1] + "ies"
+	}
+	return name + "s"
+}
+
+// Fields of model with a db column
+func (m Model) Fields() []Field {
+	var fields []Field
+	for i := 0; i < m.Type.NumField(); i++ {
+		f := m.Type.Field(i)
+		column := strings.TrimSpace(strings.Split(f.Tag.Get("db"), ",")[0])
+		if f.PkgPath != "" || column == "" || column == "-" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" { // internal column, like ipkey
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, Field{
+			Name:     f.Name,
+			Column:   column,
+			JSON:     name,
+			Type:     f.Type,
+			Ref:      f.Tag.Get("ref"),
+			Required: f.Tag.Get("valid") == "required",
+			Readonly: f.Tag.Get("readonly") == "true",
+			Index:    i,
+		})
+	}
+	return fields
+}
+
+// New return a pointer to a new record
+func (m Model) New() interface{} {
+	return reflect.New(m.Type).Interface()
+}
+
+// NewSlice return a pointer to an empty slice of records, for Select
+func (m Model) NewSlice() interface{} {
+	return reflect.New(reflect.SliceOf(m.Type)).Interface()
+}
+
+// Validator checked by handlers before Insert and Update
+type Validator interface {
+	Validate() error
+}
+
+// validate a record with its Validate method or its required fields
+func validate(record interface{}) error {
+	if v, ok := record.(Validator); ok {
+		return v.Validate()
+	}
+	return required(record)
+}
+
+// required check fields tagged `valid:"required"` are not empty
+func required(record interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(record))
+	for i := 0; i < rv.NumField(); i++ {
+		if rv.Type().Field(i).Tag.Get("valid") == "required" && rv.Field(i).IsZero() {
+			return errors.New("mandatory fields are empty")
+		}
+	}
+	return nil
+}
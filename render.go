@@ -0,0 +1,368 @@
+package models
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	ginrender "github.com/gin-gonic/gin/render"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const jsonapiMedia = "application/vnd.api+json"
+
+// formats offered by render, first one is the default
+var formats = []string{
+	binding.MIMEJSON, jsonapiMedia,
+	binding.MIMEYAML, binding.MIMEYAML2, "text/yaml",
+	binding.MIMEXML, binding.MIMEXML2,
+	binding.MIMEMSGPACK, binding.MIMEMSGPACK2,
+}
+
+// JSONAPI gin Middlware to serialize all resource handlers as JSON:API,
+// without it clients opt in with Accept: application/vnd.api+json
+func JSONAPI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("JSONAPI", true)
+		c.Next()
+	}
+}
+
+// contentRange set Content-Range of lists with X-Total-Count, like
+// "agents 0-24/319", expected by react-admin
+func contentRange(c *gin.Context, obj interface{}) {
+	total := c.Writer.Header().Get("X-Total-Count")
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	if total == "" || v.Kind() != reflect.Slice {
+		return
+	}
+	if v.Len() == 0 {
+		c.Header("Content-Range", resource(c)+" */"+total)
+		return
+	}
+	start := firstRecord(c.Request.URL.Query())
+	c.Header("Content-Range", resource(c)+" "+strconv.Itoa(start)+"-"+strconv.Itoa(start+v.Len()-1)+"/"+total)
+}
+
+// format negotiate response format from Accept header, "" if none is acceptable
+func format(c *gin.Context) string {
+	if c.GetBool("JSONAPI") {
+		return jsonapiMedia
+	}
+	switch f := c.NegotiateFormat(formats...); f {
+	case binding.MIMEYAML2, "text/yaml":
+		return binding.MIMEYAML
+	case binding.MIMEXML2:
+		return binding.MIMEXML
+	case binding.MIMEMSGPACK2:
+		return binding.MIMEMSGPACK
+	default:
+		return f
+	}
+}
+
+// render write records or messages of resource handlers in negotiated format
+func render(c *gin.Context, code int, obj interface{}) {
+	c.Header("Vary", "Accept")
+	obj = withoutSecretFields(obj)
+	contentRange(c, obj)
+	switch format(c) {
+	case jsonapiMedia:
+		b, _ := json.Marshal(jsonapiDocument(c, obj))
+		c.Data(code, jsonapiMedia, b)
+	case binding.MIMEYAML:
+		c.YAML(code, obj)
+	case binding.MIMEXML:
+		c.XML(code, xmlValue(c, obj))
+	case binding.MIMEMSGPACK:
+		c.Render(code, ginrender.MsgPack{Data: obj})
+	case "":
+		c.JSON(406, gin.H{"error": "not acceptable, use one of " + strings.Join(formats, ", ")})
+	default:
+		c.JSON(code, obj)
+	}
+}
+
+// withoutSecretFields copy of a record or list with fields tagged
+// `log:"redact"` emptied, like User.Pass, obj itself without such fields
+func withoutSecretFields(obj interface{}) interface{} {
+	v := reflect.ValueOf(obj)
+	ptr := v.Kind() == reflect.Ptr
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		return obj
+	}
+	t := v.Type()
+	if v.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return obj
+	}
+	var secrets []int
+	for i := 0; i < t.NumField(); i++ {
+		if secret(t.Field(i)) {
+			secrets = append(secrets, i)
+		}
+	}
+	if len(secrets) == 0 {
+		return obj
+	}
+
+	clean := func(record reflect.Value) {
+		for _, i := range secrets {
+			record.Field(i).Set(reflect.Zero(t.Field(i).Type))
+		}
+	}
+	out := reflect.New(v.Type()).Elem()
+	if v.Kind() == reflect.Slice {
+		out = reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(out, v)
+		for i := 0; i < out.Len(); i++ {
+			clean(out.Index(i))
+		}
+	} else {
+		out.Set(v)
+		clean(out)
+	}
+	if ptr {
+		return out.Addr().Interface()
+	}
+	return out.Interface()
+}
+
+// renderError write an error message of resource handlers
+func renderError(c *gin.Context, code int, msg string) {
+	switch format(c) {
+	case jsonapiMedia:
+		b, _ := json.Marshal(gin.H{"errors": []gin.H{{"status": strconv.Itoa(code), "title": msg}}})
+		c.Data(code, jsonapiMedia, b)
+	case "":
+		c.JSON(code, gin.H{"error": msg})
+	default:
+		render(c, code, gin.H{"error": msg})
+	}
+}
+
+// renderUnavailable log a failed database write and answer 503, the
+// server keeps running where checkErr would stop it
+func renderUnavailable(c *gin.Context, msg string, err error) {
+	logger(c).Error(msg, "error", err)
+	renderError(c, 503, msg)
+}
+
+// bind decode request body of create and update handlers from its
+// Content-Type, on error write a 400, 406 or 415 response
+func bind(c *gin.Context, obj interface{}) error {
+	if format(c) == "" {
+		render(c, 406, nil)
+		return errors.New("not acceptable")
+	}
+
+	var err error
+	switch ct := c.ContentType(); ct {
+	case jsonapiMedia:
+		err = bindJSONAPI(c, obj)
+	case "", binding.MIMEJSON:
+		err = c.ShouldBindWith(obj, binding.JSON)
+	case "text/yaml":
+		err = c.ShouldBindWith(obj, binding.YAML)
+	case binding.MIMEXML, binding.MIMEXML2, binding.MIMEYAML, binding.MIMEYAML2,
+		binding.MIMEMSGPACK, binding.MIMEMSGPACK2, binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+		err = c.ShouldBindWith(obj, binding.Default(c.Request.Method, ct))
+	default:
+		renderError(c, 415, "unsupported media type "+ct)
+		return errors.New("unsupported media type")
+	}
+	if err != nil {
+		renderError(c, 400, err.Error())
+	}
+	return err
+}
+
+// bindJSONAPI decode a JSON:API resource object, relationships as ids
+func bindJSONAPI(c *gin.Context, obj interface{}) error {
+	var doc struct {
+		Data struct {
+			Attributes    map[string]interface{} `json:"attributes"`
+			Relationships map[string]struct {
+				Data *struct {
+					Id string `json:"id"`
+				} `json:"data"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil {
+		return err
+	}
+	flat := doc.Data.Attributes
+	if flat == nil {
+		flat = make(map[string]interface{})
+	}
+	for name, rel := range doc.Data.Relationships {
+		if rel.Data == nil {
+			flat[name] = 0
+			continue
+		}
+		id, err := strconv.ParseInt(rel.Data.Id, 10, 64)
+		if err != nil {
+			return errors.New("invalid relationship id")
+		}
+		flat[name] = id
+	}
+	b, _ := json.Marshal(flat)
+	return json.Unmarshal(b, obj)
+}
+
+// xmlList root element of lists: <agents><Agent>...</Agent></agents>
+type xmlList struct {
+	name  string
+	items reflect.Value
+}
+
+// MarshalXML encode each item with its type name
+func (l xmlList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = l.name
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for i := 0; i < l.items.Len(); i++ {
+		item := l.items.Index(i)
+		name := xml.StartElement{Name: xml.Name{Local: reflect.Indirect(item).Type().Name()}}
+		if err := e.EncodeElement(item.Interface(), name); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func xmlValue(c *gin.Context, obj interface{}) interface{} {
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	if v.Kind() == reflect.Slice {
+		return xmlList{name: resource(c), items: v}
+	}
+	return obj
+}
+
+// jsonapiDocument wrap records into data, messages into meta
+func jsonapiDocument(c *gin.Context, obj interface{}) gin.H {
+	base := collectionPath(c)
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		data := make([]gin.H, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			data = append(data, jsonapiResource(base, v.Index(i)))
+		}
+		doc := gin.H{"data": data, "links": gin.H{"self": c.Request.URL.String()}}
+		if total, err := strconv.Atoi(c.Writer.Header().Get("X-Total-Count")); err == nil {
+			doc["meta"] = gin.H{"total": total}
+			doc["links"] = paginationLinks(c, total)
+		}
+		return doc
+	case reflect.Struct:
+		r := jsonapiResource(base, v)
+		return gin.H{"data": r, "links": r["links"]}
+	}
+	return gin.H{"meta": obj}
+}
+
+// jsonapiResource type, id, attributes and relationships of a record
+func jsonapiResource(base string, v reflect.Value) gin.H {
+	m := Model{Name: v.Type().Name(), Type: v.Type()}
+	attributes := make(map[string]interface{})
+	b, _ := json.Marshal(v.Interface())
+	json.Unmarshal(b, &attributes)
+
+	id := ""
+	relationships := gin.H{}
+	for _, f := range m.Fields() {
+		switch {
+		case f.Column == "id":
+			id = strconv.FormatInt(v.Field(f.Index).Int(), 10)
+			delete(attributes, f.JSON)
+		case f.Ref != "":
+			delete(attributes, f.JSON)
+			ref := v.Field(f.Index)
+			if ref.IsZero() {
+				relationships[f.JSON] = gin.H{"data": nil}
+			} else {
+				relationships[f.JSON] = gin.H{"data": gin.H{
+					"type": plural(strings.ToLower(f.Ref)),
+					"id":   strconv.FormatInt(ref.Int(), 10),
+				}}
+			}
+		}
+	}
+
+	r := gin.H{
+		"type":       plural(m.Resource()),
+		"id":         id,
+		"attributes": attributes,
+		"links":      gin.H{"self": base + "/" + id},
+	}
+	if len(relationships) > 0 {
+		r["relationships"] = relationships
+	}
+	return r
+}
+
+// collectionPath route of resource: /api/v1/agents for /api/v1/agents/:id
+func collectionPath(c *gin.Context) string {
+	path := c.Request.URL.Path
+	if id := c.Param("id"); id != "" {
+		if i := strings.LastIndex(path, "/"+id); i >= 0 {
+			path = path[:i]
+		}
+	}
+	return path
+}
+
+// paginationLinks self, first, prev, next and last links with page[number]
+func paginationLinks(c *gin.Context, total int) gin.H {
+	links := gin.H{"self": c.Request.URL.String()}
+	q := jsonapiQuery(c.Request.URL.Query())
+	if q["_perPage"] == nil {
+		return links
+	}
+	size, _ := strconv.Atoi(q["_perPage"][0])
+	if size <= 0 {
+		return links
+	}
+	page := 1
+	if q["_page"] != nil {
+		page, _ = strconv.Atoi(q["_page"][0])
+	}
+	last := (total + size - 1) / size
+	if last < 1 {
+		last = 1
+	}
+
+	link := func(n int) string {
+		u := *c.Request.URL
+		values := u.Query()
+		values.Del("_page")
+		values.Set("page[number]", strconv.Itoa(n))
+		if values.Get("_perPage") == "" {
+			values.Set("page[size]", strconv.Itoa(size))
+		}
+		u.RawQuery = values.Encode()
+		return u.String()
+	}
+	links["first"] = link(1)
+	links["last"] = link(last)
+	if page > 1 {
+		links["prev"] = link(page - 1)
+	}
+	if page < last {
+		links["next"] = link(page + 1)
+	}
+	return links
+}
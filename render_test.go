@@ -0,0 +1,124 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type jsonapiDoc struct {
+	Data   json.RawMessage
+	Meta   map[string]interface{}
+	Links  map[string]string
+	Errors []map[string]string
+}
+
+type jsonapiRes struct {
+	Type          string
+	Id            string
+	Attributes    map[string]interface{}
+	Relationships map[string]struct{ Data map[string]string }
+	Links         map[string]string
+}
+
+func TestJSONAPI(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.GET(urla, GetAgents)
+	router.GET(urla+"/:id", GetAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+
+	do := func(method string, path string, body string) (*httptest.ResponseRecorder, jsonapiDoc) {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Accept", jsonapiMedia)
+		req.Header.Set("Content-Type", jsonapiMedia)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var doc jsonapiDoc
+		json.Unmarshal(resp.Body.Bytes(), &doc)
+		return resp, doc
+	}
+
+	// Create
+	log.Println("= JSON:API create")
+	for _, name := range []string{"web1", "web2", "db1"} {
+		resp, doc := do("POST", urla, `{"data":{"type":"agents","attributes":{"name":"`+name+`","ip":"10.0.0.1"},
+			"relationships":{"owner":{"data":{"type":"users","id":"7"}}}}}`)
+		assert.Equal(t, 201, resp.Code, "http POST success")
+		assert.Equal(t, jsonapiMedia, resp.Header().Get("Content-Type"), "JSON:API content type")
+		var r jsonapiRes
+		json.Unmarshal(doc.Data, &r)
+		assert.Equal(t, "agents", r.Type, "type")
+		assert.Equal(t, name, r.Attributes["name"], "attributes")
+		assert.Equal(t, "7", r.Relationships["owner"].Data["id"], "owner relationship")
+		assert.Nil(t, r.Attributes["owner"], "relationship not in attributes")
+	}
+
+	log.Println("= JSON:API errors")
+	resp, doc := do("POST", urla, `{"data":{"type":"agents","attributes":{"name":"missing ip"}}}`)
+	assert.Equal(t, 400, resp.Code, "http POST missing mandatory field")
+	assert.Equal(t, "400", doc.Errors[0]["status"], "error object")
+	resp, doc = do("GET", urla+"/9", "")
+	assert.Equal(t, 404, resp.Code, "http GET missing")
+	assert.Equal(t, "agent not found", doc.Errors[0]["title"], "error object")
+
+	// List
+	log.Println("= JSON:API list with filter, sort and page")
+	resp, doc = do("GET", urla+"?filter[name]=web&sort=-name&page[number]=1&page[size]=1", "")
+	assert.Equal(t, 200, resp.Code, "http GET all success")
+	var rs []jsonapiRes
+	json.Unmarshal(doc.Data, &rs)
+	assert.Equal(t, 1, len(rs), "1 per page")
+	if len(rs) == 1 {
+		assert.Equal(t, "web2", rs[0].Attributes["name"], "sorted desc")
+		assert.Equal(t, urla+"/2", rs[0].Links["self"], "self link")
+	}
+	assert.Equal(t, float64(2), doc.Meta["total"], "total filtered")
+	next, _ := url.Parse(doc.Links["next"])
+	assert.Equal(t, "2", next.Query().Get("page[number]"), "next page link")
+	assert.Empty(t, doc.Links["prev"], "no prev link")
+	_, doc = do("GET", next.String(), "")
+	json.Unmarshal(doc.Data, &rs)
+	if assert.Equal(t, 1, len(rs), "page 2") {
+		assert.Equal(t, "web1", rs[0].Attributes["name"], "no record skipped")
+	}
+
+	log.Println("= JSON:API translated query")
+	q, _ := url.ParseQuery("filter[name]=web&sort=-created&page[number]=2&page[size]=5")
+	query, sort, limit := ParseQuery(q)
+	assert.Equal(t, "name LIKE \"%web%\"", query, "filter")
+	assert.Equal(t, " ORDER BY datetime(created) DESC", sort, "sort")
+	assert.Equal(t, " LIMIT 5 OFFSET 5", limit, "page 2 from record 5")
+
+	// Update
+	log.Println("= JSON:API update")
+	resp, doc = do("PUT", urla+"/3", `{"data":{"type":"agents","id":"3","attributes":{"name":"db1 renamed","ip":"10.0.0.1"}}}`)
+	assert.Equal(t, 200, resp.Code, "http PUT success")
+	var r jsonapiRes
+	json.Unmarshal(doc.Data, &r)
+	assert.Equal(t, "db1 renamed", r.Attributes["name"], "updated")
+
+	log.Println("= JSON:API opt-in middleware")
+	router2 := gin.New()
+	router2.Use(SetConfig(config))
+	router2.Use(Database(config.DBname))
+	router2.Use(JSONAPI())
+	router2.GET(urla+"/:id", GetAgent)
+	req, _ := http.NewRequest("GET", urla+"/3", nil)
+	resp = httptest.NewRecorder()
+	router2.ServeHTTP(resp, req)
+	assert.Equal(t, jsonapiMedia, resp.Header().Get("Content-Type"), "JSON:API without Accept")
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
@@ -14,46 +15,91 @@ import (
 
 // Database gin Middlware to select database
 func Database(connString string) gin.HandlerFunc {
-	dbmap := InitDb(connString)
+	return DatabaseMap(InitDb(connString))
+}
+
+// DatabaseMap gin Middlware to use an already opened database
+func DatabaseMap(dbmap *gorp.DbMap) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Set("DBmap", dbmap)
 		c.Next()
 	}
 }
 
+// DatabasePerTenant gin Middlware to select the database of the request
+// tenant, a file from pattern like "data/%s.sqlite3", among size opened ones.
+// Idle databases are closed for the life of the process, use NewTenantPool
+// and its Run to close them all at shutdown.
+func DatabasePerTenant(pattern string, size int, resolvers ...TenantResolver) gin.HandlerFunc {
+	p := NewTenantPool(pattern, size)
+	go p.Run(context.Background())
+	return p.Middleware(resolvers...)
+}
+
 // InitDb set or create db
 func InitDb(dbName string) *gorp.DbMap {
+	dbmap, err := openDb(dbName)
+	checkErr(err, "Open db failed")
+	return dbmap
+}
+
+// openDb open db, create tables and apply pending migrations
+func openDb(dbName string) (*gorp.DbMap, error) {
+	dbmap, err := OpenDb(dbName)
+	if err != nil {
+		return nil, err
+	}
+	if err = Migrate(dbmap); err != nil {
+		dbmap.Db.Close()
+		return nil, err
+	}
+	return dbmap, nil
+}
+
+// OpenDb open db and create missing tables, without applying migrations,
+// for tools like ginadmin migrate
+func OpenDb(dbName string) (*gorp.DbMap, error) {
 	// XXX fix database type
+	if !strings.Contains(dbName, "?") { // sqlite: wait for locks of concurrent writers
+		dbName = dbName + "?_busy_timeout=5000"
+	}
 	db, err := sql.Open("sqlite3", dbName)
-	checkErr(err, "sql.Open failed")
+	if err != nil {
+		return nil, err
+	}
 	//dbmap := &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{"InnoDB", "UTF8"}}
 	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
 	// XXX fix tables names
-	dbmap.AddTableWithName(Agent{}, "Agent").SetKeys(true, "Id")
-	dbmap.AddTableWithName(User{}, "User").SetKeys(true, "Id")
-	err = dbmap.CreateTablesIfNotExists()
-	checkErr(err, "Create tables failed")
-
-	return dbmap
+	register(dbmap, Agent{}, "Agent")
+	register(dbmap, User{}, "User")
+	dbmap.AddTableWithName(Webhook{}, "Webhook").SetKeys(true, "Id")
+	dbmap.AddTableWithName(WebhookDelivery{}, "WebhookDelivery").SetKeys(true, "Id")
+	dbmap.AddTableWithName(AgentFile{}, "AgentFile").SetKeys(true, "Id").SetUniqueTogether("agentid", "path")
+	dbmap.AddTableWithName(AgentFileChange{}, "AgentFileChange").SetKeys(true, "Id")
+	dbmap.AddTableWithName(StatusTransition{}, "StatusTransition").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Token{}, "Token").SetKeys(true, "Id")
+	dbmap.AddTableWithName(APIKey{}, "APIKey").SetKeys(true, "Id").ColMap("Prefix").SetUnique(true)
+	dbmap.AddTableWithName(Fixture{}, "Fixture").SetKeys(true, "Id").SetUniqueTogether("model", "key")
+	dbmap.AddTableWithName(MigrationRecord{}, "Migration").SetKeys(false, "Id")
+	if err = dbmap.CreateTablesIfNotExists(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return dbmap, nil
 }
 
-// ParseQuery parse query to set select SQL query
+// ParseQuery parse query to set select SQL query, from ng-admin parameters
+// or their JSON:API and react-admin equivalents
 func ParseQuery(q map[string][]string) (string, string, string) {
+	q = jsonapiQuery(restQuery(q))
 	query := ""
-	if q["_filters"] != nil {
-		data := make(map[string]string)
-		err := json.Unmarshal([]byte(q["_filters"][0]), &data)
-		if err == nil {
-			var searches []string
-			for col, search := range data {
-				valid := regexp.MustCompile("^[A-Za-z0-9_.]+$")
-				if col != "" && search != "" && valid.MatchString(col) && valid.MatchString(search) {
-					searches = append(searches, col+" LIKE \"%"+search+"%\"")
-				}
-			}
-			query = query + strings.Join(searches, " AND ") // TODO join with OR for same keys
-		}
+	var searches []string
+	for col, search := range parseFilters(q) {
+		searches = append(searches, col+" LIKE \"%"+search+"%\"")
 	}
+	searches = append(searches, ipFilters(q)...)
+	searches = append(searches, exactFilters(q)...)
+	query = query + strings.Join(searches, " AND ") // TODO join with OR for same keys
 
 	sort := ""
 	if q["_sortField"] != nil && q["_sortDir"] != nil {
@@ -66,6 +112,9 @@ func ParseQuery(q map[string][]string) (string, string, string) {
 		if sortField == "created" || sortField == "updated" { // XXX trick for sqlite
 			sortField = "datetime(" + sortField + ")"
 		}
+		if sortField == "ip" { // XXX trick for numeric order of addresses
+			sortField = "ipkey"
+		}
 		sortOrder := q["_sortDir"][0]
 		if sortOrder != "ASC" {
 			sortOrder = "DESC"
@@ -92,7 +141,7 @@ func ParseQuery(q map[string][]string) (string, string, string) {
 		pageInt, _ := strconv.Atoi(page)
 
 		if valid.MatchString(page) && pageInt > 1 {
-			offset := (pageInt-1)*perPageInt + 1
+			offset := (pageInt - 1) * perPageInt
 			limit = limit + " OFFSET " + strconv.Itoa(offset)
 		}
 	}
@@ -115,6 +164,177 @@ func ParseQuery(q map[string][]string) (string, string, string) {
 	return query, sort, limit
 }
 
+// jsonapiQuery translate JSON:API parameters page[number], page[size],
+// filter[col] and sort=-col to ParseQuery ones
+func jsonapiQuery(q map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(q))
+	filters := make(map[string]string)
+	for k, v := range q {
+		out[k] = v
+		if strings.HasPrefix(k, "filter[") && strings.HasSuffix(k, "]") && len(v) > 0 {
+			filters[k[7:len(k)-1]] = v[0]
+		}
+	}
+	if len(filters) > 0 {
+		b, _ := json.Marshal(filters)
+		out["_filters"] = []string{string(b)}
+	}
+	if q["page[number]"] != nil {
+		out["_page"] = q["page[number]"]
+	}
+	if q["page[size]"] != nil {
+		out["_perPage"] = q["page[size]"]
+	}
+	if q["sort"] != nil && q["sort"][0] != "" && !strings.HasPrefix(q["sort"][0], "[") {
+		sortField := strings.Split(q["sort"][0], ",")[0] // first sort field only
+		sortDir := "ASC"
+		if strings.HasPrefix(sortField, "-") {
+			sortField = sortField[1:]
+			sortDir = "DESC"
+		}
+		out["_sortField"] = []string{sortField}
+		out["_sortDir"] = []string{sortDir}
+	}
+	return out
+}
+
+// restQuery translate react-admin simple-rest parameters: range=[0,24],
+// sort=["id","ASC"] and filter={"name":"web"}. The full-text search
+// filter {"q":"..."} of react-admin lists has no column, it is ignored.
+func restQuery(q map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(q))
+	for k, v := range q {
+		out[k] = v
+	}
+	var r []int
+	if q["range"] != nil && json.Unmarshal([]byte(q["range"][0]), &r) == nil && len(r) == 2 && r[0] >= 0 && r[1] >= r[0] {
+		out["_start"] = []string{strconv.Itoa(r[0] + 1)} // from 0 included, _start from 1
+		out["_end"] = []string{strconv.Itoa(r[1] + 1)}
+	}
+	var sort []string
+	if q["sort"] != nil && json.Unmarshal([]byte(q["sort"][0]), &sort) == nil && len(sort) == 2 {
+		out["_sortField"] = []string{sort[0]}
+		out["_sortDir"] = []string{strings.ToUpper(sort[1])}
+	}
+	if q["filter"] != nil && q["_filters"] == nil {
+		out["_filters"] = q["filter"]
+		filter := make(map[string]interface{})
+		if json.Unmarshal([]byte(q["filter"][0]), &filter) == nil && filter["q"] != nil {
+			delete(filter, "q")
+			b, _ := json.Marshal(filter)
+			out["_filters"] = []string{string(b)}
+		}
+	}
+	return out
+}
+
+// firstRecord index from 0 of the first record selected by ParseQuery limit
+func firstRecord(q map[string][]string) int {
+	q = jsonapiQuery(restQuery(q))
+	valid := regexp.MustCompile("^[0-9]+$")
+	get := func(k string) (int, bool) {
+		if q[k] == nil || !valid.MatchString(q[k][0]) {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(q[k][0])
+		return n, true
+	}
+	start, okStart := get("_start")
+	end, okEnd := get("_end")
+	if okStart && okEnd && end > start-1 {
+		if start < 1 {
+			return 0
+		}
+		return start - 1
+	}
+	page, _ := get("_page")
+	perPage, _ := get("_perPage")
+	if page > 1 {
+		return (page - 1) * perPage // same OFFSET as ParseQuery
+	}
+	return 0
+}
+
+// exactFilters return conditions of _filters numbers and lists, like
+// {"owner":3} or {"id":[1,2]} of react-admin references
+func exactFilters(q map[string][]string) []string {
+	var conditions []string
+	for col, values := range exactValues(q) {
+		switch len(values) {
+		case 0:
+			conditions = append(conditions, "0") // no match for an empty list
+		case 1:
+			conditions = append(conditions, col+"="+values[0])
+		default:
+			conditions = append(conditions, col+" IN ("+strings.Join(values, ",")+")")
+		}
+	}
+	return conditions
+}
+
+// exactValues return valid numeric and list values of _filters query by
+// column, as SQL literals, an empty list match no record
+func exactValues(q map[string][]string) map[string][]string {
+	exact := make(map[string][]string)
+	if q["_filters"] == nil {
+		return exact
+	}
+	data := make(map[string]interface{})
+	if json.Unmarshal([]byte(q["_filters"][0]), &data) != nil {
+		return exact
+	}
+	validCol := regexp.MustCompile("^[A-Za-z0-9_]+$")
+	validValue := regexp.MustCompile("^[A-Za-z0-9_.:]+$")
+	value := func(v interface{}) (string, bool) {
+		switch v := v.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case string:
+			return "\"" + v + "\"", validValue.MatchString(v)
+		}
+		return "", false
+	}
+	for col, v := range data {
+		if !validCol.MatchString(col) {
+			continue
+		}
+		switch v := v.(type) {
+		case float64:
+			s, _ := value(v)
+			exact[col] = []string{s}
+		case []interface{}:
+			values := []string{}
+			for _, item := range v {
+				if s, ok := value(item); ok {
+					values = append(values, s)
+				}
+			}
+			exact[col] = values
+		}
+	}
+	return exact
+}
+
+// parseFilters return valid column and search values of _filters query
+func parseFilters(q map[string][]string) map[string]string {
+	filters := make(map[string]string)
+	if q["_filters"] != nil {
+		data := make(map[string]interface{})
+		err := json.Unmarshal([]byte(q["_filters"][0]), &data)
+		if err == nil {
+			valid := regexp.MustCompile("^[A-Za-z0-9_]+$")
+			validSearch := regexp.MustCompile("^[A-Za-z0-9_.:/@]+$") // paths like /etc, mails, quoted by ParseQuery
+			for col, v := range data {
+				search, ok := v.(string) // operators like {"cidr":...} are read by ipFilters
+				if ok && col != "" && search != "" && valid.MatchString(col) && validSearch.MatchString(search) {
+					filters[col] = search
+				}
+			}
+		}
+	}
+	return filters
+}
+
 func checkErr(err error, msg string) {
 	if err != nil {
 		log.Fatalln(msg, err)
@@ -7,6 +7,7 @@ package models
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"log/slog"
 	"os"
 )
 
@@ -20,19 +21,16 @@ func deleteFile(file string) {
 }
 
 type Config struct {
-	DBname  string
-	Verbose bool
+	DBname string
+	Logger *slog.Logger
 }
 
 func SetConfig(config Config) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Set("Verbose", config.Verbose)
-		c.Next()
-	}
+	return Logger(config.Logger)
 }
 
 // Set test config
 var config = Config{
-	DBname:  "_test.sqlite3",
-	Verbose: true,
+	DBname: "_test.sqlite3",
+	Logger: slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})),
 }
@@ -3,6 +3,9 @@ package main
 import (
 	. "./models"
 
+	"context"
+	"log/slog"
+	"os"
 	"time"
 	"github.com/gin-gonic/gin"
 	"github.com/itsjamie/gin-cors"
@@ -12,7 +15,6 @@ import (
 func SetConfig() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Set("CorsOrigin", "*")
-		c.Set("Verbose", true)
 		c.Next()
 	}
 }
@@ -20,8 +22,28 @@ func SetConfig() gin.HandlerFunc {
 func main() {
 	r := gin.Default()
 
-	r.Use(Database("test.sqlite3"))
+	dbmap := InitDb("test.sqlite3")
+	metrics := NewMetrics()
+	metrics.WatchDb(dbmap, "test")
+
+	r.Use(metrics.Middleware())
+	r.Use(DatabaseMap(dbmap))
+	dispatcher := NewDispatcher()
+	bus := NewBus(1000)
+	r.Use(dispatcher.Middleware())
+	r.Use(bus.Middleware())
+	sweeper := NewSweeper(dbmap, 5*time.Minute)
+	sweeper.Bus = bus
+	sweeper.Webhooks = dispatcher
+	go sweeper.Run(context.Background())
+
+	backups := NewBackups(dbmap, "backups")
+	backups.Sweeper = sweeper // paused during restores, like delivery logs
+	backups.Webhooks = dispatcher
+	r.Use(backups.Middleware())
 	r.Use(SetConfig())
+	r.Use(SetMailer(NewSMTPMailer("localhost:25", "noreply@example.org", "", ""), "https://example.org/api/v1/account"))
+	r.Use(Logger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))))
 	r.Use(cors.Middleware(cors.Config{
 		Origins:         "*",
 		Methods:         "GET, PUT, POST, DELETE",
@@ -32,23 +54,71 @@ func main() {
 		ValidateHeaders: false,
 	}))
 
+	r.GET("/metrics", metrics.Export)
+
+	// keys with scope admin, first one by: ginadmin apikey create -user admin@example.org -name cli -scopes admin,apikeys
+	admin := r.Group("admin", APIKeyAuth())
+	{
+		admin.GET("/backups", backups.GetBackups)
+		admin.POST("/backups", backups.PostBackup)
+		admin.GET("/backups/:name", backups.GetBackup)
+		admin.POST("/restore", backups.PostRestore)
+		admin.GET("/config", GetAdminConfig)
+	}
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", Readyz)
+	r.POST("/graphql", GraphQL)
+
 	v1 := r.Group("api/v1")
+	// several customers in one database: v1.Use(Tenant(TenantHeader("X-Tenant"), TenantSubdomain("example.org")))
+	// or one database per customer: v1.Use(DatabasePerTenant("data/%s.sqlite3", 50, TenantHeader("X-Tenant")))
 	{
+		v1.GET("/users/_stream", StreamUsers)
 		v1.GET("/users", GetUsers)
 		v1.GET("/users/:id", GetUser)
 		v1.POST("/users", PostUser)
 		v1.PUT("/users/:id", UpdateUser)
 		v1.DELETE("/users/:id", DeleteUser)
+		v1.POST("/users/:id/transition", PostUserTransition)
+		v1.GET("/users/:id/transitions", GetUserTransitions)
 		v1.OPTIONS("/users", Options)     // POST
 		v1.OPTIONS("/users/:id", Options) // PUT, DELETE
 
+		v1.POST("/account/signup", PostSignup)
+		v1.POST("/account/verify", PostVerifyRequest)
+		v1.GET("/account/verify/confirm", VerifyConfirm)
+		v1.POST("/account/verify/confirm", VerifyConfirm)
+		v1.POST("/account/reset", PostResetRequest)
+		v1.POST("/account/reset/confirm", PostResetConfirm)
+
+		v1.GET("/live", Live)
+
+		// apikeys:write keys, first one by: ginadmin apikey create -user admin@example.org -name cli -scopes '*'
+		v1.GET("/apikeys", APIKeyAuth(), GetAPIKeys)
+		v1.POST("/apikeys", APIKeyAuth(), PostAPIKey)
+		v1.DELETE("/apikeys/:id", APIKeyAuth(), DeleteAPIKey)
+
+		v1.GET("/webhooks", GetWebhooks)
+		v1.POST("/webhooks", PostWebhook)
+		v1.DELETE("/webhooks/:id", DeleteWebhook)
+		v1.GET("/webhooks/:id/deliveries", GetWebhookDeliveries)
+
+		v1.GET("/agents/_stream", StreamAgents)
 		v1.GET("/agents", GetAgents)
 		v1.GET("/agents/:id", GetAgent)
 		v1.POST("/agents", PostAgent)
 		v1.PUT("/agents/:id", UpdateAgent)
 		v1.DELETE("/agents/:id", DeleteAgent)
+		v1.POST("/agents/:id/heartbeat", APIKeyAuth(), PostAgentHeartbeat) // agents call with their own key
+		v1.POST("/agents/:id/transition", PostAgentTransition)
+		v1.GET("/agents/:id/transitions", GetAgentTransitions)
+		v1.POST("/agents/:id/files", APIKeyAuth(), PostAgentFiles)
+		v1.GET("/agents/:id/files", GetAgentFiles)
+		v1.GET("/agents/:id/file-changes", GetAgentFileChanges)
 		v1.OPTIONS("/agents", Options)     // POST
 		v1.OPTIONS("/agents/:id", Options) // PUT, DELETE
+
+		// ginmodel:routes, ginmodel -routes adds routes of new models above
 	}
 
 	r.Run("localhost:8088")
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"io"
+	"strconv"
+	"time"
+)
+
+// keepalive delay between comments sent to idle streams
+var keepalive = 15 * time.Second
+
+// StreamAgents push agent changes as server-sent events
+func StreamAgents(c *gin.Context) {
+	stream(c, "agent")
+
+	// curl -i -N http://localhost:8080/api/v1/agents/_stream?_filters={\"status\":\"offline\"}
+}
+
+// StreamUsers push user changes as server-sent events
+func StreamUsers(c *gin.Context) {
+	stream(c, "user")
+
+	// curl -i -N http://localhost:8080/api/v1/users/_stream
+}
+
+// stream send created, updated and deleted events of resource matching
+// _filters, resume after Last-Event-ID from the bus buffer
+func stream(c *gin.Context, resource string) {
+	bus := c.MustGet("Bus").(*Bus)
+	defer unquiesce(c)()
+	if err := checkFilters(resource, c.Request.URL.Query()); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	filters := newRecordFilter(c.Request.URL.Query())
+
+	last := c.GetHeader("Last-Event-ID")
+	if last == "" {
+		last = c.Query("lastEventId")
+	}
+	since, _ := strconv.ParseUint(last, 10, 64)
+
+	ch, missed := bus.Subscribe(since, 64)
+	defer bus.Unsubscribe(ch)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	for _, e := range missed {
+		sendEvent(c, resource, filters, e)
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok { // too slow, client may resume with Last-Event-ID
+				return false
+			}
+			sendEvent(c, resource, filters, e)
+			return true
+		case <-ticker.C:
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func sendEvent(c *gin.Context, resource string, filters recordFilter, e Event) {
+	if !e.Change() || !e.Visible(tenantOf(c)) || !e.matches(resource, filters) {
+		return
+	}
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(e.Id, 10),
+		Event: e.Action(),
+		Data:  e.Data,
+	})
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	Id, Event, Data string
+}
+
+// readEvents parse a server-sent events stream
+func readEvents(resp *http.Response) chan sseEvent {
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id:"):
+				e.Id = strings.TrimSpace(line[3:])
+			case strings.HasPrefix(line, "event:"):
+				e.Event = strings.TrimSpace(line[6:])
+			case strings.HasPrefix(line, "data:"):
+				e.Data = strings.TrimSpace(line[5:])
+			case line == "" && e.Event != "":
+				events <- e
+				e = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events chan sseEvent) sseEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Error("no event received")
+		return sseEvent{}
+	}
+}
+
+func TestStream(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+	router.Use(NewBus(100).Middleware())
+
+	var urla = "/api/v1/agents"
+	router.GET(urla+"/_stream", StreamAgents)
+	router.GET(urla+"/:id", GetAgent)
+	router.POST(urla, PostAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func(a Agent) {
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(a)
+		resp, err := http.Post(server.URL+urla, "application/json", b)
+		assert.Nil(t, err, "http POST")
+		assert.Equal(t, 201, resp.StatusCode, "http POST success")
+		resp.Body.Close()
+	}
+
+	log.Println("= Subscribe with filters")
+	filters := url.QueryEscape(`{"name":"web"}`)
+	stream, err := http.Get(server.URL + urla + "/_stream?_filters=" + filters)
+	assert.Nil(t, err, "http GET stream")
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"), "event stream")
+	events := readEvents(stream)
+
+	post(Agent{Name: "web1", IP: "10.0.0.1"})
+	post(Agent{Name: "db1", IP: "10.0.0.1"})
+	post(Agent{Name: "web2", IP: "10.0.0.1"})
+
+	e := nextEvent(t, events)
+	assert.Equal(t, "created", e.Event, "created event")
+	assert.Contains(t, e.Data, `"name":"web1"`, "web1 record")
+	e = nextEvent(t, events)
+	assert.Equal(t, "3", e.Id, "db1 filtered out")
+	assert.Contains(t, e.Data, `"name":"web2"`, "web2 record")
+	stream.Body.Close()
+
+	log.Println("= Resume with Last-Event-ID")
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(Agent{Name: "web1 renamed", IP: "10.0.0.1"})
+	req, _ := http.NewRequest("PUT", server.URL+urla+"/1", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, "http PUT")
+	assert.Equal(t, 200, resp.StatusCode, "http PUT success")
+	resp.Body.Close()
+
+	req, _ = http.NewRequest("GET", server.URL+urla+"/_stream?_filters="+filters, nil)
+	req.Header.Set("Last-Event-ID", "3")
+	stream, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err, "http GET stream")
+	events = readEvents(stream)
+	e = nextEvent(t, events)
+	assert.Equal(t, "updated", e.Event, "missed event")
+	assert.Equal(t, "4", e.Id, "missed event id")
+	assert.Contains(t, e.Data, `"name":"web1 renamed"`, "updated record")
+
+	post(Agent{Name: "web3", IP: "10.0.0.1"})
+	e = nextEvent(t, events)
+	assert.Equal(t, "created", e.Event, "live event after resume")
+	assert.Contains(t, e.Data, `"name":"web3"`, "web3 record")
+	stream.Body.Close()
+
+	log.Println("= Subscribe to a subnet")
+	filters = url.QueryEscape(`{"ip":{"cidr":"10.2.0.0/16"}}`)
+	stream, err = http.Get(server.URL + urla + "/_stream?_filters=" + filters)
+	assert.Nil(t, err, "http GET stream")
+	events = readEvents(stream)
+	post(Agent{Name: "web4", IP: "10.0.0.4"})
+	post(Agent{Name: "web5", IP: "10.2.0.5"})
+	e = nextEvent(t, events)
+	assert.Contains(t, e.Data, `"name":"web5"`, "agent of the subnet")
+	stream.Body.Close()
+
+	resp, _ = http.Get(server.URL + urla + "/_stream?_filters=" + url.QueryEscape(`{"name":{"cidr":"10.0.0.0/8"}}`))
+	assert.Equal(t, 400, resp.StatusCode, "no address operators on name")
+	resp.Body.Close()
+
+	log.Println("= Subscribe to an owner")
+	filters = url.QueryEscape(`{"owner":3}`)
+	stream, err = http.Get(server.URL + urla + "/_stream?_filters=" + filters)
+	assert.Nil(t, err, "http GET stream")
+	events = readEvents(stream)
+	post(Agent{Name: "web6", IP: "10.0.0.6", Owner: 2})
+	post(Agent{Name: "web7", IP: "10.0.0.7", Owner: 3})
+	e = nextEvent(t, events)
+	assert.Contains(t, e.Data, `"name":"web7"`, "agent of the owner")
+	stream.Body.Close()
+
+	log.Println("= Subscribe to a list of ids")
+	filters = url.QueryEscape(`{"id":[9,11]}`)
+	stream, err = http.Get(server.URL + urla + "/_stream?_filters=" + filters)
+	assert.Nil(t, err, "http GET stream")
+	events = readEvents(stream)
+	post(Agent{Name: "web8", IP: "10.0.0.8"})
+	post(Agent{Name: "web9", IP: "10.0.0.9"})
+	post(Agent{Name: "web10", IP: "10.0.0.10"})
+	post(Agent{Name: "web11", IP: "10.0.0.11"})
+	e = nextEvent(t, events)
+	assert.Contains(t, e.Data, `"name":"web8"`, "first agent of the list")
+	e = nextEvent(t, events)
+	assert.Contains(t, e.Data, `"name":"web10"`, "second agent of the list")
+	stream.Body.Close()
+
+	log.Println("= Route still reachable by id")
+	resp, _ = http.Get(server.URL + urla + "/1")
+	assert.Equal(t, 200, resp.StatusCode, "http GET one success")
+	resp.Body.Close()
+}
@@ -0,0 +1,257 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StateMachine allowed values of a Status field and transitions between them
+type StateMachine struct {
+	Initial     string              // status of new records without one
+	Transitions map[string][]string // from -> allowed targets, every state is a key
+	Guards      map[string]Guard    // target -> extra check of the record
+}
+
+// Guard check a record may enter a state from its previous status
+type Guard func(record interface{}, from string) error
+
+// Stateful models with a state machine on their Status field
+type Stateful interface {
+	States() *StateMachine
+}
+
+// TransitionError a status change not allowed by a state machine
+type TransitionError struct {
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("transition from %q to %q not allowed", e.From, e.To)
+}
+
+// StatusTransition db and json type of a status change of one record
+type StatusTransition struct {
+	Id       int64     `db:"id" json:"id"`
+	Resource string    `db:"resource" json:"resource"` // agent
+	RecordId int64     `db:"recordid" json:"recordid"`
+	From     string    `db:"fromstatus" json:"from"`
+	To       string    `db:"tostatus" json:"to"`
+	User     string    `db:"user" json:"user"`
+	Reason   string    `db:"reason, size:1024" json:"reason"`
+	Created  time.Time `db:"created" json:"created"`
+}
+
+// PreInsert set created time before insert in db
+func (a *StatusTransition) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	return nil
+}
+
+// States sorted names of states
+func (sm *StateMachine) States() []string {
+	states := make([]string, 0, len(sm.Transitions))
+	for s := range sm.Transitions {
+		states = append(states, s)
+	}
+	sort.Strings(states)
+	return states
+}
+
+// Valid return true for a state of the machine
+func (sm *StateMachine) Valid(state string) bool {
+	_, ok := sm.Transitions[state]
+	return ok
+}
+
+// Can return true if transitions allow from -> to, records with
+// an unknown status, set before the machine, may move to any state
+func (sm *StateMachine) Can(from string, to string) bool {
+	if !sm.Valid(to) {
+		return false
+	}
+	if from == to || !sm.Valid(from) {
+		return true
+	}
+	return contains(sm.Transitions[from], to)
+}
+
+// Check status change of record from its previous status, guards included
+func (sm *StateMachine) Check(record interface{}, from string, to string) error {
+	if !sm.Valid(to) {
+		return errors.New("unknown status " + strconv.Quote(to) + ", use one of " + strings.Join(sm.States(), ", "))
+	}
+	if from == to {
+		return nil
+	}
+	if !sm.Can(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+	if g := sm.Guards[to]; g != nil {
+		return g(record, from)
+	}
+	return nil
+}
+
+// checkStatus enforce state machine of a stateful record before Insert,
+// previous is nil, or Update: an empty status is set to initial or kept,
+// guards of the new status apply in both cases
+func checkStatus(record interface{}, previous interface{}) error {
+	st, ok := record.(Stateful)
+	if !ok {
+		return nil
+	}
+	sm := st.States()
+	rv := reflect.Indirect(reflect.ValueOf(record))
+	status := statusField(rv)
+	if !status.IsValid() {
+		return nil
+	}
+
+	if previous == nil {
+		if status.String() == "" {
+			status.SetString(sm.Initial)
+		}
+		return sm.Check(record, "", status.String())
+	}
+
+	from := statusField(reflect.Indirect(reflect.ValueOf(previous))).String()
+	if status.String() == "" {
+		status.SetString(from)
+	}
+	return sm.Check(record, from, status.String())
+}
+
+// statusField settable field with db column status
+func statusField(rv reflect.Value) reflect.Value {
+	for i := 0; i < rv.NumField(); i++ {
+		if strings.TrimSpace(strings.Split(rv.Type().Field(i).Tag.Get("db"), ",")[0]) == "status" {
+			return rv.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// recordTransition store status change of a record, called by notify,
+// t carries the user and reason, like "Reason" set by handlers
+func recordTransition(dbmap *gorp.DbMap, l *slog.Logger, t StatusTransition, resource string, data interface{}, previous interface{}) {
+	rv := reflect.Indirect(reflect.ValueOf(data))
+	if rv.Kind() != reflect.Struct || !statusField(rv).IsValid() {
+		return
+	}
+	if _, ok := reflect.New(rv.Type()).Interface().(Stateful); !ok {
+		return
+	}
+	t.Resource = resource
+	t.To = statusField(rv).String()
+	if previous != nil {
+		t.From = statusField(reflect.Indirect(reflect.ValueOf(previous))).String()
+	}
+	if t.From == t.To {
+		return
+	}
+	for i := 0; i < rv.NumField(); i++ {
+		if rv.Type().Field(i).Tag.Get("db") == "id" {
+			t.RecordId = rv.Field(i).Int()
+		}
+	}
+
+	if err := dbmap.Insert(&t); err != nil {
+		l.Warn("transition history failed", "resource", resource, "id", t.RecordId, "error", err)
+	}
+}
+
+// errorStatus http status of a validation error, 409 for a forbidden
+// transition, by PUT or transition endpoints
+func errorStatus(err error) int {
+	var te *TransitionError
+	if errors.As(err, &te) {
+		return 409
+	}
+	return 400
+}
+
+// TransitionRequest body of transition endpoints
+type TransitionRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// transition change status of one record of model, 409 on a forbidden transition
+func transition(c *gin.Context, m Model) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	record, err := getRecord(c, m, id)
+	if err != nil {
+		renderError(c, 404, m.Resource()+" not found")
+		return
+	}
+	var req TransitionRequest
+	if bind(c, &req) != nil {
+		return
+	}
+	if req.Status == "" {
+		renderError(c, 400, "mandatory fields are empty")
+		return
+	}
+
+	previous := reflect.ValueOf(record).Elem().Interface()
+	statusField(reflect.ValueOf(record).Elem()).SetString(req.Status)
+	if err = checkStatus(record, previous); err != nil {
+		renderError(c, errorStatus(err), err.Error())
+		return
+	}
+
+	start := time.Now()
+	_, err = dbmap.Update(record)
+	trace(c, "UPDATE "+m.Resource()+" status id="+id, start, err)
+	if err != nil {
+		renderUnavailable(c, "transition failed", err)
+		return
+	}
+	invalidate(c, m.Resource())
+	c.Set("Reason", req.Reason)
+	notify(c, m.Resource(), "updated", reflect.ValueOf(record).Elem().Interface(), previous)
+	render(c, 200, record)
+}
+
+// transitions return status history of one record, last first
+func transitions(c *gin.Context, m Model) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	if _, err := getRecord(c, m, id); err != nil { // history of a record of the tenant
+		renderError(c, 404, m.Resource()+" not found")
+		return
+	}
+	if err := checkFilters("statustransition", c.Request.URL.Query()); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	s, o, l := ParseQuery(c.Request.URL.Query())
+	where := " WHERE resource=? AND recordid=?"
+	if s != "" {
+		where = where + " AND " + s
+	}
+	if o == "" {
+		o = " ORDER BY id DESC"
+	}
+	count, _ := dbmap.SelectInt("SELECT COUNT(*) FROM statustransition"+where, m.Resource(), id)
+
+	var history []StatusTransition
+	_, err := dbmap.Select(&history, "SELECT * FROM statustransition"+where+o+l, m.Resource(), id)
+	if err == nil {
+		c.Header("X-Total-Count", strconv.FormatInt(count, 10))
+		render(c, 200, history)
+	} else {
+		renderError(c, 404, "no transition(s) into the table")
+	}
+}
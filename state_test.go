@@ -0,0 +1,139 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStateMachine(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+
+	var urla = "/api/v1/agents"
+	router.POST(urla, PostAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+	router.POST(urla+"/:id/heartbeat", PostAgentHeartbeat)
+	router.POST(urla+"/:id/transition", PostAgentTransition)
+	router.GET(urla+"/:id/transitions", GetAgentTransitions)
+	var urlu = "/api/v1/users"
+	router.POST(urlu, PostUser)
+	router.POST(urlu+"/:id/transition", PostUserTransition)
+
+	do := func(method string, path string, body interface{}) (*httptest.ResponseRecorder, Agent) {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var a Agent
+		json.Unmarshal(resp.Body.Bytes(), &a)
+		return resp, a
+	}
+
+	// Create
+	log.Println("= Create with initial or valid status")
+	resp, a := do("POST", urla, Agent{Name: "web1", IP: "10.0.0.1"})
+	assert.Equal(t, 201, resp.Code, "http POST success")
+	assert.Equal(t, AgentNew, a.Status, "initial status")
+	resp, a = do("POST", urla, Agent{Name: "web2", IP: "10.0.0.1", Status: AgentMaintenance})
+	assert.Equal(t, AgentMaintenance, a.Status, "valid status")
+	resp, _ = do("POST", urla, Agent{Name: "web3", IP: "10.0.0.1", Status: "onlin"})
+	assert.Equal(t, 400, resp.Code, "http POST unknown status")
+	assert.Contains(t, resp.Body.String(), "use one of decommissioned, maintenance, new, offline, online", "known states")
+
+	// Update
+	log.Println("= Update enforces transitions")
+	resp, a = do("PUT", urla+"/1", Agent{Name: "web1", IP: "10.0.0.1"})
+	assert.Equal(t, 200, resp.Code, "http PUT without status")
+	assert.Equal(t, AgentNew, a.Status, "status kept")
+	resp, a = do("PUT", urla+"/1", Agent{Name: "web1", IP: "10.0.0.1", Status: AgentDecommissioned})
+	assert.Equal(t, 200, resp.Code, "http PUT allowed transition")
+	resp, _ = do("PUT", urla+"/1", Agent{Name: "web1", IP: "10.0.0.1", Status: AgentOnline})
+	assert.Equal(t, 409, resp.Code, "http PUT decommissioned back online, as transition")
+	assert.Contains(t, resp.Body.String(), `transition from \"decommissioned\" to \"online\" not allowed`, "error")
+
+	log.Println("= Heartbeat does not revive decommissioned agent")
+	_, a = do("POST", urla+"/1/heartbeat", nil)
+	assert.Equal(t, AgentDecommissioned, a.Status, "still decommissioned")
+
+	// Transition endpoint
+	log.Println("= Transition endpoint")
+	resp, a = do("POST", urla+"/2/transition", TransitionRequest{Status: AgentOnline, Reason: "back from repair"})
+	assert.Equal(t, 200, resp.Code, "http POST transition")
+	assert.Equal(t, AgentOnline, a.Status, "new status")
+	resp, _ = do("POST", urla+"/2/transition", TransitionRequest{Status: AgentDecommissioned})
+	assert.Equal(t, 409, resp.Code, "http POST forbidden transition")
+	resp, _ = do("POST", urla+"/2/transition", TransitionRequest{Status: "gone"})
+	assert.Equal(t, 400, resp.Code, "http POST unknown status")
+	resp, _ = do("POST", urla+"/2/transition", TransitionRequest{})
+	assert.Equal(t, 400, resp.Code, "http POST missing status")
+	resp, _ = do("POST", urla+"/9/transition", TransitionRequest{Status: AgentOnline})
+	assert.Equal(t, 404, resp.Code, "http POST missing agent")
+
+	log.Println("= Guards")
+	AgentStates.Guards = map[string]Guard{
+		AgentOffline: func(record interface{}, from string) error {
+			if record.(*Agent).Role == "" {
+				return errors.New("role is required to go offline")
+			}
+			return nil
+		},
+		AgentOnline: func(record interface{}, from string) error {
+			if record.(*Agent).Role == "frozen" {
+				return errors.New("frozen agents stay offline")
+			}
+			return nil
+		},
+	}
+	defer func() { AgentStates.Guards = nil }()
+	resp, _ = do("POST", urla+"/2/transition", TransitionRequest{Status: AgentOffline})
+	assert.Equal(t, 400, resp.Code, "http POST guard refused")
+	assert.Contains(t, resp.Body.String(), "role is required", "guard error")
+	resp, a = do("PUT", urla+"/2", Agent{Name: "web2", IP: "10.0.0.1", Role: "db", Status: AgentOffline})
+	assert.Equal(t, 200, resp.Code, "http PUT guard accepted")
+	assert.Equal(t, AgentOffline, a.Status, "offline")
+	resp, _ = do("POST", urla, Agent{Name: "web4", IP: "10.0.0.1", Status: AgentOffline})
+	assert.Equal(t, 400, resp.Code, "http POST guard refused on create")
+	resp, _ = do("POST", urla, Agent{Name: "web5", IP: "10.0.0.1", Role: "frozen", Status: AgentOffline})
+	assert.Equal(t, 201, resp.Code, "http POST guard accepted on create")
+	resp, a = do("POST", urla+"/3/heartbeat", nil)
+	assert.Equal(t, 200, resp.Code, "http POST heartbeat")
+	assert.Equal(t, AgentOffline, a.Status, "heartbeat kept by guard")
+
+	// History
+	log.Println("= Transition history")
+	var history []StatusTransition
+	resp, _ = do("GET", urla+"/2/transitions", nil)
+	assert.Equal(t, "3", resp.Header().Get("X-Total-Count"), "history count")
+	json.Unmarshal(resp.Body.Bytes(), &history)
+	assert.Equal(t, AgentOnline, history[0].From, "last first")
+	assert.Equal(t, AgentOffline, history[0].To, "last first")
+	assert.Equal(t, "back from repair", history[1].Reason, "reason")
+	assert.Equal(t, "", history[2].From, "creation")
+	assert.Equal(t, AgentMaintenance, history[2].To, "creation")
+	resp, _ = do("GET", urla+"/1/transitions?_filters="+`{"tostatus":"decommissioned"}`, nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "history filter")
+
+	// Users
+	log.Println("= User state machine")
+	resp, _ = do("POST", urlu, User{Name: "user1"})
+	assert.Equal(t, 201, resp.Code, "http POST user")
+	resp, _ = do("POST", urlu+"/1/transition", TransitionRequest{Status: UserPending})
+	assert.Equal(t, 409, resp.Code, "http POST active back to pending")
+	resp, _ = do("POST", urlu+"/1/transition", TransitionRequest{Status: UserDisabled})
+	assert.Equal(t, 200, resp.Code, "http POST disable user")
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"github.com/gin-gonic/gin"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// tenant names are inlined in SQL conditions, keep them simple
+var tenantFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// TenantResolver return the tenant of a request, "" when it does not know
+type TenantResolver func(c *gin.Context) string
+
+// TenantHeader read tenant from a request header, like X-Tenant
+func TenantHeader(name string) TenantResolver {
+	return func(c *gin.Context) string {
+		return strings.ToLower(strings.TrimSpace(c.GetHeader(name)))
+	}
+}
+
+// TenantSubdomain read tenant from the first label of hosts under domain:
+// acme for acme.example.org
+func TenantSubdomain(domain string) TenantResolver {
+	return func(c *gin.Context) string {
+		host := c.Request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		sub := strings.TrimSuffix(strings.ToLower(host), "."+strings.ToLower(domain))
+		if sub == host || strings.Contains(sub, ".") {
+			return ""
+		}
+		return sub
+	}
+}
+
+// TenantKey read tenant claim of the API key set by APIKeyAuth
+func TenantKey() TenantResolver {
+	return func(c *gin.Context) string {
+		if v, ok := c.Get("APIKey"); ok {
+			return v.(APIKey).Tenant
+		}
+		return ""
+	}
+}
+
+// Tenant gin Middlware to scope rows of tenanted tables, like Agent and
+// User, to the tenant of the request: first resolver with a value wins.
+// Set it after APIKeyAuth, a key only reaches the tenant of its owner.
+func Tenant(resolvers ...TenantResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !resolveTenant(c, resolvers) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// resolveTenant set Tenant of request, or abort with 400 or 403
+func resolveTenant(c *gin.Context, resolvers []TenantResolver) bool {
+	tenant := ""
+	for _, r := range resolvers {
+		if tenant = r(c); tenant != "" {
+			break
+		}
+	}
+	if !tenantFormat.MatchString(tenant) {
+		renderError(c, 400, "missing or invalid tenant")
+		c.Abort()
+		return false
+	}
+	if v, ok := c.Get("APIKey"); ok && v.(APIKey).Tenant != tenant {
+		renderError(c, 403, "api key is not valid for tenant "+tenant)
+		c.Abort()
+		return false
+	}
+	c.Set("Tenant", tenant)
+	return true
+}
+
+// tenantOf return tenant of request, "" without Tenant middleware
+func tenantOf(c *gin.Context) string {
+	return c.GetString("Tenant")
+}
+
+// tenanted return true if table has a tenant column
+func tenanted(table string) bool {
+	m, ok := ModelFor(table)
+	if !ok {
+		return false
+	}
+	_, ok = m.Type.FieldByName("Tenant")
+	return ok
+}
+
+// tenantScope add tenant condition to where conditions s of table:
+// "id=?" becomes "tenant='acme' AND id=?"
+func tenantScope(c *gin.Context, table string, s string) string {
+	tenant := tenantOf(c)
+	if tenant == "" || !tenanted(table) {
+		return s
+	}
+	cond := "tenant='" + tenant + "'" // checked by tenantFormat
+	if s == "" {
+		return cond
+	}
+	return cond + " AND " + s
+}
+
+// setTenant set tenant of request into a new record
+func setTenant(c *gin.Context, record interface{}) {
+	f := reflect.Indirect(reflect.ValueOf(record)).FieldByName("Tenant")
+	if f.IsValid() && f.Kind() == reflect.String && f.CanSet() {
+		f.SetString(tenantOf(c))
+	}
+}
+
+// recordTenant return tenant of a record, "" if it has none
+func recordTenant(record interface{}) string {
+	rv := reflect.Indirect(reflect.ValueOf(record))
+	if rv.Kind() != reflect.Struct {
+		return ""
+	}
+	f := rv.FieldByName("Tenant")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTenantScope(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	router.Use(NewCache(time.Minute).Middleware())
+	router.Use(Tenant(TenantHeader("X-Tenant")))
+
+	var urla = "/api/v1/agents"
+	router.GET(urla, GetAgents)
+	router.GET(urla+"/:id", GetAgent)
+	router.POST(urla, PostAgent)
+	router.PUT(urla+"/:id", UpdateAgent)
+	router.DELETE(urla+"/:id", DeleteAgent)
+	router.POST(urla+"/:id/heartbeat", PostAgentHeartbeat)
+	router.GET(urla+"/:id/transitions", GetAgentTransitions)
+	router.GET(urla+"/:id/files", GetAgentFiles)
+	router.POST("/api/v1/users", PostUser)
+	router.GET("/api/v1/users", GetUsers)
+	router.POST("/graphql", GraphQL)
+
+	do := func(method string, path string, tenant string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	log.Println("= Tenant is required")
+	resp := do("GET", urla, "", nil)
+	assert.Equal(t, 400, resp.Code, "no tenant")
+	resp = do("GET", urla, "acme'--", nil)
+	assert.Equal(t, 400, resp.Code, "invalid tenant")
+
+	log.Println("= Create rows of two tenants")
+	do("POST", urla, "acme", Agent{Name: "web1", IP: "10.0.0.1"})
+	do("POST", urla, "acme", Agent{Name: "web2", IP: "10.0.0.2"})
+	do("POST", urla, "Globex", Agent{Name: "web1", IP: "10.0.0.1"}) // header is lower cased
+	do("POST", "/api/v1/users", "globex", User{Name: "Thea"})
+	var tenant string
+	tenant, _ = dbmap.SelectStr("SELECT tenant FROM agent WHERE id=3")
+	assert.Equal(t, "globex", tenant, "tenant set from header")
+
+	// Lists
+	log.Println("= Lists only show rows of the tenant")
+	resp = do("GET", urla, "acme", nil)
+	assert.Equal(t, "2", resp.Header().Get("X-Total-Count"), "acme count")
+	acmeTag := resp.Header().Get("ETag")
+	resp = do("GET", urla+"?_filters={\"name\":\"web1\"}", "acme", nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "acme filter count")
+	resp = do("GET", urla, "globex", nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "globex count from same cached query")
+	assert.NotEqual(t, acmeTag, resp.Header().Get("ETag"), "etag per tenant")
+	assert.NotContains(t, resp.Body.String(), "tenant", "tenant not serialized")
+	resp = do("GET", "/api/v1/users", "acme", nil)
+	assert.Equal(t, "0", resp.Header().Get("X-Total-Count"), "acme users")
+
+	// Records of another tenant
+	log.Println("= Records of another tenant are not found")
+	resp = do("GET", urla+"/3", "acme", nil)
+	assert.Equal(t, 404, resp.Code, "http GET other tenant")
+	resp = do("PUT", urla+"/3", "acme", Agent{Name: "stolen", IP: "10.0.0.3"})
+	assert.Equal(t, 404, resp.Code, "http PUT other tenant")
+	resp = do("DELETE", urla+"/3", "acme", nil)
+	assert.Equal(t, 404, resp.Code, "http DELETE other tenant")
+	resp = do("POST", urla+"/3/heartbeat", "acme", nil)
+	assert.Equal(t, 404, resp.Code, "http POST heartbeat other tenant")
+	resp = do("GET", urla+"/3/transitions", "acme", nil)
+	assert.Equal(t, 404, resp.Code, "http GET transitions other tenant")
+	resp = do("GET", urla+"/3/files", "acme", nil)
+	assert.Equal(t, 404, resp.Code, "http GET files other tenant")
+	resp = do("GET", urla+"/3", "globex", nil)
+	assert.Equal(t, 200, resp.Code, "http GET own tenant")
+
+	log.Println("= Update keeps tenant")
+	resp = do("PUT", urla+"/1", "acme", Agent{Name: "web1b", IP: "10.0.0.1"})
+	assert.Equal(t, 200, resp.Code, "http PUT own tenant")
+	tenant, _ = dbmap.SelectStr("SELECT tenant FROM agent WHERE id=1")
+	assert.Equal(t, "acme", tenant, "tenant kept")
+
+	log.Println("= GraphQL is scoped")
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(gin.H{"query": `{ agentsCount agent(id: 3) { name } }`})
+	req, _ := http.NewRequest("POST", "/graphql", b)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant", "acme")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	var r gqlResult
+	json.Unmarshal(resp.Body.Bytes(), &r)
+	assert.Equal(t, float64(2), r.Data["agentsCount"], "graphql count")
+	assert.Equal(t, 1, len(r.Errors), "graphql other tenant not found")
+}
+
+func TestTenantResolvers(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	gin.SetMode(gin.TestMode)
+	dbmap := InitDb(config.DBname)
+
+	log.Println("= Subdomain")
+	sub := TenantSubdomain("example.org")
+	for host, tenant := range map[string]string{
+		"acme.example.org":      "acme",
+		"ACME.example.org:8080": "acme",
+		"example.org":           "",
+		"a.b.example.org":       "",
+		"acme.example.com":      "",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+		c.Request.Host = host
+		assert.Equal(t, tenant, sub(c), host)
+	}
+
+	log.Println("= API key claim")
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(DatabaseMap(dbmap))
+	admin := router.Group("/admin")
+	admin.Use(Tenant(TenantHeader("X-Tenant")))
+	admin.POST("/agents", PostAgent)
+	admin.POST("/apikeys", PostAPIKey)
+	admin.GET("/apikeys", GetAPIKeys)
+	admin.DELETE("/apikeys/:id", DeleteAPIKey)
+	v1 := router.Group("/api/v1")
+	v1.Use(APIKeyAuth(), Tenant(TenantHeader("X-Tenant"), TenantKey()))
+	v1.POST("/agents/:id/heartbeat", PostAgentHeartbeat)
+	v2 := router.Group("/api/v2") // tenant resolved before the key
+	v2.Use(Tenant(TenantHeader("X-Tenant")), APIKeyAuth())
+	v2.POST("/agents/:id/heartbeat", PostAgentHeartbeat)
+
+	send := func(method string, path string, tenant string, key string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	do := func(path string, tenant string, key string, body interface{}) *httptest.ResponseRecorder {
+		return send("POST", path, tenant, key, body)
+	}
+
+	do("/admin/agents", "acme", "", Agent{Name: "web1", IP: "10.0.0.1"})
+	do("/admin/agents", "globex", "", Agent{Name: "web1", IP: "10.0.0.1"})
+	resp := do("/admin/apikeys", "acme", "", APIKey{Name: "other", AgentId: 2, Scopes: "agents"})
+	assert.Equal(t, 400, resp.Code, "key for agent of another tenant")
+	resp = do("/admin/apikeys", "globex", "", APIKey{Name: "web1", AgentId: 2, Scopes: "agents"})
+	assert.Equal(t, 201, resp.Code, "key for agent of tenant")
+	var created struct {
+		Key string
+	}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+
+	resp = do("/api/v1/agents/2/heartbeat", "", created.Key, nil)
+	assert.Equal(t, 200, resp.Code, "tenant from key")
+	resp = do("/api/v1/agents/2/heartbeat", "acme", created.Key, nil)
+	assert.Equal(t, 403, resp.Code, "key used for another tenant")
+	resp = do("/api/v2/agents/2/heartbeat", "globex", created.Key, nil)
+	assert.Equal(t, 200, resp.Code, "key of tenant set before")
+	resp = do("/api/v2/agents/2/heartbeat", "acme", created.Key, nil)
+	assert.Equal(t, 403, resp.Code, "key checked against tenant set before")
+
+	log.Println("= API keys of other tenants are hidden")
+	resp = send("GET", "/admin/apikeys", "acme", "", nil)
+	assert.Equal(t, "0", resp.Header().Get("X-Total-Count"), "no key of acme")
+	assert.NotContains(t, resp.Body.String(), "web1", "key of globex not listed")
+	resp = send("GET", "/admin/apikeys", "globex", "", nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "key of globex")
+	resp = send("DELETE", "/admin/apikeys/1", "acme", "", nil)
+	assert.Equal(t, 404, resp.Code, "key of another tenant not revoked")
+	resp = do("/api/v1/agents/2/heartbeat", "", created.Key, nil)
+	assert.Equal(t, 200, resp.Code, "key still valid")
+
+	log.Println("= Events of other tenants are hidden")
+	e := Event{Event: "agent.created", tenant: "acme"}
+	assert.True(t, e.Visible("acme"), "own tenant")
+	assert.False(t, e.Visible("globex"), "other tenant")
+	assert.True(t, e.Visible(""), "no tenant")
+}
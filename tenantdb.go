@@ -0,0 +1,199 @@
+package models
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"sync"
+	"time"
+)
+
+// TenantPool bounded LRU of opened tenant databases, one sqlite file per
+// tenant, created and migrated on first use
+type TenantPool struct {
+	Pattern string        // db file of tenant, like "data/%s.sqlite3"
+	Size    int           // opened databases, more only while all are in use
+	Idle    time.Duration // unused databases are closed after Idle by Run
+
+	mu  sync.Mutex
+	dbs map[string]*list.Element
+	lru *list.List // front is last used
+}
+
+type tenantDb struct {
+	tenant string
+	dbmap  *gorp.DbMap
+	err    error
+	ready  chan struct{} // closed when opened
+	refs   int           // requests using dbmap
+	used   time.Time
+}
+
+// NewTenantPool create a pool of size databases from pattern, closed after 10 minutes unused
+func NewTenantPool(pattern string, size int) *TenantPool {
+	return &TenantPool{
+		Pattern: pattern,
+		Size:    size,
+		Idle:    10 * time.Minute,
+		dbs:     make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Middleware gin Middlware to resolve tenant of request and set its database
+func (p *TenantPool) Middleware(resolvers ...TenantResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !resolveTenant(c, resolvers) {
+			return
+		}
+		tenant := tenantOf(c)
+		dbmap, release, err := p.Get(tenant)
+		if err != nil {
+			logger(c).Error("tenant database failed", "error", err)
+			renderError(c, 503, "tenant database unavailable")
+			c.Abort()
+			return
+		}
+		defer release()
+		c.Set("DBmap", dbmap)
+		c.Set("DBRetain", func() func() { // held by this request, Get only adds a ref
+			_, release, err := p.Get(tenant)
+			if err != nil {
+				return func() {}
+			}
+			return release
+		})
+		c.Next()
+	}
+}
+
+// retainDb return a func to take one more reference on the request
+// database, for work going on after the request like webhook deliveries,
+// and to get its release func. Databases outside TenantPool are not closed.
+func retainDb(c *gin.Context) func() func() {
+	if v, ok := c.Get("DBRetain"); ok {
+		return v.(func() func())
+	}
+	return nil
+}
+
+// Get return database of tenant, opened and migrated if needed, and a
+// release func to call when done with it
+func (p *TenantPool) Get(tenant string) (*gorp.DbMap, func(), error) {
+	if !tenantFormat.MatchString(tenant) { // tenant is part of a file name
+		return nil, nil, fmt.Errorf("invalid tenant %q", tenant)
+	}
+
+	p.mu.Lock()
+	el, ok := p.dbs[tenant]
+	if !ok {
+		el = p.lru.PushFront(&tenantDb{tenant: tenant, ready: make(chan struct{})})
+		p.dbs[tenant] = el
+	}
+	t := el.Value.(*tenantDb)
+	t.refs++
+	t.used = time.Now()
+	p.lru.MoveToFront(el)
+	p.mu.Unlock()
+
+	if !ok { // open outside the lock, concurrent requests wait for ready
+		t.dbmap, t.err = openDb(fmt.Sprintf(p.Pattern, tenant))
+		if t.err == nil { // idle connections of an opened database
+			t.dbmap.Db.SetConnMaxIdleTime(p.Idle)
+		}
+		close(t.ready)
+	}
+	<-t.ready
+
+	release := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		t.refs--
+		t.used = time.Now()
+		if t.err != nil && t.refs == 0 && p.dbs[tenant] == el { // retry on next request
+			p.lru.Remove(el)
+			delete(p.dbs, tenant)
+		}
+		p.trim()
+	}
+	if t.err != nil {
+		release()
+		return nil, nil, t.err
+	}
+	return t.dbmap, release, nil
+}
+
+// trim close least recently used databases above Size, with lock held
+func (p *TenantPool) trim() {
+	for el := p.lru.Back(); el != nil && p.lru.Len() > p.Size; {
+		prev := el.Prev()
+		if t := el.Value.(*tenantDb); t.refs == 0 {
+			p.close(el)
+		}
+		el = prev
+	}
+}
+
+// close remove a database from pool, with lock held
+func (p *TenantPool) close(el *list.Element) {
+	t := el.Value.(*tenantDb)
+	p.lru.Remove(el)
+	delete(p.dbs, t.tenant)
+	if t.dbmap != nil {
+		t.dbmap.Db.Close()
+	}
+}
+
+// Evict close databases unused for Idle, return their number
+func (p *TenantPool) Evict() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for el := p.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if t := el.Value.(*tenantDb); t.refs == 0 && time.Since(t.used) > p.Idle {
+			p.close(el)
+			n++
+		}
+		el = prev
+	}
+	return n
+}
+
+// Run evict idle databases every Idle/2 until ctx is done, then close all
+func (p *TenantPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Evict()
+		case <-ctx.Done():
+			p.Close()
+			return
+		}
+	}
+}
+
+// Close close databases not in use, like at shutdown
+func (p *TenantPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := p.Size
+	p.Size = 0
+	p.trim()
+	p.Size = size
+}
+
+// Tenants return tenants of opened databases, last used first
+func (p *TenantPool) Tenants() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var tenants []string
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		tenants = append(tenants, el.Value.(*tenantDb).tenant)
+	}
+	return tenants
+}
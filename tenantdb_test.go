@@ -0,0 +1,154 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTenantPool(t *testing.T) {
+	dir := t.TempDir()
+	pattern := filepath.Join(dir, "%s.sqlite3")
+
+	gin.SetMode(gin.TestMode)
+	pool := NewTenantPool(pattern, 2)
+	defer pool.Close()
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(pool.Middleware(TenantHeader("X-Tenant")))
+	router.GET("/api/v1/agents", GetAgents)
+	router.POST("/api/v1/agents", PostAgent)
+
+	do := func(method string, tenant string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, "/api/v1/agents", b)
+		req.Header.Set("Content-Type", "application/json")
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	log.Println("= One migrated database per tenant")
+	resp := do("POST", "acme", Agent{Name: "web1", IP: "10.0.0.1"})
+	assert.Equal(t, 201, resp.Code, "http POST acme")
+	_, err := os.Stat(filepath.Join(dir, "acme.sqlite3"))
+	assert.Nil(t, err, "acme file")
+	resp = do("GET", "globex", nil)
+	assert.Equal(t, "0", resp.Header().Get("X-Total-Count"), "globex is empty")
+	resp = do("GET", "", nil)
+	assert.Equal(t, 400, resp.Code, "no tenant")
+	resp = do("GET", "../acme", nil)
+	assert.Equal(t, 400, resp.Code, "no path in tenant")
+
+	log.Println("= Least recently used database is closed")
+	assert.Equal(t, []string{"globex", "acme"}, pool.Tenants(), "two opened")
+	do("GET", "initech", nil)
+	assert.Equal(t, []string{"initech", "globex"}, pool.Tenants(), "acme closed")
+	resp = do("GET", "acme", nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "acme reopened with its data")
+	assert.Equal(t, []string{"acme", "initech"}, pool.Tenants(), "globex closed")
+
+	log.Println("= Databases in use are kept")
+	dbmap, release, err := pool.Get("umbrella")
+	assert.Nil(t, err, "get")
+	do("GET", "globex", nil)
+	assert.Equal(t, []string{"globex", "umbrella"}, pool.Tenants(), "umbrella in use")
+	other, release2, _ := pool.Get("umbrella")
+	assert.Equal(t, dbmap, other, "same db")
+	release()
+	release2()
+
+	var wg sync.WaitGroup
+	dbs := make([]interface{}, 8)
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, r, err := pool.Get("hooli")
+			if err == nil {
+				dbs[i] = d
+				r()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, d := range dbs {
+		assert.Equal(t, dbs[0], d, "concurrent first use opens once")
+	}
+
+	log.Println("= Idle databases are evicted")
+	pool.Idle = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, 2, pool.Evict(), "evicted")
+	assert.Empty(t, pool.Tenants(), "none opened")
+}
+
+func TestTenantPoolDeliveries(t *testing.T) {
+	pattern := filepath.Join(t.TempDir(), "%s.sqlite3")
+
+	received := make(chan bool)
+	unblock := make(chan bool)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+		<-unblock
+	}))
+	defer receiver.Close()
+	dispatcher := NewDispatcher()
+	dispatcher.Internal = true
+
+	gin.SetMode(gin.TestMode)
+	pool := NewTenantPool(pattern, 1)
+	defer pool.Close()
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(pool.Middleware(TenantHeader("X-Tenant")))
+	router.Use(dispatcher.Middleware())
+	router.GET("/agents", GetAgents)
+	router.POST("/agents", PostAgent)
+	router.POST("/webhooks", PostWebhook)
+	router.GET("/webhooks/:id/deliveries", GetWebhookDeliveries)
+
+	do := func(method string, path string, tenant string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant", tenant)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	log.Println("= Database kept opened during deliveries")
+	do("POST", "/webhooks", "acme", Webhook{URL: receiver.URL, Events: "agent.*", Secret: "s3cr3t"})
+	resp := do("POST", "/agents", "acme", Agent{Name: "web1", IP: "10.0.0.1"})
+	assert.Equal(t, 201, resp.Code, "http POST agent")
+	<-received
+	do("GET", "/agents", "globex", nil)
+	assert.Equal(t, []string{"acme"}, pool.Tenants(), "acme kept while delivering, globex closed")
+	close(unblock)
+	dispatcher.Wait()
+	resp = do("GET", "/webhooks/1/deliveries", "acme", nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "delivery logged")
+
+	log.Println("= Released after deliveries")
+	do("GET", "/agents", "globex", nil)
+	assert.Equal(t, []string{"globex"}, pool.Tenants(), "acme closed")
+}
@@ -1,10 +1,11 @@
 package models
 
 import (
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"gopkg.in/gorp.v2"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,28 +23,64 @@ or remove sqlite tricks
 // User db and json type
 type User struct {
 	Id      int64     `db:"id" json:"id"`
-	Name    string    `db:"name" json:"name"`
+	Name    string    `db:"name" json:"name" valid:"required"`
 	Email   string    `db:"email" json:"mail"`
 	Status  string    `db:"status" json:"status"`
 	Comment string    `db:"comment, size:16384" json:"comment"`
-	Pass    string    `db:"pass" json:"pass"`
+	Pass    string    `db:"pass" json:"pass,omitempty" log:"redact"`
+	Tenant  string    `db:"tenant" json:"-"`        // set by handlers from Tenant middleware
 	Created time.Time `db:"created" json:"created"` // or int64
 	Updated time.Time `db:"updated" json:"updated"`
 }
 
+// Validate check mandatory fields before Insert and Update
+func (a *User) Validate() error {
+	if len(a.Pass) > 72 && !strings.HasPrefix(a.Pass, "$2a$") {
+		return errors.New("password is too long")
+	}
+	return required(a) // XXX add custom checks
+}
+
+// XXX custom states
+// User status
+const (
+	UserPending  = "pending"
+	UserActive   = "active"
+	UserDisabled = "disabled"
+)
+
+// UserStates allowed Status values and transitions of users
+var UserStates = &StateMachine{
+	Initial: UserActive,
+	Transitions: map[string][]string{
+		UserPending:  {UserActive, UserDisabled},
+		UserActive:   {UserDisabled},
+		UserDisabled: {UserActive},
+	},
+}
+
+// States state machine of Status field
+func (a *User) States() *StateMachine {
+	return UserStates
+}
+
 // Hooks : PreInsert and PreUpdate
 
 // PreInsert set created an updated time before insert in db
 func (a *User) PreInsert(s gorp.SqlExecutor) error {
 	a.Created = time.Now() // or time.Now().UnixNano()
 	a.Updated = a.Created
-	return nil
+	var err error
+	a.Pass, err = hashPass(a.Pass) // bcrypt clear passwords
+	return err
 }
 
 // PreUpdate set updated time before insert in db
 func (a *User) PreUpdate(s gorp.SqlExecutor) error {
 	a.Updated = time.Now()
-	return nil
+	var err error
+	a.Pass, err = hashPass(a.Pass) // bcrypt clear passwords
+	return err
 }
 
 // REST handlers
@@ -51,19 +88,36 @@ func (a *User) PreUpdate(s gorp.SqlExecutor) error {
 // GetUsers return all users filtered by URL query
 func GetUsers(c *gin.Context) {
 	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
-	verbose := c.MustGet("Verbose").(bool)
 	query := "SELECT * FROM user"
 
 	// Parse query string
 	q := c.Request.URL.Query()
+	if err := checkFilters("user", q); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
 	s, o, l := ParseQuery(q)
-	var count int64
+	s = tenantScope(c, "user", s)
+
+	if cached, ok := cacheGet(c, "user", c.Request.URL.RawQuery); ok {
+		if !notModified(c, cached.tag, time.Time{}) {
+			c.Header("X-Total-Count", strconv.FormatInt(cached.count, 10))
+			render(c, 200, cached.data)
+		}
+		return
+	}
+
+	where := ""
 	if s != "" {
-		count, _ = dbmap.SelectInt("SELECT COUNT(*) FROM user  WHERE " + s)
-		query = query + " WHERE " + s
-	} else {
-		count, _ = dbmap.SelectInt("SELECT COUNT(*) FROM user")
+		where = " WHERE " + s
 	}
+	count, updated := listVersion(c, "user", where)
+	tag := etag("user", strconv.FormatInt(count, 10), updated, c.Request.URL.RawQuery)
+	if notModified(c, tag, time.Time{}) { // no Last-Modified, MAX(updated) stays the same after a delete
+		return
+	}
+
+	query = query + where
 	if o != "" {
 		query = query + o
 	}
@@ -71,19 +125,20 @@ func GetUsers(c *gin.Context) {
 		query = query + l
 	}
 
-	if verbose == true {
-		fmt.Println(q)
-		fmt.Println("query: " + query)
-	}
+	logger(c).Debug("list users", "params", q)
 
 	var users []User
+	start := time.Now()
 	_, err := dbmap.Select(&users, query)
+	trace(c, query, start, err)
 
 	if err == nil {
+		countRows(c, len(users))
+		cachePut(c, "user", c.Request.URL.RawQuery, cacheEntry{tag: tag, count: count, data: users})
 		c.Header("X-Total-Count", strconv.FormatInt(count, 10)) // float64 to string
-		c.JSON(200, users)
+		render(c, 200, users)
 	} else {
-		c.JSON(404, gin.H{"error": "no user(s) into the table"})
+		renderError(c, 404, "no user(s) into the table")
 	}
 
 	// curl -i http://localhost:8080/api/v1/users
@@ -95,12 +150,15 @@ func GetUser(c *gin.Context) {
 	id := c.Params.ByName("id")
 
 	var user User
-	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE id=? LIMIT 1", id)
+	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE "+tenantScope(c, "user", "id=?")+" LIMIT 1", id)
 
 	if err == nil {
-		c.JSON(200, user)
+		if notModified(c, etag("user", id, user.Updated.Format(time.RFC3339Nano)), user.Updated) {
+			return
+		}
+		render(c, 200, user)
 	} else {
-		c.JSON(404, gin.H{"error": "user not found"})
+		renderError(c, 404, "user not found")
 	}
 
 	// curl -i http://localhost:8080/api/v1/users/1
@@ -109,25 +167,36 @@ func GetUser(c *gin.Context) {
 // PostUser create and return one user
 func PostUser(c *gin.Context) {
 	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
-	verbose := c.MustGet("Verbose").(bool)
 
 	var user User
-	c.Bind(&user)
-
-	if verbose == true {
-		fmt.Println(user)
+	if bind(c, &user) != nil {
+		return
 	}
 
-	if user.Name != "" { // XXX Check mandatory fields
-		err := dbmap.Insert(&user)
+	logger(c).Debug("post user", "user", Redact(user))
+	setTenant(c, &user)
+
+	err := user.Validate()
+	if err == nil && user.Pass != "" {
+		err = user.SetPassword(user.Pass)
+	}
+	if err == nil {
+		err = checkStatus(&user, nil)
+	}
+	if err == nil {
+		start := time.Now()
+		err = dbmap.Insert(&user)
+		trace(c, "INSERT user", start, err)
 		if err == nil {
-			c.JSON(201, user)
+			invalidate(c, "user")
+			notify(c, "user", "created", user, nil)
+			render(c, 201, user)
 		} else {
 			checkErr(err, "Insert failed")
 		}
 
 	} else {
-		c.JSON(400, gin.H{"error": "Mandatory fields are empty"})
+		renderError(c, 400, err.Error())
 	}
 
 	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"firstname\": \"Thea\", \"lastname\": \"Queen\" }" http://localhost:8080/api/v1/users
@@ -136,19 +205,19 @@ func PostUser(c *gin.Context) {
 // UpdateUser update one user by id
 func UpdateUser(c *gin.Context) {
 	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
-	verbose := c.MustGet("Verbose").(bool)
 	id := c.Params.ByName("id")
 
 	var user User
-	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE id=?", id)
+	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE "+tenantScope(c, "user", "id=?"), id)
 	if err == nil {
 		var json User
-		c.Bind(&json)
-
-		if verbose == true {
-			fmt.Println(json)
+		if bind(c, &json) != nil {
+			return
 		}
 
+		logger(c).Debug("update user", "id", id, "user", Redact(json))
+
+		previous := user
 		userId, _ := strconv.ParseInt(id, 0, 64)
 
 		//TODO : find fields via reflections
@@ -160,23 +229,38 @@ func UpdateUser(c *gin.Context) {
 			Email:   json.Email,
 			Status:  json.Status,
 			Comment: json.Comment,
+			Tenant:  user.Tenant,
 			Created: user.Created, //user read from previous select
 		}
+		if user.Pass == "" { // keep password
+			user.Pass = previous.Pass
+		}
 
-		if user.Name != "" { // XXX Check mandatory fields
+		err = user.Validate()
+		if err == nil && json.Pass != "" {
+			err = user.SetPassword(json.Pass)
+		}
+		if err == nil {
+			err = checkStatus(&user, &previous)
+		}
+		if err == nil {
+			start := time.Now()
 			_, err = dbmap.Update(&user)
+			trace(c, "UPDATE user id="+id, start, err)
 			if err == nil {
-				c.JSON(200, user)
+				invalidate(c, "user")
+				notify(c, "user", "updated", user, previous)
+				render(c, 200, user)
 			} else {
 				checkErr(err, "Updated failed")
 			}
 
 		} else {
-			c.JSON(400, gin.H{"error": "mandatory fields are empty"})
+			renderError(c, errorStatus(err), err.Error())
 		}
 
 	} else {
-		c.JSON(404, gin.H{"error": "user not found"})
+		renderError(c, 404, "user not found")
 	}
 
 	// curl -i -X PUT -H "Content-Type: application/json" -d "{ \"firstname\": \"Thea\", \"lastname\": \"Merlyn\" }" http://localhost:8080/api/v1/users/1
@@ -188,20 +272,40 @@ func DeleteUser(c *gin.Context) {
 	id := c.Params.ByName("id")
 
 	var user User
-	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE id=?", id)
+	err := dbmap.SelectOne(&user, "SELECT * FROM user WHERE "+tenantScope(c, "user", "id=?"), id)
 
 	if err == nil {
+		start := time.Now()
 		_, err = dbmap.Delete(&user)
+		trace(c, "DELETE user id="+id, start, err)
 
 		if err == nil {
-			c.JSON(200, gin.H{"id #" + id: "deleted"})
+			invalidate(c, "user")
+			notify(c, "user", "deleted", user, nil)
+			render(c, 200, gin.H{"id": user.Id, "status": "deleted"})
 		} else {
 			checkErr(err, "Delete failed")
 		}
 
 	} else {
-		c.JSON(404, gin.H{"error": "user not found"})
+		renderError(c, 404, "user not found")
 	}
 
 	// curl -i -X DELETE http://localhost:8080/api/v1/users/1
 }
+
+// PostUserTransition change status of one user, body {"status":"...","reason":"..."}
+func PostUserTransition(c *gin.Context) {
+	m, _ := ModelFor("User")
+	transition(c, m)
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"status\": \"disabled\", \"reason\": \"left\" }" http://localhost:8080/api/v1/users/1/transition
+}
+
+// GetUserTransitions return status history of one user
+func GetUserTransitions(c *gin.Context) {
+	m, _ := ModelFor("User")
+	transitions(c, m)
+
+	// curl -i http://localhost:8080/api/v1/users/1/transitions
+}
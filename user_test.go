@@ -104,7 +104,7 @@ func TestUser(t *testing.T) {
 	//fmt.Println(q)
 	query, sort, limit = ParseQuery(q)
 	//fmt.Println(query)
-	assert.Equal(t, " LIMIT 5 OFFSET 6", limit, "Parse query")
+	assert.Equal(t, " LIMIT 5 OFFSET 5", limit, "Parse query")
 
 	log.Println("= Test parsing start, end query")
 	s = "http://127.0.0.1:8080/api?_start=2&_end=4"
@@ -212,4 +212,53 @@ func TestUser(t *testing.T) {
 	router.ServeHTTP(resp, req)
 	assert.Equal(t, 400, resp.Code, "Can't update missing mandatory field in /2")
 
+	// Passwords
+	log.Println("= Pass is hashed and never rendered")
+	stored := func(id string) *User {
+		dbmap := InitDb(config.DBname)
+		defer dbmap.Db.Close()
+		var u User
+		dbmap.SelectOne(&u, "SELECT * FROM user WHERE id=?", id)
+		return &u
+	}
+	json.NewEncoder(b).Encode(User{Name: "With pass", Pass: "s3cr3t-pass"})
+	req, _ = http.NewRequest("POST", urla, b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST success")
+	assert.NotContains(t, resp.Body.String(), `"pass"`, "no pass in POST response")
+	var withPass User
+	json.Unmarshal(resp.Body.Bytes(), &withPass)
+	id := fmt.Sprint(withPass.Id)
+	assert.True(t, stored(id).CheckPassword("s3cr3t-pass"), "pass hashed")
+
+	withPass.Name = "With pass updated"
+	json.NewEncoder(b).Encode(withPass)
+	req, _ = http.NewRequest("PUT", urla+"/"+id, b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http PUT success")
+	assert.NotContains(t, resp.Body.String(), `"pass"`, "no pass in PUT response")
+	assert.True(t, stored(id).CheckPassword("s3cr3t-pass"), "empty pass keeps hash")
+
+	hashLike := stored(id).Pass
+	withPass.Pass = hashLike
+	json.NewEncoder(b).Encode(withPass)
+	req, _ = http.NewRequest("PUT", urla+"/"+id, b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http PUT success")
+	assert.NotEqual(t, hashLike, stored(id).Pass, "hash-like input hashed again")
+	assert.True(t, stored(id).CheckPassword(hashLike), "hash-like pass")
+
+	for _, path := range []string{urla, urla + "/" + id} {
+		req, _ = http.NewRequest("GET", path, nil)
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code, "http GET success")
+		assert.NotContains(t, resp.Body.String(), `"pass"`, "no pass in GET response")
+	}
 }
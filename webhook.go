@@ -0,0 +1,325 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gorp.v2"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook db and json type of a subscription to record changes
+type Webhook struct {
+	Id      int64     `db:"id" json:"id"`
+	URL     string    `db:"url" json:"url"`
+	Events  string    `db:"events" json:"events"` // comma separated: agent.created,user.*,*
+	Secret  string    `db:"secret" json:"secret,omitempty" log:"redact"`
+	Tenant  string    `db:"tenant" json:"-"` // events of other tenants are not delivered
+	Created time.Time `db:"created" json:"created"`
+	Updated time.Time `db:"updated" json:"updated"`
+}
+
+// WebhookDelivery db and json type of one delivery attempt
+type WebhookDelivery struct {
+	Id        int64     `db:"id" json:"id"`
+	WebhookId int64     `db:"webhookid" json:"webhookid"`
+	Event     string    `db:"event" json:"event"`
+	Payload   string    `db:"payload, size:16384" json:"payload"`
+	Attempt   int       `db:"attempt" json:"attempt"`
+	Status    int       `db:"status" json:"status"` // http status, 0 on network error
+	Error     string    `db:"error" json:"error"`
+	Created   time.Time `db:"created" json:"created"`
+}
+
+// PreInsert set created an updated time before insert in db
+func (a *Webhook) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	a.Updated = a.Created
+	return nil
+}
+
+// PreUpdate set updated time before insert in db
+func (a *Webhook) PreUpdate(s gorp.SqlExecutor) error {
+	a.Updated = time.Now()
+	return nil
+}
+
+// PreInsert set created time before insert in db
+func (a *WebhookDelivery) PreInsert(s gorp.SqlExecutor) error {
+	a.Created = time.Now()
+	return nil
+}
+
+// matches return true if webhook subscribed to event
+func (a *Webhook) matches(event string) bool {
+	resource := strings.SplitN(event, ".", 2)[0]
+	for _, e := range strings.Split(a.Events, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || e == event || e == resource+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher deliver events to webhooks asynchronously with retries
+type Dispatcher struct {
+	Client   *http.Client  // a client of NewDispatcher only connects to public addresses
+	Retries  int           // attempts after the first one
+	Backoff  time.Duration // delay before first retry, doubled for each retry
+	Internal bool          // also deliver to loopback, private and link-local addresses
+	wg       sync.WaitGroup
+	gate     sync.RWMutex // read by delivery logs, written by pause
+}
+
+// NewDispatcher create a dispatcher with default retries, set Internal
+// for webhooks of a local network
+func NewDispatcher() *Dispatcher {
+	d := &Dispatcher{Retries: 5, Backoff: time.Second}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: d.checkAddress}
+	d.Client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext}, // no proxy, addresses are checked
+	}
+	return d
+}
+
+// checkAddress refuse connections to loopback, private and link-local
+// addresses unless Internal, checked after DNS resolution and for redirects
+func (d *Dispatcher) checkAddress(network string, address string, c syscall.RawConn) error {
+	if d.Internal {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errors.New("webhook address " + host + " is not public")
+	}
+	return nil
+}
+
+// Middleware gin Middlware to dispatch events of handlers
+func (d *Dispatcher) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("Webhooks", d)
+		c.Next()
+	}
+}
+
+// Wait for pending deliveries, before shutdown
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// pause wait for running delivery logs and hold next ones, like during a
+// restore, call returned func to resume. Deliveries go on meanwhile.
+func (d *Dispatcher) pause() func() {
+	d.gate.Lock()
+	return d.gate.Unlock
+}
+
+// dispatch event to each subscribed webhook of the event tenant, each
+// delivery holds a reference of retain on dbmap when it is from a TenantPool
+func (d *Dispatcher) dispatch(l *slog.Logger, dbmap *gorp.DbMap, retain func() func(), e Event) {
+	var webhooks []Webhook
+	_, err := dbmap.Select(&webhooks, "SELECT * FROM webhook WHERE tenant=?", e.tenant)
+	if err != nil {
+		l.Error("webhooks select failed", "error", err)
+		return
+	}
+	body, _ := json.Marshal(e)
+	for _, w := range webhooks {
+		if w.matches(e.Event) {
+			release := func() {}
+			if retain != nil {
+				release = retain()
+			}
+			d.wg.Add(1)
+			go d.deliver(l, dbmap, release, w, e.Event, body)
+		}
+	}
+}
+
+// deliver signed payload, retry with exponential backoff, then release dbmap
+func (d *Dispatcher) deliver(l *slog.Logger, dbmap *gorp.DbMap, release func(), w Webhook, event string, body []byte) {
+	defer d.wg.Done()
+	defer release()
+	delay := d.Backoff
+	for attempt := 1; attempt <= d.Retries+1; attempt++ {
+		status, err := d.post(w, event, body)
+		delivery := WebhookDelivery{
+			WebhookId: w.Id,
+			Event:     event,
+			Payload:   string(body),
+			Attempt:   attempt,
+			Status:    status,
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		d.gate.RLock()
+		if lerr := dbmap.Insert(&delivery); lerr != nil {
+			l.Error("webhook delivery log failed", "error", lerr)
+		}
+		d.gate.RUnlock()
+		if err == nil {
+			l.Debug("webhook delivered", "webhook", w.Id, "event", event, "attempt", attempt)
+			return
+		}
+		l.Warn("webhook delivery failed", "webhook", w.Id, "event", event, "attempt", attempt, "error", err)
+		if attempt <= d.Retries {
+			time.Sleep(delay)
+			delay = delay * 2
+		}
+	}
+}
+
+func (d *Dispatcher) post(w Webhook, event string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(w.Secret, body))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("unexpected status " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign HMAC-SHA256 of a payload, hex encoded, to check X-Webhook-Signature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// REST handlers
+
+// GetWebhooks return webhooks of the request tenant, without secrets
+func GetWebhooks(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	var webhooks []Webhook
+	_, err := dbmap.Select(&webhooks, "SELECT * FROM webhook WHERE tenant=? ORDER BY id", tenantOf(c))
+
+	if err == nil {
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		c.Header("X-Total-Count", strconv.Itoa(len(webhooks)))
+		render(c, 200, webhooks)
+	} else {
+		renderError(c, 404, "no webhook(s) into the table")
+	}
+
+	// curl -i http://localhost:8080/api/v1/webhooks
+}
+
+// PostWebhook create and return one webhook
+func PostWebhook(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+
+	var webhook Webhook
+	if bind(c, &webhook) != nil {
+		return
+	}
+
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || webhook.Events == "" || webhook.Secret == "" {
+		renderError(c, 400, "Mandatory fields are empty or invalid")
+		return
+	}
+
+	setTenant(c, &webhook)
+	err = dbmap.Insert(&webhook)
+	if err == nil {
+		webhook.Secret = ""
+		render(c, 201, webhook)
+	} else {
+		renderUnavailable(c, "webhook not created", err)
+	}
+
+	// curl -i -X POST -H "Content-Type: application/json" -d "{ \"url\": \"https://example.org/hook\", \"events\": \"agent.*\", \"secret\": \"s3cr3t\" }" http://localhost:8080/api/v1/webhooks
+}
+
+// DeleteWebhook delete one webhook of the request tenant by id
+func DeleteWebhook(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	var webhook Webhook
+	err := dbmap.SelectOne(&webhook, "SELECT * FROM webhook WHERE id=? AND tenant=?", id, tenantOf(c))
+
+	if err == nil {
+		_, err = dbmap.Delete(&webhook)
+		if err == nil {
+			render(c, 200, gin.H{"id": webhook.Id, "status": "deleted"})
+		} else {
+			renderUnavailable(c, "delete failed", err)
+		}
+	} else {
+		renderError(c, 404, "webhook not found")
+	}
+
+	// curl -i -X DELETE http://localhost:8080/api/v1/webhooks/1
+}
+
+// GetWebhookDeliveries return delivery log of one webhook of the request
+// tenant filtered by URL query
+func GetWebhookDeliveries(c *gin.Context) {
+	dbmap := c.MustGet("DBmap").(*gorp.DbMap)
+	id := c.Params.ByName("id")
+
+	if n, _ := dbmap.SelectInt("SELECT COUNT(*) FROM webhook WHERE id=? AND tenant=?", id, tenantOf(c)); n == 0 {
+		renderError(c, 404, "webhook not found")
+		return
+	}
+	if err := checkFilters("webhookdelivery", c.Request.URL.Query()); err != nil {
+		renderError(c, 400, err.Error())
+		return
+	}
+	s, o, l := ParseQuery(c.Request.URL.Query())
+	where := " WHERE webhookid=?"
+	if s != "" {
+		where = where + " AND " + s
+	}
+	if o == "" {
+		o = " ORDER BY id DESC"
+	}
+	count, _ := dbmap.SelectInt("SELECT COUNT(*) FROM webhookdelivery"+where, id)
+
+	var deliveries []WebhookDelivery
+	_, err := dbmap.Select(&deliveries, "SELECT * FROM webhookdelivery"+where+o+l, id)
+
+	if err == nil {
+		c.Header("X-Total-Count", strconv.FormatInt(count, 10))
+		render(c, 200, deliveries)
+	} else {
+		renderError(c, 404, "no delivery(ies) into the table")
+	}
+
+	// curl -i http://localhost:8080/api/v1/webhooks/1/deliveries
+}
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	// receiver fails once then accepts
+	var mu sync.Mutex
+	var received []Event
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var e Event
+		json.Unmarshal(body, &e)
+		received = append(received, e)
+		assert.Equal(t, "sha256="+Sign("s3cr3t", body), r.Header.Get("X-Webhook-Signature"), "valid signature")
+	}))
+	defer receiver.Close()
+
+	dispatcher := NewDispatcher()
+	dispatcher.Backoff = 10 * time.Millisecond
+	dispatcher.Internal = true // receiver on loopback
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+	router.Use(dispatcher.Middleware())
+
+	router.POST("/webhooks", PostWebhook)
+	router.GET("/webhooks", GetWebhooks)
+	router.DELETE("/webhooks/:id", DeleteWebhook)
+	router.GET("/webhooks/:id/deliveries", GetWebhookDeliveries)
+	router.POST("/agents", PostAgent)
+	router.PUT("/agents/:id", UpdateAgent)
+	router.POST("/users", PostUser)
+
+	// Subscribe
+	log.Println("= http POST Webhook")
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(Webhook{URL: receiver.URL, Events: "agent.status,user.created", Secret: "s3cr3t"})
+	req, _ := http.NewRequest("POST", "/webhooks", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST success")
+	assert.NotContains(t, resp.Body.String(), "s3cr3t", "secret not returned")
+
+	json.NewEncoder(b).Encode(Webhook{URL: "ftp://example.org", Events: "*"})
+	req, _ = http.NewRequest("POST", "/webhooks", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code, "http POST invalid url")
+
+	json.NewEncoder(b).Encode(Webhook{URL: receiver.URL, Events: "*"})
+	req, _ = http.NewRequest("POST", "/webhooks", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code, "http POST without secret")
+
+	req, _ = http.NewRequest("GET", "/webhooks", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET all success")
+	assert.NotContains(t, resp.Body.String(), "s3cr3t", "secret not listed")
+
+	// Trigger events
+	log.Println("= Events dispatched")
+	json.NewEncoder(b).Encode(Agent{Name: "Name test", IP: "10.0.0.1", Status: "new"})
+	req, _ = http.NewRequest("POST", "/agents", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST agent, not subscribed")
+
+	json.NewEncoder(b).Encode(Agent{Name: "Name test", IP: "10.0.0.1", Status: "online"})
+	req, _ = http.NewRequest("PUT", "/agents/1", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http PUT agent status")
+	dispatcher.Wait()
+
+	json.NewEncoder(b).Encode(User{Name: "Thea", Pass: "secret pass"})
+	req, _ = http.NewRequest("POST", "/users", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 201, resp.Code, "http POST user")
+	dispatcher.Wait()
+
+	mu.Lock()
+	assert.Equal(t, 3, calls, "one retry")
+	assert.Equal(t, 2, len(received), "2 events")
+	if len(received) == 2 {
+		assert.Equal(t, "agent.status", received[0].Event, "status event")
+		assert.Equal(t, "online", received[0].Data.(map[string]interface{})["status"], "new status")
+		assert.Equal(t, "new", received[0].Previous.(map[string]interface{})["status"], "previous status")
+		assert.Equal(t, "user.created", received[1].Event, "user event")
+		assert.Nil(t, received[1].Data.(map[string]interface{})["pass"], "no pass in payload")
+	}
+	mu.Unlock()
+
+	// Delivery log
+	log.Println("= http GET deliveries")
+	req, _ = http.NewRequest("GET", "/webhooks/1/deliveries?_sortField=id&_sortDir=ASC", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http GET deliveries success")
+	var deliveries []WebhookDelivery
+	json.Unmarshal(resp.Body.Bytes(), &deliveries)
+	assert.Equal(t, 3, len(deliveries), "3 attempts")
+	if len(deliveries) == 3 {
+		assert.Equal(t, 500, deliveries[0].Status, "first attempt failed")
+		assert.Equal(t, 2, deliveries[1].Attempt, "retried")
+		assert.Equal(t, 200, deliveries[1].Status, "retry success")
+	}
+
+	log.Println("= Private addresses refused")
+	dispatcher.Internal = false
+	dispatcher.Retries = 0
+	dispatcher.Client.CloseIdleConnections() // next delivery dials again
+	json.NewEncoder(b).Encode(User{Name: "Leo"})
+	req, _ = http.NewRequest("POST", "/users", b)
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	dispatcher.Wait()
+	req, _ = http.NewRequest("GET", "/webhooks/1/deliveries?_sortField=id&_sortDir=DESC", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	json.Unmarshal(resp.Body.Bytes(), &deliveries)
+	if assert.Equal(t, 4, len(deliveries), "one more attempt") {
+		assert.Contains(t, deliveries[0].Error, "is not public", "loopback refused")
+	}
+	mu.Lock()
+	assert.Equal(t, 3, calls, "not received")
+	mu.Unlock()
+
+	// Unsubscribe
+	log.Println("= http DELETE Webhook")
+	req, _ = http.NewRequest("DELETE", "/webhooks/1", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "http DELETE success")
+	req, _ = http.NewRequest("DELETE", "/webhooks/1", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 404, resp.Code, "No more /1")
+}
+
+func TestWebhookTenants(t *testing.T) {
+	defer deleteFile(config.DBname)
+
+	var mu sync.Mutex
+	var received []Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		received = append(received, e)
+	}))
+	defer receiver.Close()
+	dispatcher := NewDispatcher()
+	dispatcher.Internal = true
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(SetConfig(config))
+	router.Use(Database(config.DBname))
+	router.Use(dispatcher.Middleware())
+	router.Use(Tenant(TenantHeader("X-Tenant")))
+	router.POST("/webhooks", PostWebhook)
+	router.GET("/webhooks", GetWebhooks)
+	router.DELETE("/webhooks/:id", DeleteWebhook)
+	router.GET("/webhooks/:id/deliveries", GetWebhookDeliveries)
+	router.POST("/agents", PostAgent)
+
+	do := func(method string, path string, tenant string, body interface{}) *httptest.ResponseRecorder {
+		b := new(bytes.Buffer)
+		if body != nil {
+			json.NewEncoder(b).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, b)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant", tenant)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	log.Println("= Webhooks of a tenant")
+	resp := do("POST", "/webhooks", "acme", Webhook{URL: receiver.URL, Events: "agent.*", Secret: "s3cr3t"})
+	assert.Equal(t, 201, resp.Code, "http POST webhook")
+	resp = do("GET", "/webhooks", "globex", nil)
+	assert.Equal(t, "0", resp.Header().Get("X-Total-Count"), "not listed for other tenant")
+	resp = do("GET", "/webhooks/1/deliveries", "globex", nil)
+	assert.Equal(t, 404, resp.Code, "no deliveries for other tenant")
+	resp = do("DELETE", "/webhooks/1", "globex", nil)
+	assert.Equal(t, 404, resp.Code, "not deleted by other tenant")
+
+	log.Println("= Events only delivered to their tenant")
+	do("POST", "/agents", "globex", Agent{Name: "web1", IP: "10.0.0.1"})
+	do("POST", "/agents", "acme", Agent{Name: "web2", IP: "10.0.0.2"})
+	dispatcher.Wait()
+	mu.Lock()
+	if assert.Equal(t, 1, len(received), "one event") {
+		assert.Equal(t, "web2", received[0].Data.(map[string]interface{})["name"], "agent of acme")
+	}
+	mu.Unlock()
+	resp = do("GET", "/webhooks/1/deliveries", "acme", nil)
+	assert.Equal(t, "1", resp.Header().Get("X-Total-Count"), "one delivery")
+}